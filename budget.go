@@ -0,0 +1,159 @@
+/*
+ * Copyright 2024 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+// ErrCacheRegistered is returned by MemoryBudget.Register when a cache is
+// already registered under the same name.
+var ErrCacheRegistered = errors.New("a cache is already registered under this name")
+
+// BudgetedCache is a cache whose MaxCost can be managed by a MemoryBudget. It
+// is implemented by *Cache.
+type BudgetedCache interface {
+	MaxCost() int64
+	UpdateMaxCost(maxCost int64)
+	UsedCost() int64
+	// Trim evicts items until the used cost is within MaxCost.
+	Trim() int
+}
+
+// MemoryBudget shares a global cost limit between several caches, e.g. all the
+// caches of a process whose costs are in bytes. Each cache asks for the MaxCost
+// it has when it is registered. As long as the caches ask for no more than the
+// limit in total, each gets what it asked for; otherwise the limit is split
+// between them in proportion to what they asked for, by updating their
+// MaxCost. The caches use the same unit of cost as the limit.
+//
+// The shares only change when a cache is registered or unregistered and when
+// the limit changes. They are based on what the caches asked for, not on the
+// cost they currently use, so a cache using less than its share doesn't lend
+// the rest to the others. When the MaxCost of a cache is lowered, its items
+// over the new MaxCost are evicted right away, so that the caches stay within
+// the limit together.
+type MemoryBudget struct {
+	mu     sync.Mutex
+	limit  int64
+	caches map[string]*budgetEntry
+}
+
+type budgetEntry struct {
+	cache BudgetedCache
+	// asked is the MaxCost of the cache when it was registered.
+	asked int64
+}
+
+// NewMemoryBudget returns a MemoryBudget sharing limit between the caches
+// registered with it.
+func NewMemoryBudget(limit int64) *MemoryBudget {
+	return &MemoryBudget{
+		limit:  limit,
+		caches: make(map[string]*budgetEntry),
+	}
+}
+
+// Register adds c to the budget under name, asking for its current MaxCost,
+// and rebalances the budget.
+func (b *MemoryBudget) Register(name string, c BudgetedCache) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.caches[name]; ok {
+		return ErrCacheRegistered
+	}
+	b.caches[name] = &budgetEntry{cache: c, asked: c.MaxCost()}
+	b.rebalance()
+	return nil
+}
+
+// Unregister removes the cache registered under name from the budget, restores
+// the MaxCost it asked for, and rebalances the budget between the other caches.
+func (b *MemoryBudget) Unregister(name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e, ok := b.caches[name]
+	if !ok {
+		return
+	}
+	delete(b.caches, name)
+	b.setMaxCost(e, e.asked)
+	b.rebalance()
+}
+
+// SetLimit changes the global limit and rebalances the budget.
+func (b *MemoryBudget) SetLimit(limit int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.limit = limit
+	b.rebalance()
+}
+
+// UsedCost returns the cost used by all the registered caches together.
+func (b *MemoryBudget) UsedCost() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var used int64
+	for _, e := range b.caches {
+		used += e.cache.UsedCost()
+	}
+	return used
+}
+
+// rebalance updates the MaxCost of every cache. b must be locked.
+func (b *MemoryBudget) rebalance() {
+	// Summed in floating point, as the sum may overflow an int64.
+	var asked float64
+	for _, e := range b.caches {
+		asked += float64(e.asked)
+	}
+	if asked <= float64(b.limit) {
+		for _, e := range b.caches {
+			b.setMaxCost(e, e.asked)
+		}
+		return
+	}
+
+	// Hand out the limit in a fixed order, so that the shares add up to the
+	// limit despite the rounding.
+	names := make([]string, 0, len(b.caches))
+	for name := range b.caches {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	left, leftAsked := b.limit, asked
+	for _, name := range names {
+		e := b.caches[name]
+		share := int64(float64(left) * float64(e.asked) / leftAsked)
+		// A MaxCost of zero would make the cache reject everything forever.
+		b.setMaxCost(e, max(share, 1))
+		left -= share
+		leftAsked -= float64(e.asked)
+	}
+}
+
+// setMaxCost updates the MaxCost of the cache, evicting its items over it if it
+// was lowered.
+func (b *MemoryBudget) setMaxCost(e *budgetEntry, maxCost int64) {
+	lowered := maxCost < e.cache.MaxCost()
+	e.cache.UpdateMaxCost(maxCost)
+	if lowered {
+		e.cache.Trim()
+	}
+}
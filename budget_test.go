@@ -0,0 +1,82 @@
+package ristretto
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newBudgetTestCache(t *testing.T, maxCost int64) *Cache[int, int] {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        1000,
+		MaxCost:            maxCost,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	require.NoError(t, err)
+	t.Cleanup(c.Close)
+	return c
+}
+
+func TestMemoryBudget(t *testing.T) {
+	a := newBudgetTestCache(t, 600)
+	b := newBudgetTestCache(t, 200)
+	c := newBudgetTestCache(t, 200)
+
+	budget := NewMemoryBudget(1000)
+	require.NoError(t, budget.Register("a", a))
+	require.NoError(t, budget.Register("b", b))
+	require.Equal(t, int64(600), a.MaxCost())
+	require.Equal(t, int64(200), b.MaxCost())
+	require.ErrorIs(t, budget.Register("b", c), ErrCacheRegistered)
+
+	budget.SetLimit(400)
+	require.Equal(t, int64(300), a.MaxCost())
+	require.Equal(t, int64(100), b.MaxCost())
+
+	require.NoError(t, budget.Register("c", c))
+	require.Equal(t, int64(240), a.MaxCost())
+	require.Equal(t, int64(80), b.MaxCost())
+	require.Equal(t, int64(80), c.MaxCost())
+
+	for i := 0; i < 50; i++ {
+		require.True(t, a.Set(i, i, 1))
+	}
+	a.Wait()
+	require.Equal(t, int64(50), budget.UsedCost())
+
+	budget.Unregister("a")
+	require.Equal(t, int64(600), a.MaxCost())
+	require.Equal(t, int64(200), b.MaxCost())
+	require.Equal(t, int64(200), c.MaxCost())
+	require.Equal(t, int64(0), budget.UsedCost())
+}
+
+func TestMemoryBudgetTrim(t *testing.T) {
+	a := newBudgetTestCache(t, 100)
+	for i := 0; i < 100; i++ {
+		require.True(t, a.Set(i, i, 1))
+	}
+	a.Wait()
+	require.Equal(t, int64(100), a.UsedCost())
+
+	budget := NewMemoryBudget(100)
+	require.NoError(t, budget.Register("a", a))
+	// Lowering the MaxCost evicts the items over it right away.
+	budget.SetLimit(40)
+	require.Equal(t, int64(40), a.MaxCost())
+	require.Equal(t, int64(40), a.UsedCost())
+	require.Equal(t, 40, a.Len())
+}
+
+func TestMemoryBudgetLargeCosts(t *testing.T) {
+	a := newBudgetTestCache(t, math.MaxInt64/2+1)
+	b := newBudgetTestCache(t, math.MaxInt64/2+1)
+
+	budget := NewMemoryBudget(math.MaxInt64 / 2)
+	require.NoError(t, budget.Register("a", a))
+	require.NoError(t, budget.Register("b", b))
+	require.InDelta(t, math.MaxInt64/4, a.MaxCost(), math.MaxInt64/1e6)
+	require.InDelta(t, math.MaxInt64/4, b.MaxCost(), math.MaxInt64/1e6)
+}
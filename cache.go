@@ -21,8 +21,14 @@ package ristretto
 
 import (
 	"bytes"
+	"context"
 	"errors"
+	"expvar"
 	"fmt"
+	"log"
+	"math"
+	"runtime"
+	"runtime/debug"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -38,6 +44,29 @@ var (
 
 const itemSize = int64(unsafe.Sizeof(storeItem[any]{}))
 
+// decaySteps is the number of steps in which the frequencies are decayed every
+// Config.DecayHalfLife, and decayFactor the factor applied at every step.
+const decaySteps = 8
+
+var decayFactor = math.Pow(0.5, 1.0/decaySteps)
+
+// Errors returned by NewCache when the Config is invalid. They can be matched
+// using errors.Is.
+var (
+	ErrZeroNumCounters     = errors.New("NumCounters can't be zero")
+	ErrNegativeNumCounters = errors.New("NumCounters can't be negative number")
+	ErrTooManyNumCounters  = fmt.Errorf("NumCounters can't be greater than %d", maxNumCounters)
+	ErrZeroMaxCost         = errors.New("MaxCost can't be zero")
+	ErrNegativeMaxCost     = errors.New("MaxCost can't be be negative number")
+	// Deprecated: a zero BufferItems now picks RecommendBufferItems.
+	ErrZeroBufferItems     = errors.New("BufferItems can't be zero")
+	ErrNegativeBufferItems = errors.New("BufferItems can't be be negative number")
+	ErrNegativeMaxKeys     = errors.New("MaxKeys can't be negative number")
+	ErrInvalidCounterBits  = errors.New("CounterBits must be 4 or 8")
+	ErrNegativeDecay       = errors.New("DecayHalfLife can't be negative")
+	ErrNegativeDefaultTTL  = errors.New("DefaultTTL can't be negative")
+)
+
 func zeroValue[T any]() T {
 	var zero T
 	return zero
@@ -49,14 +78,21 @@ type Key = z.Key
 // Cache is a thread-safe implementation of a hashmap with a TinyLFU admission
 // policy and a Sampled LFU eviction policy. You can use the same Cache instance
 // from as many goroutines as you want.
+//
+// Values of type V are copied into the cache on every Set and out of it on
+// every Get. For large struct values, prefer using a pointer type as V (and
+// pass the size of the pointed-to value as the cost) to avoid those copies.
+// See BenchmarkStoreSetLargeValue for a comparison.
 type Cache[K Key, V any] struct {
 	// storedItems is the central concurrent hashmap where key-value items are stored.
 	storedItems store[V]
 	// cachePolicy determines what gets let in to the cache and what gets kicked out.
 	cachePolicy *defaultPolicy[V]
 	// getBuf is a custom ring buffer implementation that gets pushed to when
-	// keys are read.
+	// keys are read. It is nil when Config.DisableGetBuffer is set.
 	getBuf *ringBuffer
+	// getSampleRate is the 1-in-N rate at which Gets are pushed to getBuf.
+	getSampleRate uint32
 	// setBuf is a buffer allowing us to batch/drop Sets during times of high
 	// contention.
 	setBuf chan *Item[V]
@@ -66,6 +102,20 @@ type Cache[K Key, V any] struct {
 	onReject func(*Item[V])
 	// onExit is called whenever a value goes out of scope from the cache.
 	onExit (func(V))
+	// onRemove is called exactly once for every value that leaves the cache.
+	onRemove func(*Item[V], RemoveReason)
+	// onExpire is called with the original key of the items whose TTL passed.
+	onExpire func(K, V)
+	// defaultTTL is the TTL used by Set.
+	defaultTTL time.Duration
+	// tracer is told about every Get and Set, if set.
+	tracer Tracer[K]
+	// victimChan receives the items evicted by the policy, if set.
+	victimChan chan<- Entry[K, V]
+	// onCleanup is called after every TTL cleanup cycle.
+	onCleanup func(numExpired int, took time.Duration)
+	// processGoroutines is the number of goroutines applying buffered Sets.
+	processGoroutines int
 	// KeyToHash function is used to customize the key hashing algorithm.
 	// Each key will be hashed using the provided function. If keyToHash value
 	// is not set, the default keyToHash function is used.
@@ -73,6 +123,12 @@ type Cache[K Key, V any] struct {
 	// stop is used to stop the processItems goroutine.
 	stop chan struct{}
 	done chan struct{}
+	// purge asks the processItems goroutine to remove the expired items, and
+	// to send back how many it removed on the given channel.
+	purge chan chan int
+	// shrink asks the processItems goroutine to evict items until the used
+	// cost is within MaxCost, and to send back how many it evicted.
+	shrink chan chan int
 	// indicates whether cache is closed.
 	isClosed atomic.Bool
 	// cost calculates cost from a value.
@@ -81,7 +137,20 @@ type Cache[K Key, V any] struct {
 	// the item in the cost calculation.
 	ignoreInternalCost bool
 	// cleanupTicker is used to periodically check for entries whose TTL has passed.
+	// It is nil if Config.DisableCleanup is set.
 	cleanupTicker *time.Ticker
+	// decayTicker is used to periodically decay the admission frequencies. It
+	// is nil unless Config.DecayHalfLife is set.
+	decayTicker *time.Ticker
+	// storeKeys is set if the original keys are kept along with the items.
+	storeKeys bool
+	// synchronousSet is set if Sets and Dels wait to be applied before
+	// returning.
+	synchronousSet bool
+	// logger reports problems the cache recovered from.
+	logger Logger
+	// computes tracks the GetOrCompute calls in flight, by key hash.
+	computes [numShards]computeShard[V]
 	// Metrics contains a running log of important statistics like hits, misses,
 	// and dropped items.
 	Metrics *Metrics
@@ -122,6 +191,82 @@ type Config[K Key, V any] struct {
 	// values when calling Set.
 	MaxCost int64
 
+	// MaxKeys, if set, caps the number of keys stored in the cache regardless
+	// of their cost. When a new key would exceed it, the policy evicts keys by
+	// frequency the same way it does when MaxCost is exceeded. This bounds the
+	// number of map entries (and the GC pressure) when storing many tiny items.
+	// Zero means no limit.
+	MaxKeys int64
+
+	// SampleFn, if set, replaces the random sampling of eviction candidates.
+	// When room must be made, it is called with the cost of every key tracked
+	// by the policy and should return up to n candidates; the one with the
+	// lowest estimated frequency is evicted. Keys that aren't tracked or are
+	// already candidates are ignored. It is called with the policy lock held,
+	// so it must not use the cache. This is mostly useful to make eviction
+	// deterministic in tests.
+	SampleFn func(keyCosts map[uint64]int64, n int) []SamplePair
+
+	// MaxEvictionsPerAdd caps the number of items evicted to make room for a
+	// single new item. If more would be needed, the new item is rejected and
+	// nothing is evicted, so that one large item can't wipe out many smaller
+	// ones, however frequently it is used. Zero means no cap.
+	MaxEvictionsPerAdd int
+
+	// TrackRecency set to true makes eviction pick, among the sampled
+	// candidates with the lowest frequency estimate, the one accessed least
+	// recently, instead of an arbitrary one. Ties are common once the small
+	// counters saturate or are halved, so this can improve the hit ratio of
+	// workloads where recency matters. Accesses are those recorded by the Get
+	// buffers, and Sets. This costs a map entry per key in the policy.
+	TrackRecency bool
+
+	// EvictionPolicy selects how victims are picked when room must be made.
+	// The default, EvictLFU, evicts the least frequently used items.
+	EvictionPolicy EvictionPolicy
+
+	// CounterBits is the width of the TinyLFU frequency counters, either 4 or
+	// 8. 4-bit counters saturate at 15, which is enough for most workloads.
+	// With highly skewed workloads, where a few keys dominate, 8-bit counters
+	// keep the frequency ordering among the hottest keys at the cost of twice
+	// the sketch memory. Zero means 4.
+	CounterBits int
+
+	// DecayHalfLife, if set, makes the TinyLFU frequencies decay exponentially
+	// over time, halving every DecayHalfLife, instead of being halved all at
+	// once after every NumCounters increments. The decay is applied in the
+	// background, in small steps, so that frequencies age smoothly. This suits
+	// workloads where the popularity of keys shifts gradually.
+	DecayHalfLife time.Duration
+
+	// ShardFn maps a key hash to the shard of the store holding it, modulo the
+	// number of shards. By default the key hash itself is used, which spreads
+	// the keys evenly as long as the low bits of the key hashes are random. A
+	// custom KeyToHash whose low bits are skewed, e.g. one returning multiples
+	// of 256, can set it to mix the key hash first and avoid lock contention on
+	// a few shards; see MixShardFn.
+	ShardFn func(keyHash uint64) uint64
+
+	// DisableGetBuffer makes Get skip recording accesses in the Get buffers, so
+	// that the admission policy never hears about reads. Frequencies are then
+	// driven only by Sets. This is meant for write-mostly caches where the
+	// read feedback isn't worth its cost.
+	DisableGetBuffer bool
+
+	// RingStripes, if set, makes the Get buffer use that many mutex guarded
+	// stripes instead of the default sync.Pool of stripes, whose size already
+	// follows GOMAXPROCS. On machines with many cores, a fixed number of stripes
+	// (e.g. a small multiple of GOMAXPROCS) trades a little locking for never
+	// losing stripes to GC. Zero keeps the default.
+	RingStripes int
+
+	// GetSampleRate, if greater than 1, makes only one in GetSampleRate Gets
+	// (chosen at random) feed the admission policy, cutting the contention on
+	// the Get buffer under very high read rates. When the access distribution
+	// is stable, a sample is enough for the policy to tell hot keys from cold
+	// ones.
+	GetSampleRate int
+
 	// BufferItems determines the size of Get buffers.
 	//
 	// Unless you have a rare use case, using `64` as the BufferItems value
@@ -130,6 +275,7 @@ type Config[K Key, V any] struct {
 	// If for some reason you see Get performance decreasing with lots of
 	// contention (you shouldn't), try increasing this value in increments of 64.
 	// This is a fine-tuning mechanism and you probably won't have to touch this.
+	// Zero means RecommendBufferItems.
 	BufferItems int64
 
 	// Metrics is true when you want variety of stats about the cache.
@@ -140,6 +286,30 @@ type Config[K Key, V any] struct {
 	// OnEvict is called for every eviction with the evicted item.
 	OnEvict func(item *Item[V])
 
+	// OnExpire is called with the original key and the value of every item
+	// removed by the periodic cleanup because its TTL passed, besides OnEvict,
+	// e.g. to refresh it. It isn't called for items removed early to stay
+	// within MaxExpirationBuckets, nor for expired items overwritten or deleted
+	// before the cleanup. Setting it makes the cache store keys, as with
+	// StoreKeys. It runs on the goroutine processing Sets, so it should return
+	// quickly.
+	OnExpire func(key K, value V)
+
+	// Tracer, if set, is called on every read and write of a key, e.g. to
+	// sample the accesses and analyze their distribution offline: by Get,
+	// GetNoExpiry and GetAllowStale, by Set and SetWithTTL, and by Increment,
+	// GetOrSet and GetOrCompute, which both read and write. It is called on the caller's goroutine, so
+	// it must be fast and safe for concurrent use.
+	Tracer Tracer[K]
+
+	// VictimChan, if set, receives the items evicted by the policy to make
+	// room, e.g. to demote them to a slower tier from another goroutine. The
+	// items are sent without blocking, and dropped if the channel is full. Items
+	// removed for other reasons, such as expiration, aren't sent. The cache
+	// doesn't close the channel. Setting it implies StoreKeys, so that the
+	// victims carry their OriginalKey.
+	VictimChan chan<- Entry[K, V]
+
 	// OnReject is called for every rejection done via the policy.
 	OnReject func(item *Item[V])
 
@@ -148,6 +318,15 @@ type Config[K Key, V any] struct {
 	// as well as on rejection of the value.
 	OnExit func(val V)
 
+	// OnRemove is called whenever a value leaves the cache, along with its key
+	// and the reason it was removed. Unlike OnEvict, OnReject and OnExit, which
+	// overlap, OnRemove is guaranteed to be called exactly once for every value
+	// handed to the cache by a Set call that returned true. It is never called
+	// with a zero value for a key that wasn't present. This makes it the right
+	// place to release resources held by cached values. Setting it implies
+	// StoreKeys, since the keys must be kept to be passed back.
+	OnRemove func(key K, value V, reason RemoveReason)
+
 	// ShouldUpdate is called when a value already exists in cache and is being updated.
 	// If ShouldUpdate returns true, the cache continues with the update (Set). If the
 	// function returns false, no changes are made in the cache. If the value doesn't
@@ -168,8 +347,20 @@ type Config[K Key, V any] struct {
 	// Note that if you want 128bit hashes you should use the both the values
 	// in the return of the function. If you want to use 64bit hashes, you can
 	// just return the first uint64 and return 0 for the second uint64.
+	//
+	// Be aware that a second uint64 (the conflict hash) of 0 disables the
+	// collision check for that key: any two keys with the same first uint64
+	// are then treated as the same key. A function that returns (0, 0) for
+	// many keys (e.g. on error) will make all of those keys collide silently.
+	// Use OnZeroHash to detect this.
 	KeyToHash func(key K) (uint64, uint64)
 
+	// OnZeroHash is called whenever the custom KeyToHash function returns
+	// (0, 0) for a key, which usually indicates a bug in the hash function.
+	// See KeyToHash for details. It is not called for the default KeyToHash,
+	// where a zero hash is legitimate (e.g. for the integer key 0).
+	OnZeroHash func(key K)
+
 	// Cost evaluates a value and outputs a corresponding cost. This function is ran
 	// after Set is called for a new item or an item is updated with a cost param of 0.
 	//
@@ -189,8 +380,184 @@ type Config[K Key, V any] struct {
 	// this to true will increase the memory usage.
 	IgnoreInternalCost bool
 
+	// StoreKeys set to true makes the cache keep the original key of each item,
+	// besides its hash, at the cost of the memory for one more key per item.
+	// Iterating over the cache, e.g. with the Range method of AsSyncMap,
+	// requires it.
+	StoreKeys bool
+
+	// TrackCreationTime set to true makes the cache record when each key was
+	// first inserted, which can then be retrieved using Age. Updating the value
+	// of an existing key doesn't reset its creation time. This is disabled by
+	// default to avoid the extra memory cost per entry.
+	TrackCreationTime bool
+
+	// SynchronousSet makes Set, SetWithTTL and Del wait until they are
+	// applied to the store and the policy before returning, so a Get right
+	// after a Set sees the value, without calling Wait. Sets are then never
+	// dropped when the Set buffer is full, and Set returns false only if the
+	// policy rejected the value. This serializes every write through the Set
+	// buffer and waits for it, so it lowers the write throughput a lot; it is
+	// meant for low throughput caches where correctness comes first.
+	SynchronousSet bool
+
+	// DefaultTTL is the TTL of the values added by Set, so that a cache whose
+	// values should all expire doesn't keep the ones added without a TTL by
+	// mistake forever. SetWithTTL still uses the TTL it is given, where zero
+	// means the value never expires. Zero, the default, means the values added
+	// by Set never expire.
+	DefaultTTL time.Duration
+
 	// TtlTickerDurationInSec sets the value of time ticker for cleanup keys on TTL expiry.
 	TtlTickerDurationInSec int64
+
+	// DisableCleanup stops the periodic cleanup of expired items, so that the
+	// goroutine processing Sets isn't woken up every TtlTickerDurationInSec/2
+	// seconds, e.g. for caches which never use TTLs. Expired items are still
+	// never returned by Get, but they keep their memory and cost until they are
+	// overwritten, deleted, evicted or removed by PurgeExpired.
+	DisableCleanup bool
+
+	// ProcessGoroutines is the number of goroutines applying buffered Sets to
+	// the policy and the store. It defaults to 1, which is usually the
+	// fastest, but more can help when Cost, OnEvict or the other callbacks are
+	// expensive. Items are routed by key, so the Sets and Dels of a key are
+	// still applied in order. With more than one goroutine, the callbacks may
+	// be called concurrently.
+	ProcessGoroutines int
+
+	// MaxExpirationBuckets bounds the memory used to track items with a TTL.
+	// Items are grouped into buckets by expiration time; if more than
+	// MaxExpirationBuckets buckets are left after a periodic cleanup, the
+	// buckets expiring first are cleaned up early, removing their items before
+	// they expire. OnRemove reports them with RemoveOverflow, and OnExpire
+	// isn't called for them. Zero, the default, means no bound.
+	MaxExpirationBuckets int
+
+	// MaxCleanupKeys bounds the number of expired items removed by each
+	// periodic cleanup. When a lot of items expire at once, removing them all
+	// in one go can stall Sets for a while; with a bound, the rest are removed
+	// by the following cleanups instead, spreading the work over time. Expired
+	// items are never returned by Get, even before they are removed. Zero, the
+	// default, means no bound.
+	//
+	// The bound applies to the cache as a whole, not to each shard: expired
+	// items are tracked in a single expiration map, so one budget bounds the
+	// work of a cleanup however the keys are spread across the shards.
+	MaxCleanupKeys int
+
+	// OnCleanup is called after every periodic cleanup of expired items, with
+	// the number of items expired and how long the cleanup took. It runs on
+	// the goroutine processing Sets, so it should return quickly.
+	OnCleanup func(numExpired int, took time.Duration)
+
+	// Logger is used to report problems the cache recovers from, such as a
+	// panic in one of the callbacks above. If nil, the standard log package is
+	// used.
+	Logger Logger
+}
+
+// Tracer is told about the accesses to a cache, see Config.Tracer.
+type Tracer[K Key] interface {
+	// OnGet is called on reads with the key and whether it was found.
+	OnGet(key K, hit bool)
+	// OnSet is called on writes with the key and the cost they were called
+	// with, whether or not the value ends up admitted.
+	OnSet(key K, cost int64)
+}
+
+// Logger is the interface used by the cache to report problems.
+type Logger interface {
+	Warningf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// defaultLogger is the Logger used when Config.Logger is nil.
+type defaultLogger struct{}
+
+func (defaultLogger) Warningf(format string, args ...interface{}) {
+	log.Printf("ristretto: WARNING: "+format, args...)
+}
+
+func (defaultLogger) Errorf(format string, args ...interface{}) {
+	log.Printf("ristretto: ERROR: "+format, args...)
+}
+
+// EvictionPolicy selects how the cache picks the items to evict, see
+// Config.EvictionPolicy.
+type EvictionPolicy int
+
+const (
+	// EvictLFU evicts the least frequently used item among a random sample,
+	// and only if the incoming item is used more frequently.
+	EvictLFU EvictionPolicy = iota
+	// EvictSoonestExpiring evicts the items expiring first, found through the
+	// expiration buckets, so the order is only approximate within a bucket.
+	// Such items are evicted regardless of their frequency, which suits caches
+	// where staleness matters more than popularity. Items without a TTL are
+	// evicted once no item with a TTL is left, the same way as with EvictLFU.
+	EvictSoonestExpiring
+)
+
+// RemoveReason describes why a value was removed from the cache.
+type RemoveReason int
+
+const (
+	// RemoveEvicted means the value was evicted by the policy to make room.
+	RemoveEvicted RemoveReason = iota
+	// RemoveExpired means the value was removed because its TTL had passed.
+	RemoveExpired
+	// RemoveDeleted means the value was removed by a call to Del.
+	RemoveDeleted
+	// RemoveUpdated means the value was replaced by a newer value for the same key.
+	RemoveUpdated
+	// RemoveRejected means the value was never admitted into the cache.
+	RemoveRejected
+	// RemoveCleared means the value was dropped by Clear or Close.
+	RemoveCleared
+	// RemoveOverflow means the value was removed before its TTL passed, because
+	// its expiration bucket was cleaned up early to stay within
+	// MaxExpirationBuckets.
+	RemoveOverflow
+)
+
+func (r RemoveReason) String() string {
+	switch r {
+	case RemoveEvicted:
+		return "evicted"
+	case RemoveExpired:
+		return "expired"
+	case RemoveDeleted:
+		return "deleted"
+	case RemoveUpdated:
+		return "updated"
+	case RemoveRejected:
+		return "rejected"
+	case RemoveCleared:
+		return "cleared"
+	case RemoveOverflow:
+		return "overflow"
+	default:
+		return "unidentified"
+	}
+}
+
+// WithMaxMemory configures the cache to hold roughly at most bytes of memory.
+// It sets MaxCost to bytes, makes the cache account for the internal cost of
+// storing each item and installs a Cost function returning the size of V.
+// Together, each item costs the size of V plus the size of the internal item.
+// Use a cost of 0 when calling Set so that the Cost function gets used.
+//
+// Note that the size of V is its shallow size, as reported by unsafe.Sizeof.
+// Memory referenced by V (e.g. the contents of a slice, string or pointer) is
+// not accounted for. If V references memory, provide your own Cost function.
+func (c *Config[K, V]) WithMaxMemory(bytes int64) *Config[K, V] {
+	c.MaxCost = bytes
+	c.IgnoreInternalCost = false
+	c.Cost = func(value V) int64 {
+		return int64(unsafe.Sizeof(value))
+	}
+	return c
 }
 
 type itemFlag byte
@@ -199,6 +566,9 @@ const (
 	itemNew itemFlag = iota
 	itemDelete
 	itemUpdate
+	// itemInserted marks an item that was already written to the store, and
+	// only needs to be admitted by the policy.
+	itemInserted
 )
 
 // Item is a full representation of what's stored in the cache for each key-value pair.
@@ -210,67 +580,201 @@ type Item[V any] struct {
 	Cost       int64
 	Expiration time.Time
 	wg         *sync.WaitGroup
+	// origKey is the key the item was set with. It is only set when the
+	// cache stores keys, see Config.StoreKeys.
+	origKey any
+	// gen identifies an item inserted by the store's Upsert.
+	gen uint64
+	// overflow is set on the items removed by the expiration cleanup before
+	// they expired, to stay within MaxExpirationBuckets.
+	overflow bool
+	// applied, if set, is closed once the item is applied or dropped, after
+	// stored is set if the value was admitted. It is used by SynchronousSet.
+	applied chan struct{}
+	stored  bool
+}
+
+// Outside of this range, BufferItems is most likely a mistake, e.g. a
+// number of bytes or of items of the cache.
+const (
+	minSaneBufferItems = 8
+	maxSaneBufferItems = 1 << 16
+)
+
+// RecommendBufferItems returns the BufferItems value that works well for a
+// cache used by gomaxprocs goroutines, which is used when BufferItems is zero.
+// The Get buffers are already striped per P, so this is 64 regardless of
+// gomaxprocs for now.
+func RecommendBufferItems(gomaxprocs int) int64 {
+	return 64
 }
 
 // NewCache returns a new Cache instance and any configuration errors, if any.
 func NewCache[K Key, V any](config *Config[K, V]) (*Cache[K, V], error) {
 	switch {
 	case config.NumCounters == 0:
-		return nil, errors.New("NumCounters can't be zero")
+		return nil, ErrZeroNumCounters
 	case config.NumCounters < 0:
-		return nil, errors.New("NumCounters can't be negative number")
+		return nil, ErrNegativeNumCounters
+	case config.NumCounters > maxNumCounters:
+		return nil, ErrTooManyNumCounters
 	case config.MaxCost == 0:
-		return nil, errors.New("MaxCost can't be zero")
+		return nil, ErrZeroMaxCost
 	case config.MaxCost < 0:
-		return nil, errors.New("MaxCost can't be be negative number")
-	case config.BufferItems == 0:
-		return nil, errors.New("BufferItems can't be zero")
+		return nil, ErrNegativeMaxCost
 	case config.BufferItems < 0:
-		return nil, errors.New("BufferItems can't be be negative number")
+		return nil, ErrNegativeBufferItems
+	case config.MaxKeys < 0:
+		return nil, ErrNegativeMaxKeys
+	case config.CounterBits != 0 && config.CounterBits != 4 && config.CounterBits != 8:
+		return nil, ErrInvalidCounterBits
+	case config.DecayHalfLife < 0:
+		return nil, ErrNegativeDecay
+	case config.DefaultTTL < 0:
+		return nil, ErrNegativeDefaultTTL
 	case config.TtlTickerDurationInSec == 0:
 		config.TtlTickerDurationInSec = bucketDurationSecs
 	}
-	policy := newPolicy[V](config.NumCounters, config.MaxCost)
+	counterBits := config.CounterBits
+	if counterBits == 0 {
+		counterBits = 4
+	}
+	policy := newDefaultPolicyWithBits[V](config.NumCounters, config.MaxCost, counterBits)
+	policy.evict.maxKeys = config.MaxKeys
+	policy.evict.sampleFn = config.SampleFn
+	policy.evict.maxEvictions = config.MaxEvictionsPerAdd
+	if config.TrackRecency {
+		policy.evict.lastAccess = make(map[uint64]uint64)
+	}
+	policy.admit.decaying = config.DecayHalfLife > 0
 	cache := &Cache[K, V]{
 		storedItems:        newStore[V](),
 		cachePolicy:        policy,
-		getBuf:             newRingBuffer(policy, config.BufferItems),
 		setBuf:             make(chan *Item[V], setBufSize),
 		keyToHash:          config.KeyToHash,
 		stop:               make(chan struct{}),
 		done:               make(chan struct{}),
+		purge:              make(chan chan int),
+		shrink:             make(chan chan int),
 		cost:               config.Cost,
 		ignoreInternalCost: config.IgnoreInternalCost,
-		cleanupTicker:      time.NewTicker(time.Duration(config.TtlTickerDurationInSec) * time.Second / 2),
+		logger:             config.Logger,
+		onCleanup:          config.OnCleanup,
+		victimChan:         config.VictimChan,
+		tracer:             config.Tracer,
+		defaultTTL:         config.DefaultTTL,
+		synchronousSet:     config.SynchronousSet,
+	}
+	if cache.logger == nil {
+		cache.logger = defaultLogger{}
+	}
+	bufferItems := config.BufferItems
+	switch {
+	case bufferItems == 0:
+		bufferItems = RecommendBufferItems(runtime.GOMAXPROCS(0))
+	case bufferItems < minSaneBufferItems || bufferItems > maxSaneBufferItems:
+		cache.logger.Warningf("BufferItems of %d is unusual, 64 is recommended", bufferItems)
+	}
+	cache.storedItems.SetShouldUpdateFn(cache.guardShouldUpdate(config.ShouldUpdate))
+	if config.ShardFn != nil {
+		cache.storedItems.SetShardFn(config.ShardFn)
+	}
+	if config.TrackCreationTime {
+		cache.storedItems.TrackCreationTime()
+	}
+	if config.EvictionPolicy == EvictSoonestExpiring {
+		policy.evict.soonestFn = cache.storedItems.SoonestExpiring
+	}
+	if config.MaxExpirationBuckets > 0 {
+		cache.storedItems.SetMaxExpirationBuckets(config.MaxExpirationBuckets)
+	}
+	if config.MaxCleanupKeys > 0 {
+		cache.storedItems.SetMaxCleanupKeys(config.MaxCleanupKeys)
+	}
+	if config.StoreKeys || config.OnExpire != nil || config.OnRemove != nil ||
+		config.VictimChan != nil {
+		cache.storeKeys = true
+		cache.storedItems.TrackKeys()
+	}
+	if !config.DisableCleanup {
+		cache.cleanupTicker = time.NewTicker(
+			time.Duration(config.TtlTickerDurationInSec) * time.Second / 2)
+	}
+	if config.DecayHalfLife > 0 {
+		cache.decayTicker = time.NewTicker(config.DecayHalfLife / decaySteps)
+	}
+	if config.GetSampleRate > 1 {
+		cache.getSampleRate = uint32(config.GetSampleRate)
+	}
+	switch {
+	case config.DisableGetBuffer:
+	case config.RingStripes > 0:
+		cache.getBuf = newStripedRingBuffer(policy, bufferItems, config.RingStripes)
+	default:
+		cache.getBuf = newRingBuffer(policy, bufferItems)
 	}
-	cache.storedItems.SetShouldUpdateFn(config.ShouldUpdate)
+	// A panic in a callback is logged and ignored, so that the bookkeeping
+	// around it always completes.
 	cache.onExit = func(val V) {
 		if config.OnExit != nil {
+			defer cache.recoverPanic("calling OnExit")
 			config.OnExit(val)
 		}
 	}
 	cache.onEvict = func(item *Item[V]) {
 		if config.OnEvict != nil {
-			config.OnEvict(item)
+			func() {
+				defer cache.recoverPanic("calling OnEvict")
+				config.OnEvict(item)
+			}()
 		}
 		cache.onExit(item.Value)
 	}
 	cache.onReject = func(item *Item[V]) {
 		if config.OnReject != nil {
-			config.OnReject(item)
+			func() {
+				defer cache.recoverPanic("calling OnReject")
+				config.OnReject(item)
+			}()
 		}
 		cache.onExit(item.Value)
 	}
+	cache.onRemove = func(item *Item[V], reason RemoveReason) {
+		if config.OnRemove != nil {
+			defer cache.recoverPanic("calling OnRemove")
+			var key K
+			if item.origKey != nil {
+				key = item.origKey.(K)
+			}
+			config.OnRemove(key, item.Value, reason)
+		}
+	}
+	if config.OnExpire != nil {
+		cache.onExpire = func(key K, value V) {
+			defer cache.recoverPanic("calling OnExpire")
+			config.OnExpire(key, value)
+		}
+	}
 	if cache.keyToHash == nil {
-		cache.keyToHash = z.KeyToHash[K]
+		cache.keyToHash = z.KeyToHashFunc[K]()
+	} else if config.OnZeroHash != nil {
+		keyToHash := cache.keyToHash
+		cache.keyToHash = func(key K) (uint64, uint64) {
+			keyHash, conflictHash := keyToHash(key)
+			if keyHash == 0 && conflictHash == 0 {
+				config.OnZeroHash(key)
+			}
+			return keyHash, conflictHash
+		}
 	}
 
 	if config.Metrics {
 		cache.collectMetrics()
 	}
 	// NOTE: benchmarks seem to show that performance decreases the more
-	//       goroutines we have running cache.processItems(), so 1 should
-	//       usually be sufficient
+	//       goroutines we have processing items, so 1 should usually be
+	//       sufficient. See Config.ProcessGoroutines.
+	cache.processGoroutines = max(config.ProcessGoroutines, 1)
 	go cache.processItems()
 	return cache, nil
 }
@@ -295,8 +799,28 @@ func (c *Cache[K, V]) Get(key K) (V, bool) {
 		return zeroValue[V](), false
 	}
 	keyHash, conflictHash := c.keyToHash(key)
+	value, ok := c.get(keyHash, conflictHash)
+	c.traceGet(key, ok)
+	return value, ok
+}
 
-	c.getBuf.Push(keyHash)
+// traceGet tells Config.Tracer, if set, about a read of key.
+func (c *Cache[K, V]) traceGet(key K, hit bool) {
+	if c.tracer != nil {
+		c.tracer.OnGet(key, hit)
+	}
+}
+
+// traceSet tells Config.Tracer, if set, about a write of key.
+func (c *Cache[K, V]) traceSet(key K, cost int64) {
+	if c.tracer != nil {
+		c.tracer.OnSet(key, cost)
+	}
+}
+
+// get is Get for a key which was already hashed.
+func (c *Cache[K, V]) get(keyHash, conflictHash uint64) (V, bool) {
+	c.recordAccess(keyHash)
 	value, ok := c.storedItems.Get(keyHash, conflictHash)
 	if ok {
 		c.Metrics.add(hit, keyHash, 1)
@@ -306,6 +830,61 @@ func (c *Cache[K, V]) Get(key K) (V, bool) {
 	return value, ok
 }
 
+// GetNoExpiry is like Get, but it skips the expiration check, for callers that
+// track the freshness of values themselves, e.g. in a tight loop over keys they
+// just found fresh. It may return a value whose TTL has passed, as long as it
+// hasn't been removed by the periodic cleanup yet. Note that Get only reads the
+// clock for items with a TTL, so this saves little on caches without TTLs.
+func (c *Cache[K, V]) GetNoExpiry(key K) (V, bool) {
+	if c == nil || c.isClosed.Load() {
+		return zeroValue[V](), false
+	}
+	keyHash, conflictHash := c.keyToHash(key)
+
+	c.recordAccess(keyHash)
+	value, ok := c.storedItems.GetNoExpiry(keyHash, conflictHash)
+	if ok {
+		c.Metrics.add(hit, keyHash, 1)
+	} else {
+		c.Metrics.add(miss, keyHash, 1)
+	}
+	c.traceGet(key, ok)
+	return value, ok
+}
+
+// recordAccess pushes the key to the Get buffer, so that the policy learns
+// about the access, unless Gets are sampled and this one isn't.
+func (c *Cache[K, V]) recordAccess(keyHash uint64) {
+	if c.getBuf == nil {
+		return
+	}
+	if c.getSampleRate > 1 && z.FastRand()%c.getSampleRate != 0 {
+		return
+	}
+	c.getBuf.Push(keyHash)
+}
+
+// GetAllowStale is like Get, but it also returns values whose TTL has passed,
+// as long as they haven't been removed by the periodic cleanup yet. stale is
+// true for such values. This allows serving stale data while refreshing it in
+// the background, instead of missing.
+func (c *Cache[K, V]) GetAllowStale(key K) (value V, stale bool, ok bool) {
+	if c == nil || c.isClosed.Load() {
+		return zeroValue[V](), false, false
+	}
+	keyHash, conflictHash := c.keyToHash(key)
+
+	c.recordAccess(keyHash)
+	value, stale, ok = c.storedItems.GetAllowStale(keyHash, conflictHash)
+	if ok {
+		c.Metrics.add(hit, keyHash, 1)
+	} else {
+		c.Metrics.add(miss, keyHash, 1)
+	}
+	c.traceGet(key, ok)
+	return value, stale, ok
+}
+
 // Set attempts to add the key-value item to the cache. If it returns false,
 // then the Set was dropped and the key-value item isn't added to the cache. If
 // it returns true, there's still a chance it could be dropped by the policy if
@@ -321,8 +900,35 @@ func (c *Cache[K, V]) Get(key K) (V, bool) {
 // will not be reflected in the cache. Be careful when using slice types as the
 // value type V. Calling `append` may update the underlined array pointer which
 // will not be reflected in the cache.
+//
+// The value expires after Config.DefaultTTL, if set; otherwise it never expires.
 func (c *Cache[K, V]) Set(key K, value V, cost int64) bool {
-	return c.SetWithTTL(key, value, cost, 0*time.Second)
+	if c == nil {
+		return false
+	}
+	return c.SetWithTTL(key, value, cost, c.defaultTTL)
+}
+
+// SetAndCost works like Set, but also returns the cost the item is charged,
+// Config.Cost and the internal cost included, so that producers can track how
+// much of MaxCost their items take. A cost of 0 is computed right away with
+// Config.Cost, on the caller's goroutine, instead of when the Set is applied.
+// finalCost is 0 if the Set was dropped. As with Set, an accepted item may still
+// be rejected by the policy.
+func (c *Cache[K, V]) SetAndCost(key K, value V, cost int64) (accepted bool, finalCost int64) {
+	if c == nil || c.isClosed.Load() {
+		return false, 0
+	}
+	if cost == 0 && c.cost != nil {
+		cost = c.cost(value)
+	}
+	if !c.SetWithTTL(key, value, cost, c.defaultTTL) {
+		return false, 0
+	}
+	if !c.ignoreInternalCost {
+		cost += itemSize
+	}
+	return true, cost
 }
 
 // SetWithTTL works like Set but adds a key-value pair to the cache that will expire
@@ -335,7 +941,19 @@ func (c *Cache[K, V]) SetWithTTL(key K, value V, cost int64, ttl time.Duration)
 	if c == nil || c.isClosed.Load() {
 		return false
 	}
+	c.traceSet(key, cost)
+	keyHash, conflictHash := c.keyToHash(key)
+	var origKey any
+	if c.storeKeys {
+		origKey = key
+	}
+	return c.set(keyHash, conflictHash, origKey, value, cost, ttl)
+}
 
+// set is SetWithTTL for a key which was already hashed. origKey is kept along
+// with the item if it isn't nil.
+func (c *Cache[K, V]) set(keyHash, conflictHash uint64, origKey any, value V, cost int64,
+	ttl time.Duration) bool {
 	var expiration time.Time
 	switch {
 	case ttl == 0:
@@ -348,7 +966,6 @@ func (c *Cache[K, V]) SetWithTTL(key K, value V, cost int64, ttl time.Duration)
 		expiration = time.Now().Add(ttl)
 	}
 
-	keyHash, conflictHash := c.keyToHash(key)
 	i := &Item[V]{
 		flag:       itemNew,
 		Key:        keyHash,
@@ -356,13 +973,23 @@ func (c *Cache[K, V]) SetWithTTL(key K, value V, cost int64, ttl time.Duration)
 		Value:      value,
 		Cost:       cost,
 		Expiration: expiration,
+		origKey:    origKey,
 	}
 	// cost is eventually updated. The expiration must also be immediately updated
 	// to prevent items from being prematurely removed from the map.
 	if prev, ok := c.storedItems.Update(i); ok {
 		c.onExit(prev)
+		c.onRemove(&Item[V]{Key: keyHash, Conflict: conflictHash, Value: prev,
+			origKey: origKey}, RemoveUpdated)
 		i.flag = itemUpdate
 	}
+	if c.synchronousSet {
+		i.applied = make(chan struct{})
+		c.setBuf <- i
+		<-i.applied
+		// An update was already applied to the store above.
+		return i.flag == itemUpdate || i.stored
+	}
 	// Attempt to send item to cachePolicy.
 	select {
 	case c.setBuf <- i:
@@ -379,15 +1006,342 @@ func (c *Cache[K, V]) SetWithTTL(key K, value V, cost int64, ttl time.Duration)
 	}
 }
 
+// Recost re-runs Config.Cost on the current value of key and updates the cost
+// the policy accounts for it, for values whose size changes in place. Like Set,
+// the update is applied asynchronously; call Wait to see it applied. It returns
+// false if the key isn't in the cache, the cache has no Cost function, or the
+// update was dropped.
+func (c *Cache[K, V]) Recost(key K) bool {
+	if c == nil || c.isClosed.Load() || c.cost == nil {
+		return false
+	}
+	keyHash, conflictHash := c.keyToHash(key)
+	value, ok := c.storedItems.Get(keyHash, conflictHash)
+	if !ok {
+		return false
+	}
+	// A cost of 0 makes processItems compute it with c.cost.
+	i := &Item[V]{
+		flag:     itemUpdate,
+		Key:      keyHash,
+		Conflict: conflictHash,
+		Value:    value,
+	}
+	select {
+	case c.setBuf <- i:
+		return true
+	default:
+		c.Metrics.add(dropSets, keyHash, 1)
+		return false
+	}
+}
+
+// RecostAll re-runs Config.Cost on every value in the cache and updates the
+// costs the policy accounts for them, e.g. after fixing the size estimation
+// done by Config.Cost. Buffered Sets are applied first. Items over MaxCost,
+// if the costs grew, are evicted as new items are added. It does nothing if
+// the cache has no Cost function. Sets made while RecostAll runs may be
+// dropped.
+func (c *Cache[K, V]) RecostAll() {
+	if c == nil || c.isClosed.Load() || c.cost == nil {
+		return
+	}
+	c.Wait()
+	// Block until processItems goroutine is returned, so that the costs
+	// computed here aren't overwritten by Sets being applied concurrently.
+	c.stop <- struct{}{}
+	<-c.done
+
+	type entry struct {
+		keyHash uint64
+		value   V
+	}
+	var entries []entry
+	c.storedItems.IterHashes(func(keyHash uint64, value V) bool {
+		entries = append(entries, entry{keyHash, value})
+		return true
+	})
+	func() {
+		defer c.recoverPanic("recosting items")
+		for _, e := range entries {
+			cost := c.cost(e.value)
+			if !c.ignoreInternalCost {
+				cost += itemSize
+			}
+			c.cachePolicy.Update(e.keyHash, cost)
+		}
+	}()
+	// Restart processItems goroutine.
+	go c.processItems()
+}
+
+// SetWithContext works like SetWithTTL, but returns false without touching the
+// cache if ctx has already been cancelled. This avoids wasting buffer space on
+// behalf of requests that are no longer alive.
+//
+// See Set for more information.
+func (c *Cache[K, V]) SetWithContext(ctx context.Context, key K, value V, cost int64,
+	ttl time.Duration) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	return c.SetWithTTL(key, value, cost, ttl)
+}
+
+// GetOrSet returns the value of key if it is in the cache and not expired, or
+// else sets it to value and returns value. inserted is true if value was set.
+// Concurrent calls for a missing key agree on a single value: exactly one of
+// them inserts its value, and the others get it.
+//
+// Unlike Set, the value is written to the store right away under the shard
+// lock, so it is visible to Get immediately. It is then admitted by the policy
+// asynchronously, and may still be rejected. A cost of 0 is computed with
+// Config.Cost. The value expires after Config.DefaultTTL, if set. value is
+// returned, but not set, if the cache is closed or a different key is stored
+// under the same hash.
+func (c *Cache[K, V]) GetOrSet(key K, value V, cost int64) (actual V, inserted bool) {
+	actual, inserted, ok := c.getOrSet(key, value, cost)
+	if ok {
+		c.traceGet(key, !inserted)
+		if inserted {
+			c.traceSet(key, cost)
+		}
+	}
+	return actual, inserted
+}
+
+// getOrSet is GetOrSet without the calls to Config.Tracer. ok is false if
+// nothing was read or set.
+func (c *Cache[K, V]) getOrSet(key K, value V, cost int64) (actual V, inserted, ok bool) {
+	if c == nil || c.isClosed.Load() {
+		return value, false, false
+	}
+	actual, inserted, ok = c.upsert(key, cost, c.defaultTTL, func(cur V, found bool) V {
+		if found {
+			return cur
+		}
+		return value
+	})
+	if !ok {
+		return value, false, false
+	}
+	return actual, inserted, true
+}
+
+// Integer is the constraint for the values of caches used with Increment.
+type Integer interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 |
+		~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr
+}
+
+// Increment atomically adds delta to the value of key and returns the result.
+// If the key is missing or expired, it is set to delta with the given cost and
+// ttl; cost and ttl are ignored for existing keys, so a counter keeps the TTL
+// it was created with, which suits fixed-window rate limiting.
+//
+// Unlike Set, the value is written to the store right away under the shard
+// lock, so concurrent increments are never lost and are visible to Get
+// immediately. A new key is then admitted by the policy asynchronously, and may
+// still be rejected. The bool is false if the cache is closed, ttl is negative,
+// or a different key is stored under the same hash.
+func Increment[K Key, V Integer](c *Cache[K, V], key K, delta, cost int64,
+	ttl time.Duration) (int64, bool) {
+	v, inserted, ok := c.upsert(key, cost, ttl, func(cur V, found bool) V {
+		return cur + V(delta)
+	})
+	if ok {
+		c.traceGet(key, !inserted)
+		c.traceSet(key, cost)
+	}
+	return int64(v), ok
+}
+
+// CompareAndSwap atomically replaces the value of key with new if its current
+// value is old, and returns whether it did. The key must be in the cache and
+// not expired; it keeps its expiration.
+//
+// Unlike Set, the value is swapped in the store right away under the shard
+// lock, so it is visible to Get immediately and concurrent swaps from the same
+// old value can't both succeed. The cost of the item is then updated to cost
+// asynchronously; the update may be dropped if the Set buffer is full, in which
+// case the item keeps its previous cost.
+func CompareAndSwap[K Key, V comparable](c *Cache[K, V], key K, old, new V,
+	cost int64) bool {
+	if c == nil || c.isClosed.Load() {
+		return false
+	}
+	keyHash, conflictHash := c.keyToHash(key)
+	i := &Item[V]{
+		flag:     itemUpdate,
+		Key:      keyHash,
+		Conflict: conflictHash,
+		Value:    new,
+		Cost:     cost,
+	}
+	prev, ok := c.storedItems.CompareAndSwap(i, func(cur V) bool {
+		return cur == old
+	})
+	if !ok {
+		return false
+	}
+	c.onExit(prev)
+	replaced := &Item[V]{Key: keyHash, Conflict: conflictHash, Value: prev}
+	if c.storeKeys {
+		replaced.origKey = key
+	}
+	c.onRemove(replaced, RemoveUpdated)
+	select {
+	case c.setBuf <- i:
+	default:
+		c.Metrics.add(dropSets, keyHash, 1)
+	}
+	return true
+}
+
+// upsert atomically replaces the value of key with fn(current, true), or, if
+// the key is missing or expired, stores fn(zero, false) with the given cost and
+// ttl and sends it to the policy for admission, in which case inserted is true.
+func (c *Cache[K, V]) upsert(key K, cost int64, ttl time.Duration,
+	fn func(cur V, found bool) V) (value V, inserted, ok bool) {
+	if c == nil || c.isClosed.Load() || ttl < 0 {
+		return zeroValue[V](), false, false
+	}
+	var expiration time.Time
+	if ttl > 0 {
+		expiration = time.Now().Add(ttl)
+	}
+
+	keyHash, conflictHash := c.keyToHash(key)
+	i := &Item[V]{
+		flag:       itemInserted,
+		Key:        keyHash,
+		Conflict:   conflictHash,
+		Cost:       cost,
+		Expiration: expiration,
+	}
+	if c.storeKeys {
+		i.origKey = key
+	}
+	value, expired, inserted, ok := c.storedItems.Upsert(i, fn)
+	if !ok {
+		return zeroValue[V](), false, false
+	}
+	if expired != nil {
+		c.Metrics.add(keyExpire, keyHash, 1)
+		c.onExit(expired.Value)
+		c.onRemove(expired, RemoveExpired)
+		if c.onExpire != nil && expired.origKey != nil {
+			c.onExpire(expired.origKey.(K), expired.Value)
+		}
+	}
+	if inserted {
+		// The item is already in the store, so it can't be dropped: the policy
+		// has to learn about it to account for its cost.
+		c.setBuf <- i
+	}
+	return value, inserted, true
+}
+
+// Range calls fn for every key and value in the cache, skipping expired items,
+// until fn returns false, e.g. to dump the cache contents or to persist them.
+// It requires Config.StoreKeys, and returns ErrKeysNotStored otherwise.
+//
+// The order is unspecified and changes between calls. Each shard is copied
+// before fn is called on its items, so fn doesn't block writers and may use
+// the cache, but items set or deleted during the iteration may or may not be
+// seen.
+func (c *Cache[K, V]) Range(fn func(key K, value V) bool) error {
+	if c == nil || c.isClosed.Load() {
+		return nil
+	}
+	if !c.storeKeys {
+		return ErrKeysNotStored
+	}
+	c.storedItems.Iter(func(key any, value V) bool {
+		return fn(key.(K), value)
+	})
+	return nil
+}
+
+// ForEachExpiring calls fn for every item which will expire within the given
+// duration, soonest first, with the time left before it does, until fn returns
+// false. Items are found through the expiration buckets, so this doesn't scan
+// the whole cache. It requires Config.StoreKeys, and returns ErrKeysNotStored
+// otherwise. fn may use the cache.
+func (c *Cache[K, V]) ForEachExpiring(within time.Duration,
+	fn func(key K, value V, remaining time.Duration) bool) error {
+	if c == nil || c.isClosed.Load() {
+		return nil
+	}
+	if !c.storeKeys {
+		return ErrKeysNotStored
+	}
+	c.storedItems.IterExpiring(time.Now().Add(within),
+		func(key any, value V, expiration time.Time) bool {
+			return fn(key.(K), value, time.Until(expiration))
+		})
+	return nil
+}
+
+// Pin prevents key from being evicted to make room for other items until it is
+// unpinned, e.g. while its value is in use. It doesn't prevent the key from
+// being deleted, expiring or being cleared, and it can be called before the key
+// is set. If pinned keys use up MaxCost, new items are rejected. Pins aren't
+// counted: a single Unpin undoes any number of Pins.
+func (c *Cache[K, V]) Pin(key K) {
+	if c == nil || c.isClosed.Load() {
+		return
+	}
+	keyHash, _ := c.keyToHash(key)
+	c.cachePolicy.Pin(keyHash)
+}
+
+// Unpin lets key be evicted again, see Pin.
+func (c *Cache[K, V]) Unpin(key K) {
+	if c == nil || c.isClosed.Load() {
+		return
+	}
+	keyHash, _ := c.keyToHash(key)
+	c.cachePolicy.Unpin(keyHash)
+}
+
 // Del deletes the key-value item from the cache if it exists.
 func (c *Cache[K, V]) Del(key K) {
 	if c == nil || c.isClosed.Load() {
 		return
 	}
 	keyHash, conflictHash := c.keyToHash(key)
+	c.del(keyHash, conflictHash)
+}
+
+// DelByHashes deletes the items stored under the given key hashes (as returned
+// by HashOf). Since the original keys aren't known, the conflict hash isn't
+// checked. If two keys share the same key hash, the one currently stored will
+// be deleted, which is acceptable for invalidation purposes.
+func (c *Cache[K, V]) DelByHashes(hashes []uint64) {
+	if c == nil || c.isClosed.Load() {
+		return
+	}
+	for _, keyHash := range hashes {
+		c.del(keyHash, 0)
+	}
+}
+
+// del deletes the item with the given hashes. A conflictHash of zero deletes
+// the item regardless of its conflict hash.
+func (c *Cache[K, V]) del(keyHash, conflictHash uint64) {
+	// The original key, if stored, is gone once the item is deleted.
+	var origKey any
+	if c.storeKeys {
+		_, origKey, _ = c.storedItems.Entry(keyHash)
+	}
 	// Delete immediately.
-	_, prev := c.storedItems.Del(keyHash, conflictHash)
+	_, prev, ok := c.storedItems.Del(keyHash, conflictHash)
 	c.onExit(prev)
+	if ok {
+		c.onRemove(&Item[V]{Key: keyHash, Conflict: conflictHash, Value: prev,
+			origKey: origKey}, RemoveDeleted)
+	}
 	// If we've set an item, it would be applied slightly later.
 	// So we must push the same item to `setBuf` with the deletion flag.
 	// This ensures that if a set is followed by a delete, it will be
@@ -397,6 +1351,9 @@ func (c *Cache[K, V]) Del(key K) {
 		Key:      keyHash,
 		Conflict: conflictHash,
 	}
+	if c.synchronousSet {
+		c.Wait()
+	}
 }
 
 // GetTTL returns the TTL for the specified key and a bool that is true if the
@@ -426,6 +1383,116 @@ func (c *Cache[K, V]) GetTTL(key K) (time.Duration, bool) {
 	return time.Until(expiration), true
 }
 
+// Age returns how long ago the key was first inserted into the cache and a bool
+// that is true if the item was found and is not expired. It always returns false
+// unless Config.TrackCreationTime is set.
+func (c *Cache[K, V]) Age(key K) (time.Duration, bool) {
+	if c == nil || c.isClosed.Load() {
+		return 0, false
+	}
+	keyHash, conflictHash := c.keyToHash(key)
+	if _, ok := c.storedItems.Get(keyHash, conflictHash); !ok {
+		return 0, false
+	}
+	created, ok := c.storedItems.Created(keyHash)
+	if !ok {
+		return 0, false
+	}
+	return time.Since(created), true
+}
+
+// Entry is the internal state of a single item of the cache, as returned by
+// Cache.Entry.
+type Entry[K Key, V any] struct {
+	// Key and Conflict are the key hash and the conflict hash of the item.
+	Key      uint64
+	Conflict uint64
+	// OriginalKey is the key the item was set with. It is only known when the
+	// cache stores keys, see Config.StoreKeys, and is the zero value otherwise.
+	OriginalKey K
+	Value       V
+	// Expiration is zero for items without a TTL.
+	Expiration time.Time
+	// Cost is the cost the policy charges for the item, its internal cost
+	// included, or -1 if the policy doesn't know the item.
+	Cost int64
+}
+
+// Entry returns the internal state of the item stored under the key hash of
+// key, and a bool that is true if there is one, to help debug hash conflicts
+// and expirations. Unlike Get, it also returns items that expired but weren't
+// cleaned up yet, and items stored under the same key hash by another key,
+// whose Conflict differs from the conflict hash of key (see HashOf). Sets still
+// buffered aren't seen.
+func (c *Cache[K, V]) Entry(key K) (Entry[K, V], bool) {
+	if c == nil || c.isClosed.Load() {
+		return Entry[K, V]{}, false
+	}
+	keyHash, _ := c.keyToHash(key)
+	item, origKey, ok := c.storedItems.Entry(keyHash)
+	if !ok {
+		return Entry[K, V]{}, false
+	}
+	entry := Entry[K, V]{
+		Key:        item.key,
+		Conflict:   item.conflict,
+		Value:      item.value,
+		Expiration: item.expiration,
+		Cost:       c.cachePolicy.Cost(keyHash),
+	}
+	if origKey != nil {
+		entry.OriginalKey = origKey.(K)
+	}
+	return entry, true
+}
+
+// PurgeExpired removes all the items whose TTL passed right away, rather than
+// waiting for the periodic cleanup, which only removes them once the whole
+// expiration bucket they are in is past. It returns the number of items it
+// removed, for which OnEvict, OnExpire and OnRemove are called as for the
+// periodic cleanup. This is meant for tests, or before measuring memory; it
+// blocks while the goroutine processing Sets runs it.
+func (c *Cache[K, V]) PurgeExpired() int {
+	if c == nil || c.isClosed.Load() {
+		return 0
+	}
+	res := make(chan int, 1)
+	c.purge <- res
+	return <-res
+}
+
+// ExpirationStats returns the number of buckets used to track items with a TTL
+// and the number of items in them. Each tracked item takes two words plus the
+// overhead of the bucket map, so numKeys gives a rough idea of the memory used.
+// See Config.MaxExpirationBuckets to bound it.
+func (c *Cache[K, V]) ExpirationStats() (numBuckets, numKeys int) {
+	if c == nil || c.isClosed.Load() {
+		return 0, 0
+	}
+	return c.storedItems.ExpirationStats()
+}
+
+// HashOf returns the key hash and the conflict hash the cache uses for key.
+// Two keys can't coexist in the cache if they share the same key hash, so this
+// is useful to debug collisions when using a custom KeyToHash function.
+func (c *Cache[K, V]) HashOf(key K) (keyHash, conflictHash uint64) {
+	if c == nil {
+		return 0, 0
+	}
+	return c.keyToHash(key)
+}
+
+// EstimateFrequency returns the admission policy's access frequency estimate
+// for key. Gets are sampled into the policy asynchronously, so recent accesses
+// may not be reflected yet.
+func (c *Cache[K, V]) EstimateFrequency(key K) int64 {
+	if c == nil || c.isClosed.Load() {
+		return 0
+	}
+	keyHash, _ := c.keyToHash(key)
+	return c.cachePolicy.Estimate(keyHash)
+}
+
 // Close stops all goroutines and closes all channels.
 func (c *Cache[K, V]) Close() {
 	if c == nil || c.isClosed.Load() {
@@ -440,7 +1507,12 @@ func (c *Cache[K, V]) Close() {
 	close(c.done)
 	close(c.setBuf)
 	c.cachePolicy.Close()
-	c.cleanupTicker.Stop()
+	if c.cleanupTicker != nil {
+		c.cleanupTicker.Stop()
+	}
+	if c.decayTicker != nil {
+		c.decayTicker.Stop()
+	}
 	c.isClosed.Store(true)
 }
 
@@ -454,9 +1526,46 @@ func (c *Cache[K, V]) Clear() {
 	// Block until processItems goroutine is returned.
 	c.stop <- struct{}{}
 	<-c.done
+	c.drainSetBuf()
+
+	// Clear value hashmap and cachePolicy data.
+	c.cachePolicy.Clear()
+	c.storedItems.Clear(func(i *Item[V]) {
+		c.onEvict(i)
+		c.onRemove(i, RemoveCleared)
+	})
+	// Only reset metrics if they're enabled.
+	if c.Metrics != nil {
+		c.Metrics.Clear()
+	}
+	// Restart processItems goroutine.
+	go c.processItems()
+}
+
+// ClearValues empties the cache like Clear, but keeps the admission frequency
+// history, so that keys which were hot before are readily admitted again when
+// they are set back. This makes re-warming the cache faster when the access
+// pattern is stable. Metrics are kept as well.
+func (c *Cache[K, V]) ClearValues() {
+	if c == nil || c.isClosed.Load() {
+		return
+	}
+	// Block until processItems goroutine is returned.
+	c.stop <- struct{}{}
+	<-c.done
+	c.drainSetBuf()
 
-	// Clear out the setBuf channel.
-loop:
+	c.cachePolicy.ClearCosts()
+	c.storedItems.Clear(func(i *Item[V]) {
+		c.onEvict(i)
+		c.onRemove(i, RemoveCleared)
+	})
+	// Restart processItems goroutine.
+	go c.processItems()
+}
+
+// drainSetBuf drops the items in the Set buffer. processItems must be stopped.
+func (c *Cache[K, V]) drainSetBuf() {
 	for {
 		select {
 		case i := <-c.setBuf:
@@ -464,27 +1573,190 @@ loop:
 				i.wg.Done()
 				continue
 			}
-			if i.flag != itemUpdate {
-				// In itemUpdate, the value is already set in the storedItems.  So, no need to call
-				// onEvict here.
+			if i.applied != nil {
+				close(i.applied)
+			}
+			if i.flag != itemUpdate && i.flag != itemInserted {
+				// In itemUpdate and itemInserted, the value is already set in the storedItems.
+				// So, no need to call onEvict here.
 				c.onEvict(i)
 			}
+			if i.flag == itemNew {
+				c.onRemove(i, RemoveCleared)
+			}
 		default:
-			break loop
+			return
 		}
 	}
+}
+
+// ReplaceAll replaces the whole contents of the cache with keys[i] set to
+// values[i], so that readers see either the previous contents or the new ones,
+// never an empty or partially filled cache as with Clear followed by Sets.
+// Extra keys or values are ignored. The cost of each entry is given by cost,
+// or by Config.Cost if cost is nil, or is 1. The
+// entries are admitted by the policy like Sets would be, so the ones that
+// don't fit within MaxCost are dropped. The new entries don't expire.
+// OnEvict is called for the previous entries, and OnRemove with
+// RemoveCleared, as with Clear.
+//
+// Buffered Sets are dropped, and Sets and Dels made while ReplaceAll runs may
+// be lost.
+func (c *Cache[K, V]) ReplaceAll(keys []K, values []V, cost func(V) int64) {
+	if c == nil || c.isClosed.Load() {
+		return
+	}
+	if cost == nil {
+		cost = c.cost
+	}
+	// Block until processItems goroutine is returned.
+	c.stop <- struct{}{}
+	<-c.done
+	c.drainSetBuf()
 
-	// Clear value hashmap and cachePolicy data.
 	c.cachePolicy.Clear()
-	c.storedItems.Clear(c.onEvict)
-	// Only reset metrics if they're enabled.
-	if c.Metrics != nil {
-		c.Metrics.Clear()
+	n := min(len(keys), len(values))
+	admitted := make(map[uint64]*Item[V], n)
+	for idx, key := range keys[:n] {
+		value := values[idx]
+		keyHash, conflictHash := c.keyToHash(key)
+		i := &Item[V]{
+			Key:      keyHash,
+			Conflict: conflictHash,
+			Value:    value,
+			Cost:     1,
+		}
+		if cost != nil {
+			i.Cost = cost(value)
+		}
+		if !c.ignoreInternalCost {
+			i.Cost += itemSize
+		}
+		if c.storeKeys {
+			i.origKey = key
+		}
+		victims, added := c.cachePolicy.Add(keyHash, i.Cost)
+		for _, victim := range victims {
+			delete(admitted, victim.Key)
+		}
+		// If two keys share the same hash, the policy only admits the first.
+		if added {
+			admitted[keyHash] = i
+		}
 	}
+
+	items := make([]*Item[V], 0, len(admitted))
+	for _, i := range admitted {
+		items = append(items, i)
+		c.Metrics.add(keyAdd, i.Key, 1)
+	}
+	c.storedItems.Replace(items, func(i *Item[V]) {
+		c.onEvict(i)
+		c.onRemove(i, RemoveCleared)
+	})
 	// Restart processItems goroutine.
 	go c.processItems()
 }
 
+// SetShouldUpdate replaces the ShouldUpdate function the cache was created
+// with. It applies to every update made after it returns, including Sets
+// buffered before the call. A nil fn accepts every update.
+func (c *Cache[K, V]) SetShouldUpdate(fn func(cur, prev V) bool) {
+	if c == nil {
+		return
+	}
+	c.storedItems.SetShouldUpdateFn(c.guardShouldUpdate(fn))
+}
+
+// guardShouldUpdate makes a ShouldUpdate function which panics refuse the
+// update instead.
+func (c *Cache[K, V]) guardShouldUpdate(fn func(cur, prev V) bool) func(cur, prev V) bool {
+	if fn == nil {
+		return nil
+	}
+	return func(cur, prev V) bool {
+		defer c.recoverPanic("calling ShouldUpdate")
+		return fn(cur, prev)
+	}
+}
+
+// PendingSets returns the number of Sets buffered and waiting to be processed.
+// Once it reaches the capacity of the buffer, further Sets are dropped, so it
+// can be used to apply backpressure before that happens.
+func (c *Cache[K, V]) PendingSets() int {
+	if c == nil {
+		return 0
+	}
+	return len(c.setBuf)
+}
+
+// UsedCost returns the total cost of the items admitted to the cache. Sets
+// still buffered aren't accounted for.
+func (c *Cache[K, V]) UsedCost() int64 {
+	if c == nil {
+		return 0
+	}
+	return c.cachePolicy.Used()
+}
+
+// Len returns the number of items in the cache which haven't expired. It
+// counts them shard by shard, so under concurrent writes it is approximate,
+// and Sets still buffered aren't counted. It visits every item, which takes
+// time proportional to the size of the cache.
+func (c *Cache[K, V]) Len() int {
+	if c == nil || c.isClosed.Load() {
+		return 0
+	}
+	return c.storedItems.Len()
+}
+
+// Headroom returns the cost that can still be added to the cache before items
+// are evicted to make room, i.e. MaxCost minus UsedCost. It is negative if
+// MaxCost was lowered below UsedCost. As with UsedCost, Sets still buffered
+// aren't accounted for, and items use the internal cost on top of their own
+// unless IgnoreInternalCost is set.
+func (c *Cache[K, V]) Headroom() int64 {
+	if c == nil {
+		return 0
+	}
+	return c.cachePolicy.Cap()
+}
+
+// MaxItemCostSeen returns the largest cost of a single item admitted to the
+// cache, or updated in it, since it was created or cleared. Compared with
+// MaxCost, it shows whether a few outliers take a large share of the cache.
+// Unless Config.IgnoreInternalCost is set, it includes the internal cost of the
+// item.
+func (c *Cache[K, V]) MaxItemCostSeen() int64 {
+	if c == nil {
+		return 0
+	}
+	return c.cachePolicy.MaxCostSeen()
+}
+
+// waitUntilCostInterval is how often WaitUntilCost checks the used cost.
+const waitUntilCostInterval = 10 * time.Millisecond
+
+// WaitUntilCost blocks until UsedCost is at most maxCost, or ctx is done, in
+// which case it returns the context's error. The cost only goes down as items
+// are evicted, expire or are deleted, so it is typically used after lowering
+// MaxCost with UpdateMaxCost, or while deleting items, to drain the cache.
+func (c *Cache[K, V]) WaitUntilCost(ctx context.Context, maxCost int64) error {
+	if c == nil || c.isClosed.Load() {
+		return nil
+	}
+	ticker := time.NewTicker(waitUntilCostInterval)
+	defer ticker.Stop()
+	for c.UsedCost() > maxCost {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
 // MaxCost returns the max cost of the cache.
 func (c *Cache[K, V]) MaxCost() int64 {
 	if c == nil {
@@ -493,7 +1765,9 @@ func (c *Cache[K, V]) MaxCost() int64 {
 	return c.cachePolicy.MaxCost()
 }
 
-// UpdateMaxCost updates the maxCost of an existing cache.
+// UpdateMaxCost updates the maxCost of an existing cache. Lowering it doesn't
+// evict anything by itself: room is made as new items are added, unless Trim
+// is called.
 func (c *Cache[K, V]) UpdateMaxCost(maxCost int64) {
 	if c == nil {
 		return
@@ -501,15 +1775,84 @@ func (c *Cache[K, V]) UpdateMaxCost(maxCost int64) {
 	c.cachePolicy.UpdateMaxCost(maxCost)
 }
 
+// Trim evicts the least valuable items until the cost used by the cache is
+// within MaxCost, e.g. right after lowering it with UpdateMaxCost, and returns
+// the number of items it evicted. Pinned items are never evicted. It blocks
+// while the goroutine processing Sets runs it.
+func (c *Cache[K, V]) Trim() int {
+	if c == nil || c.isClosed.Load() {
+		return 0
+	}
+	res := make(chan int, 1)
+	c.shrink <- res
+	return <-res
+}
+
+// WarmFrequency feeds the admission policy with the access frequency of keys,
+// as if keys[i] had been read counts[i] times. This is useful after restoring
+// the cache's contents (e.g. from a snapshot), so that the restored items aren't
+// considered cold and evicted right away. Extra keys or counts are ignored.
+func (c *Cache[K, V]) WarmFrequency(keys []K, counts []int) {
+	if c == nil || c.isClosed.Load() {
+		return
+	}
+	hashes := make([]uint64, len(keys))
+	for i, key := range keys {
+		hashes[i], _ = c.keyToHash(key)
+	}
+	c.cachePolicy.Warm(hashes, counts)
+}
+
+// ResizeCounters rebuilds the admission policy's frequency counters (the
+// count-min sketch and the doorkeeper bloom filter) to hold numCounters
+// counters. This is useful when the working set outgrows the NumCounters the
+// cache was created with. All frequency history is lost in the process. Values
+// of numCounters less than or equal to zero, or too large for NewCache to
+// accept, are ignored with a warning.
+func (c *Cache[K, V]) ResizeCounters(numCounters int64) {
+	if c == nil {
+		return
+	}
+	if numCounters <= 0 || numCounters > maxNumCounters {
+		c.logger.Warningf("ignoring ResizeCounters with invalid numCounters: %d", numCounters)
+		return
+	}
+	c.cachePolicy.ResizeCounters(numCounters)
+}
+
+// PublishExpvar publishes the cache metrics under name using the expvar
+// package, so that they show up as a JSON object on /debug/vars. The metrics
+// are read each time the variable is rendered. Like expvar.Publish, it panics
+// if name is already in use. Nothing is published for a cache created without
+// Config.Metrics.
+//
+// The expvar package can't unpublish a name, so the variable outlives the
+// cache: once the cache is closed, it keeps reporting the last metrics. Only
+// the metrics are kept reachable by the variable, not the cache and its items.
+func (c *Cache[K, V]) PublishExpvar(name string) {
+	if c == nil || c.Metrics == nil {
+		return
+	}
+	metrics := c.Metrics
+	expvar.Publish(name, expvar.Func(func() any {
+		return metrics.snapshot()
+	}))
+}
+
 // processItems is ran by goroutines processing the Set buffer.
 func (c *Cache[K, V]) processItems() {
 	startTs := make(map[uint64]time.Time)
+	// startMu guards startTs, which is shared by the workers if there are more
+	// than one.
+	var startMu sync.Mutex
 	numToKeep := 100000 // TODO: Make this configurable via options.
 
 	trackAdmission := func(key uint64) {
 		if c.Metrics == nil {
 			return
 		}
+		startMu.Lock()
+		defer startMu.Unlock()
 		startTs[key] = time.Now()
 		if len(startTs) > numToKeep {
 			for k := range startTs {
@@ -521,63 +1864,288 @@ func (c *Cache[K, V]) processItems() {
 		}
 	}
 	onEvict := func(i *Item[V]) {
+		defer c.recoverPanic("evicting an item")
+		startMu.Lock()
 		if ts, has := startTs[i.Key]; has {
 			c.Metrics.trackEviction(int64(time.Since(ts) / time.Second))
 			delete(startTs, i.Key)
 		}
+		startMu.Unlock()
 		if c.onEvict != nil {
 			c.onEvict(i)
 		}
 	}
+	// numExpired counts the items expired during the current cleanup cycle.
+	var numExpired int
+	onExpire := func(i *Item[V]) {
+		defer c.recoverPanic("expiring an item")
+		onEvict(i)
+		// Items removed early by MaxExpirationBuckets haven't expired yet.
+		if i.overflow {
+			c.onRemove(i, RemoveOverflow)
+			return
+		}
+		numExpired++
+		c.Metrics.add(keyExpire, i.Key, 1)
+		c.onRemove(i, RemoveExpired)
+		if c.onExpire != nil && i.origKey != nil {
+			c.onExpire(i.origKey.(K), i.Value)
+		}
+	}
 
-	for {
-		select {
-		case i := <-c.setBuf:
-			if i.wg != nil {
-				i.wg.Done()
-				continue
+	// admitMu makes admitting an item and removing the victims it evicted
+	// atomic. With more than one worker, the victims belong to the other
+	// workers' keys; without it, a victim set again through its own worker in
+	// the meantime would be deleted in place of the evicted value.
+	var admitMu sync.Mutex
+
+	// evictVictims removes the items the policy evicted to make room. The
+	// caller must hold admitMu.
+	evictVictims := func(victims []*Item[V]) {
+		for _, victim := range victims {
+			// The original key, if stored, is gone once the item is deleted.
+			if c.storeKeys {
+				_, victim.origKey, _ = c.storedItems.Entry(victim.Key)
 			}
-			// Calculate item cost value if new or update.
-			if i.Cost == 0 && c.cost != nil && i.flag != itemDelete {
-				i.Cost = c.cost(i.Value)
+			var ok bool
+			victim.Conflict, victim.Value, ok = c.storedItems.Del(victim.Key, 0)
+			onEvict(victim)
+			if ok {
+				c.onRemove(victim, RemoveEvicted)
+				c.sendVictim(victim)
 			}
-			if !c.ignoreInternalCost {
-				// Add the cost of internally storing the object.
-				i.Cost += itemSize
+		}
+	}
+
+	// process applies a single item from the Set buffer. The user callbacks
+	// recover from their own panics, so that the item is fully applied; this
+	// only keeps the goroutine alive should anything else panic.
+	process := func(i *Item[V]) {
+		defer c.recoverPanic("processing a Set")
+
+		if i.wg != nil {
+			i.wg.Done()
+			return
+		}
+		if i.applied != nil {
+			defer close(i.applied)
+		}
+		// Calculate item cost value if new or update.
+		if i.Cost == 0 && c.cost != nil && i.flag != itemDelete {
+			cost, ok := c.costOf(i.Value)
+			if !ok {
+				// The item can't be accounted for, so it is dropped. An update
+				// keeps the previous cost.
+				switch i.flag {
+				case itemNew:
+					c.onReject(i)
+					c.onRemove(i, RemoveRejected)
+				case itemInserted:
+					if val, ok := c.storedItems.DelInserted(i); ok {
+						i.Value = val
+						c.onReject(i)
+						c.onRemove(i, RemoveRejected)
+					}
+				}
+				return
 			}
+			i.Cost = cost
+		}
+		if !c.ignoreInternalCost {
+			// Add the cost of internally storing the object.
+			i.Cost += itemSize
+		}
+
+		if c.getBuf == nil && i.flag != itemDelete {
+			// Without Get feedback, Sets are the only source of frequency.
+			c.cachePolicy.Increment(i.Key)
+		}
 
-			switch i.flag {
-			case itemNew:
-				victims, added := c.cachePolicy.Add(i.Key, i.Cost)
-				if added {
-					c.storedItems.Set(i)
+		switch i.flag {
+		case itemInserted:
+			admitMu.Lock()
+			defer admitMu.Unlock()
+			victims, added := c.cachePolicy.Add(i.Key, i.Cost)
+			switch {
+			case added:
+				if c.storedItems.Admit(i) {
 					c.Metrics.add(keyAdd, i.Key, 1)
 					trackAdmission(i.Key)
 				} else {
+					// The item was deleted before it could be admitted.
+					c.cachePolicy.Del(i.Key)
+				}
+			case c.cachePolicy.Has(i.Key):
+				// The key was already known to the policy, e.g. because a Set
+				// of it was applied in the meantime, and Add updated its cost.
+				c.storedItems.Admit(i)
+			default:
+				if val, ok := c.storedItems.DelInserted(i); ok {
+					i.Value = val
 					c.onReject(i)
+					c.onRemove(i, RemoveRejected)
 				}
-				for _, victim := range victims {
-					victim.Conflict, victim.Value = c.storedItems.Del(victim.Key, 0)
-					onEvict(victim)
+			}
+			evictVictims(victims)
+
+		case itemNew:
+			admitMu.Lock()
+			defer admitMu.Unlock()
+			victims, added := c.cachePolicy.Add(i.Key, i.Cost)
+			if added {
+				if c.storedItems.Set(i) {
+					i.stored = true
+					c.Metrics.add(keyAdd, i.Key, 1)
+					trackAdmission(i.Key)
+				} else {
+					// The store refused the value (conflict or ShouldUpdate), so
+					// it never made it into the cache.
+					c.onRemove(i, RemoveRejected)
 				}
+			} else {
+				c.onReject(i)
+				c.onRemove(i, RemoveRejected)
+			}
+			evictVictims(victims)
+
+		case itemUpdate:
+			c.cachePolicy.Update(i.Key, i.Cost)
+
+		case itemDelete:
+			c.cachePolicy.Del(i.Key) // Deals with metrics updates.
+			// The store already deleted the key when the Del was issued; this
+			// removes a value set by an earlier Set applied since.
+			var origKey any
+			if c.storeKeys {
+				_, origKey, _ = c.storedItems.Entry(i.Key)
+			}
+			_, val, ok := c.storedItems.DelDeferred(i.Key, i.Conflict)
+			c.onExit(val)
+			if ok {
+				c.onRemove(&Item[V]{Key: i.Key, Conflict: i.Conflict, Value: val,
+					origKey: origKey}, RemoveDeleted)
+			}
+		}
+	}
 
-			case itemUpdate:
-				c.cachePolicy.Update(i.Key, i.Cost)
+	// With more than one goroutine, this one routes the items to the workers by
+	// key, so that the items of a key are applied in the order they were sent.
+	dispatch := process
+	var workers []chan *Item[V]
+	var workersDone sync.WaitGroup
+	if c.processGoroutines > 1 {
+		workers = make([]chan *Item[V], c.processGoroutines)
+		for n := range workers {
+			ch := make(chan *Item[V], 256)
+			workers[n] = ch
+			workersDone.Add(1)
+			go func() {
+				defer workersDone.Done()
+				for i := range ch {
+					process(i)
+				}
+			}()
+		}
+		dispatch = func(i *Item[V]) {
+			if i.wg == nil {
+				workers[i.Key%uint64(len(workers))] <- i
+				return
+			}
+			// Wait must see the items sent before it applied by every worker.
+			var barrier sync.WaitGroup
+			barrier.Add(len(workers))
+			for _, w := range workers {
+				w <- &Item[V]{wg: &barrier}
+			}
+			barrier.Wait()
+			i.wg.Done()
+		}
+	}
+
+	// decayC stays nil, and never fires, without Config.DecayHalfLife, and so
+	// does cleanupC with Config.DisableCleanup.
+	var decayC, cleanupC <-chan time.Time
+	if c.decayTicker != nil {
+		decayC = c.decayTicker.C
+	}
+	if c.cleanupTicker != nil {
+		cleanupC = c.cleanupTicker.C
+	}
 
-			case itemDelete:
-				c.cachePolicy.Del(i.Key) // Deals with metrics updates.
-				_, val := c.storedItems.Del(i.Key, i.Conflict)
-				c.onExit(val)
+	for {
+		select {
+		case i := <-c.setBuf:
+			dispatch(i)
+		case <-decayC:
+			c.cachePolicy.Decay(decayFactor)
+		case <-cleanupC:
+			start := time.Now()
+			numExpired = 0
+			c.storedItems.Cleanup(c.cachePolicy, onExpire)
+			if c.onCleanup != nil {
+				func() {
+					defer c.recoverPanic("running OnCleanup")
+					c.onCleanup(numExpired, time.Since(start))
+				}()
 			}
-		case <-c.cleanupTicker.C:
-			c.storedItems.Cleanup(c.cachePolicy, onEvict)
+		case res := <-c.shrink:
+			admitMu.Lock()
+			victims := c.cachePolicy.Shrink()
+			evictVictims(victims)
+			admitMu.Unlock()
+			res <- len(victims)
+		case res := <-c.purge:
+			numExpired = 0
+			c.storedItems.PurgeExpired(c.cachePolicy, onExpire)
+			res <- numExpired
 		case <-c.stop:
+			for _, w := range workers {
+				close(w)
+			}
+			workersDone.Wait()
 			c.done <- struct{}{}
 			return
 		}
 	}
 }
 
+// sendVictim sends an evicted item to Config.VictimChan, unless it is unset or
+// full.
+func (c *Cache[K, V]) sendVictim(i *Item[V]) {
+	if c.victimChan == nil {
+		return
+	}
+	victim := Entry[K, V]{
+		Key:        i.Key,
+		Conflict:   i.Conflict,
+		Value:      i.Value,
+		Expiration: i.Expiration,
+		Cost:       i.Cost,
+	}
+	if i.origKey != nil {
+		victim.OriginalKey = i.origKey.(K)
+	}
+	select {
+	case c.victimChan <- victim:
+	default:
+	}
+}
+
+// costOf calls Config.Cost on value. ok is false if it panicked.
+func (c *Cache[K, V]) costOf(value V) (cost int64, ok bool) {
+	defer c.recoverPanic("calling Cost")
+	return c.cost(value), true
+}
+
+// recoverPanic recovers from a panic in a user callback, so that a misbehaving
+// callback doesn't stop the cache from processing Sets, and logs it. It must be
+// deferred.
+func (c *Cache[K, V]) recoverPanic(what string) {
+	if r := recover(); r != nil {
+		c.logger.Errorf("recovered from panic while %s: %v\n%s", what, r, debug.Stack())
+	}
+}
+
 // collectMetrics just creates a new *Metrics instance and adds the pointers
 // to the cache and policy instances.
 func (c *Cache[K, V]) collectMetrics() {
@@ -595,6 +2163,8 @@ const (
 	keyAdd
 	keyUpdate
 	keyEvict
+	// keyExpire keeps track of the number of keys removed by the TTL cleanup.
+	keyExpire
 	// The following 2 keep track of cost of keys added and evicted.
 	costAdd
 	costEvict
@@ -621,6 +2191,8 @@ func stringFor(t metricType) string {
 		return "keys-updated"
 	case keyEvict:
 		return "keys-evicted"
+	case keyExpire:
+		return "keys-expired"
 	case costAdd:
 		return "cost-added"
 	case costEvict:
@@ -708,6 +2280,13 @@ func (p *Metrics) KeysEvicted() uint64 {
 	return p.get(keyEvict)
 }
 
+// KeysExpired is the total number of keys removed because their TTL had
+// passed. These are also counted by KeysEvicted, so the number of keys
+// evicted for any other reason is the difference between the two.
+func (p *Metrics) KeysExpired() uint64 {
+	return p.get(keyExpire)
+}
+
 // CostAdded is the sum of costs that have been added (successful Set calls).
 func (p *Metrics) CostAdded() uint64 {
 	return p.get(costAdd)
@@ -786,6 +2365,18 @@ func (p *Metrics) Clear() {
 	p.mu.Unlock()
 }
 
+// snapshot returns the metrics keyed by the same names used by String.
+func (p *Metrics) snapshot() map[string]any {
+	m := make(map[string]any, doNotUse+2)
+	for i := 0; i < doNotUse; i++ {
+		t := metricType(i)
+		m[stringFor(t)] = p.get(t)
+	}
+	m["gets-total"] = p.get(hit) + p.get(miss)
+	m["hit-ratio"] = p.Ratio()
+	return m
+}
+
 // String returns a string representation of the metrics.
 func (p *Metrics) String() string {
 	if p == nil {
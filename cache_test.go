@@ -1,12 +1,17 @@
 package ristretto
 
 import (
+	"context"
+	"encoding/json"
+	"expvar"
 	"fmt"
+	"math"
 	"math/rand"
 	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -39,6 +44,51 @@ func TestCacheKeyToHash(t *testing.T) {
 	require.Equal(t, 3, keyToHashCount)
 }
 
+type namedTestKey string
+
+func TestCacheNamedKeyType(t *testing.T) {
+	c, err := NewCache(&Config[namedTestKey, any]{
+		NumCounters:        10,
+		MaxCost:            1000,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.Set(namedTestKey("a"), 1, 1))
+	c.Wait()
+	val, ok := c.Get("a")
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+	_, ok = c.Get("b")
+	require.False(t, ok)
+}
+
+func TestCacheOnZeroHash(t *testing.T) {
+	var zeroKeys []string
+	c, err := NewCache(&Config[string, int]{
+		NumCounters: 10,
+		MaxCost:     1000,
+		BufferItems: 64,
+		KeyToHash: func(key string) (uint64, uint64) {
+			if key == "bad" {
+				return 0, 0
+			}
+			return z.KeyToHash(key)
+		},
+		OnZeroHash: func(key string) {
+			zeroKeys = append(zeroKeys, key)
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	c.Get("good")
+	c.Get("bad")
+	require.Equal(t, []string{"bad"}, zeroKeys)
+}
+
 func TestCacheMaxCost(t *testing.T) {
 	charset := "abcdefghijklmnopqrstuvwxyz0123456789"
 	key := func() []byte {
@@ -90,6 +140,85 @@ func TestCacheMaxCost(t *testing.T) {
 	}
 }
 
+func TestCacheMaxKeys(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            1000,
+		MaxKeys:            5,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	for i := 0; i < 20; i++ {
+		c.Set(i, i, 1)
+		c.Wait()
+	}
+	var found int
+	for i := 0; i < 20; i++ {
+		if _, ok := c.storedItems.Get(z.KeyToHash(i)); ok {
+			found++
+		}
+	}
+	require.LessOrEqual(t, found, 5)
+	require.NotZero(t, found)
+
+	_, err = NewCache(&Config[int, int]{
+		NumCounters: 100,
+		MaxCost:     10,
+		MaxKeys:     -1,
+		BufferItems: 64,
+	})
+	require.ErrorIs(t, err, ErrNegativeMaxKeys)
+}
+
+func TestCacheCounterBits(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters: 1000,
+		MaxCost:     10,
+		BufferItems: 64,
+		CounterBits: 8,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	c.WarmFrequency([]int{1}, []int{100})
+	require.Equal(t, int64(100), c.EstimateFrequency(1))
+
+	_, err = NewCache(&Config[int, int]{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		CounterBits: 6,
+	})
+	require.ErrorIs(t, err, ErrInvalidCounterBits)
+}
+
+func TestCacheDecayHalfLife(t *testing.T) {
+	_, err := NewCache(&Config[int, int]{
+		NumCounters:   100,
+		MaxCost:       10,
+		BufferItems:   64,
+		DecayHalfLife: -time.Second,
+	})
+	require.ErrorIs(t, err, ErrNegativeDecay)
+
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:   100,
+		MaxCost:       10,
+		BufferItems:   64,
+		CounterBits:   8,
+		DecayHalfLife: 80 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	c.WarmFrequency([]int{1}, []int{200})
+	require.Equal(t, int64(200), c.EstimateFrequency(1))
+	require.Eventually(t, func() bool {
+		return c.EstimateFrequency(1) < 100
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
 func TestUpdateMaxCost(t *testing.T) {
 	c, err := NewCache(&Config[int, int]{
 		NumCounters: 10,
@@ -116,24 +245,72 @@ func TestUpdateMaxCost(t *testing.T) {
 	c.Del(1)
 }
 
+func TestCacheResizeCounters(t *testing.T) {
+	c, err := newTestCache()
+	require.NoError(t, err)
+	defer c.Close()
+	logger := &testLogger{}
+	c.logger = logger
+
+	c.ResizeCounters(0)
+	require.Len(t, logger.warnings, 1)
+	c.ResizeCounters(1 << 16)
+	c.cachePolicy.Lock()
+	require.Equal(t, int64(1<<16), c.cachePolicy.admit.resetAt)
+	c.cachePolicy.Unlock()
+
+	require.True(t, c.Set(1, 1, 1))
+	c.Wait()
+	c.Get(1)
+
+	c = nil
+	c.ResizeCounters(10)
+}
+
 func TestNewCache(t *testing.T) {
 	_, err := NewCache(&Config[int, int]{
 		NumCounters: 0,
 	})
-	require.Error(t, err)
+	require.ErrorIs(t, err, ErrZeroNumCounters)
+
+	_, err = NewCache(&Config[int, int]{
+		NumCounters: -1,
+	})
+	require.ErrorIs(t, err, ErrNegativeNumCounters)
+
+	_, err = NewCache(&Config[int, int]{
+		NumCounters: math.MaxInt64,
+	})
+	require.ErrorIs(t, err, ErrTooManyNumCounters)
 
 	_, err = NewCache(&Config[int, int]{
 		NumCounters: 100,
 		MaxCost:     0,
 	})
-	require.Error(t, err)
+	require.ErrorIs(t, err, ErrZeroMaxCost)
 
 	_, err = NewCache(&Config[int, int]{
+		NumCounters: 100,
+		MaxCost:     -1,
+	})
+	require.ErrorIs(t, err, ErrNegativeMaxCost)
+
+	auto, err := NewCache(&Config[int, int]{
 		NumCounters: 100,
 		MaxCost:     10,
 		BufferItems: 0,
+		RingStripes: 1,
+	})
+	require.NoError(t, err, "zero BufferItems should pick a default")
+	require.Equal(t, int(RecommendBufferItems(1)), auto.getBuf.stripes[0].capa)
+	auto.Close()
+
+	_, err = NewCache(&Config[int, int]{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: -1,
 	})
-	require.Error(t, err)
+	require.ErrorIs(t, err, ErrNegativeBufferItems)
 
 	c, err := NewCache(&Config[int, int]{
 		NumCounters: 100,
@@ -145,6 +322,29 @@ func TestNewCache(t *testing.T) {
 	require.NotNil(t, c)
 }
 
+func TestConfigWithMaxMemory(t *testing.T) {
+	type value struct {
+		a, b, c, d int64
+	}
+	config := (&Config[int, value]{
+		NumCounters:        100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	}).WithMaxMemory(10 * (32 + itemSize))
+	require.Equal(t, 10*(32+itemSize), config.MaxCost)
+	require.False(t, config.IgnoreInternalCost)
+	require.Equal(t, int64(32), config.Cost(value{}))
+
+	c, err := NewCache(config)
+	require.NoError(t, err)
+	defer c.Close()
+	for i := 0; i < 20; i++ {
+		c.Set(i, value{}, 0)
+		c.Wait()
+	}
+	require.Equal(t, int64(0), c.cachePolicy.Cap())
+}
+
 func TestNilCache(t *testing.T) {
 	var c *Cache[int, int]
 	val, ok := c.Get(1)
@@ -316,6 +516,118 @@ func TestCacheProcessItems(t *testing.T) {
 	c.setBuf <- &Item[int]{flag: itemNew}
 }
 
+func TestCacheOnRemove(t *testing.T) {
+	var mu sync.Mutex
+	removed := make(map[int]int)
+	removedKeys := make(map[int]int)
+	reasons := make(map[RemoveReason]int)
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		OnRemove: func(key, value int, reason RemoveReason) {
+			mu.Lock()
+			defer mu.Unlock()
+			removed[value]++
+			removedKeys[value] = key
+			reasons[reason]++
+		},
+	})
+	require.NoError(t, err)
+
+	// Every value is unique so that we can verify each one is released once,
+	// along with the key it was set with.
+	accepted := make(map[int]int)
+	val := 1
+	set := func(key int, ttl time.Duration) {
+		if c.SetWithTTL(key, val, 1, ttl) {
+			accepted[val] = key
+		}
+		val++
+	}
+	for i := 0; i < 100; i++ {
+		set(i%20, 0)
+		if i%20 == 19 {
+			c.Wait()
+		}
+	}
+	// Delete a few of the keys the policy admitted, leaving the rest to be
+	// cleared by Close.
+	for i, deleted := 0, 0; i < 20 && deleted < 3; i++ {
+		if _, ok := c.Get(i); ok {
+			c.Del(i)
+			deleted++
+		}
+	}
+	set(100, 100*time.Millisecond)
+	c.Wait()
+	time.Sleep(2 * time.Second)
+	c.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	for v, key := range accepted {
+		require.Equal(t, 1, removed[v], "value %d", v)
+		require.Equal(t, key, removedKeys[v], "value %d", v)
+	}
+	for v, n := range removed {
+		_, ok := accepted[v]
+		require.True(t, ok, "value %d was never accepted", v)
+		require.Equal(t, 1, n)
+	}
+	require.NotZero(t, reasons[RemoveUpdated])
+	require.NotZero(t, reasons[RemoveDeleted])
+	require.NotZero(t, reasons[RemoveCleared])
+	require.Equal(t, "expired", RemoveExpired.String())
+}
+
+func TestCacheOnRemoveOverflow(t *testing.T) {
+	var mu sync.Mutex
+	reasons := make(map[int]RemoveReason)
+	var expired, cleanedUp int
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:            100,
+		MaxCost:                10,
+		BufferItems:            64,
+		IgnoreInternalCost:     true,
+		TtlTickerDurationInSec: 1,
+		MaxExpirationBuckets:   1,
+		Metrics:                true,
+		OnCleanup: func(numExpired int, elapsed time.Duration) {
+			mu.Lock()
+			defer mu.Unlock()
+			cleanedUp += numExpired
+		},
+		OnRemove: func(key, value int, reason RemoveReason) {
+			mu.Lock()
+			defer mu.Unlock()
+			reasons[key] = reason
+		},
+		OnExpire: func(key, value int) {
+			mu.Lock()
+			defer mu.Unlock()
+			expired++
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.SetWithTTL(1, 10, 1, time.Minute))
+	require.True(t, c.SetWithTTL(2, 20, 1, 2*time.Minute))
+	c.Wait()
+	time.Sleep(time.Second)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, map[int]RemoveReason{1: RemoveOverflow}, reasons)
+	// The item hadn't expired, so it isn't counted as such.
+	require.Zero(t, expired)
+	require.Zero(t, cleanedUp)
+	require.Zero(t, c.Metrics.KeysExpired())
+	require.Equal(t, "overflow", RemoveOverflow.String())
+}
+
 func TestCacheGet(t *testing.T) {
 	c, err := NewCache(&Config[int, int]{
 		NumCounters:        100,
@@ -406,6 +718,34 @@ func TestCacheSet(t *testing.T) {
 	require.False(t, c.Set(1, 1, 1))
 }
 
+func TestCacheSetWithContext(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.SetWithContext(context.Background(), 1, 1, 1, 0))
+	c.Wait()
+	val, ok := c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.False(t, c.SetWithContext(ctx, 2, 2, 1, 0))
+	require.False(t, c.SetWithContext(ctx, 1, 3, 1, 0))
+	c.Wait()
+	_, ok = c.Get(2)
+	require.False(t, ok)
+	val, ok = c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+}
+
 func TestCacheInternalCost(t *testing.T) {
 	c, err := NewCache(&Config[int, int]{
 		NumCounters: 100,
@@ -541,6 +881,36 @@ func TestCacheDel(t *testing.T) {
 	c.Del(1)
 }
 
+func TestCacheDelByHashes(t *testing.T) {
+	c, err := NewCache(&Config[string, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	for i, k := range []string{"a", "b", "c"} {
+		require.True(t, c.Set(k, i, 1))
+	}
+	c.Wait()
+
+	ha, _ := c.HashOf("a")
+	hc, _ := c.HashOf("c")
+	c.DelByHashes([]uint64{ha, hc})
+	c.Wait()
+
+	_, ok := c.Get("a")
+	require.False(t, ok)
+	_, ok = c.Get("c")
+	require.False(t, ok)
+	val, ok := c.Get("b")
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+	require.False(t, c.cachePolicy.Has(ha))
+}
+
 func TestCacheDelWithTTL(t *testing.T) {
 	c, err := NewCache(&Config[int, int]{
 		NumCounters:        100,
@@ -624,33 +994,106 @@ func TestCacheGetTTL(t *testing.T) {
 	}
 }
 
-func TestCacheClear(t *testing.T) {
+func TestCacheAge(t *testing.T) {
 	c, err := NewCache(&Config[int, int]{
 		NumCounters:        100,
 		MaxCost:            10,
 		IgnoreInternalCost: true,
 		BufferItems:        64,
-		Metrics:            true,
+		TrackCreationTime:  true,
 	})
 	require.NoError(t, err)
+	defer c.Close()
 
-	for i := 0; i < 10; i++ {
-		c.Set(i, i, 1)
-	}
+	_, ok := c.Age(1)
+	require.False(t, ok)
+
+	retrySet(t, c, 1, 1, 1, 0)
+	time.Sleep(50 * time.Millisecond)
+	// Updating the value must not reset the creation time.
+	require.True(t, c.Set(1, 2, 1))
+	c.Wait()
+	age, ok := c.Age(1)
+	require.True(t, ok)
+	require.GreaterOrEqual(t, age, 50*time.Millisecond)
+
+	c.Del(1)
+	c.Wait()
+	_, ok = c.Age(1)
+	require.False(t, ok)
+
+	c2, err := newTestCache()
+	require.NoError(t, err)
+	defer c2.Close()
+	c2.storedItems.Set(&Item[int]{Key: 1, Value: 1})
+	_, ok = c2.Age(1)
+	require.False(t, ok)
+}
+
+func TestCacheHashOf(t *testing.T) {
+	c, err := newTestCache()
+	require.NoError(t, err)
+	defer c.Close()
+
+	key, conflict := c.HashOf(1)
+	wantKey, wantConflict := z.KeyToHash(1)
+	require.Equal(t, wantKey, key)
+	require.Equal(t, wantConflict, conflict)
+
+	c = nil
+	key, conflict = c.HashOf(1)
+	require.Zero(t, key)
+	require.Zero(t, conflict)
+}
+
+func TestCacheEstimateFrequency(t *testing.T) {
+	c, err := newTestCache()
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.Equal(t, int64(0), c.EstimateFrequency(1))
+	key, _ := z.KeyToHash(1)
+	c.cachePolicy.Push([]uint64{key, key, key})
 	time.Sleep(wait)
-	require.Equal(t, uint64(10), c.Metrics.KeysAdded())
+	require.Equal(t, int64(3), c.EstimateFrequency(1))
 
-	c.Clear()
-	require.Equal(t, uint64(0), c.Metrics.KeysAdded())
+	c = nil
+	require.Equal(t, int64(0), c.EstimateFrequency(1))
+}
 
-	for i := 0; i < 10; i++ {
-		val, ok := c.Get(i)
-		require.False(t, ok)
-		require.Zero(t, val)
+func TestCacheWarmFrequency(t *testing.T) {
+	c, err := newTestCache()
+	require.NoError(t, err)
+	defer c.Close()
+
+	c.WarmFrequency([]int{1, 2, 3}, []int{5, 1000})
+	require.Equal(t, int64(5), c.EstimateFrequency(1))
+	require.Equal(t, int64(maxCount+1), c.EstimateFrequency(2))
+	require.Equal(t, int64(0), c.EstimateFrequency(3))
+}
+
+func TestCacheDisableGetBuffer(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:      100,
+		MaxCost:          10,
+		BufferItems:      64,
+		DisableGetBuffer: true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	require.Nil(t, c.getBuf)
+
+	for i := 0; i < 3; i++ {
+		c.Set(1, 1, 1)
+		c.Wait()
+	}
+	for i := 0; i < 100; i++ {
+		c.Get(1)
 	}
+	require.Equal(t, int64(3), c.EstimateFrequency(1))
 }
 
-func TestCacheMetrics(t *testing.T) {
+func TestCachePublishExpvar(t *testing.T) {
 	c, err := NewCache(&Config[int, int]{
 		NumCounters:        100,
 		MaxCost:            10,
@@ -659,24 +1102,477 @@ func TestCacheMetrics(t *testing.T) {
 		Metrics:            true,
 	})
 	require.NoError(t, err)
+	defer c.Close()
 
-	for i := 0; i < 10; i++ {
-		c.Set(i, i, 1)
+	c.Set(1, 1, 1)
+	c.Wait()
+	c.Get(1)
+	c.Get(2)
+
+	// Names can't be unpublished, so each run, e.g. with -count, needs its own.
+	name := t.Name()
+	for i := 1; expvar.Get(name) != nil; i++ {
+		name = fmt.Sprintf("%s-%d", t.Name(), i)
 	}
-	time.Sleep(wait)
-	m := c.Metrics
-	require.Equal(t, uint64(10), m.KeysAdded())
+	c.PublishExpvar(name)
+	v := expvar.Get(name)
+	require.NotNil(t, v)
+	var m map[string]float64
+	require.NoError(t, json.Unmarshal([]byte(v.String()), &m))
+	require.Equal(t, 1.0, m["keys-added"])
+	require.Equal(t, 1.0, m["hit"])
+	require.Equal(t, 1.0, m["miss"])
+	require.Equal(t, 0.5, m["hit-ratio"])
 }
 
-func TestMetrics(t *testing.T) {
-	newMetrics()
-}
+func TestCacheSetShouldUpdate(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+	})
+	require.NoError(t, err)
+	defer c.Close()
 
-func TestNilMetrics(t *testing.T) {
-	var m *Metrics
-	for _, f := range []func() uint64{
-		m.Hits,
-		m.Misses,
+	require.True(t, c.Set(1, 5, 1))
+	c.Wait()
+
+	// Only accept increasing values from now on.
+	c.SetShouldUpdate(func(cur, prev int) bool { return cur > prev })
+	c.Set(1, 3, 1)
+	c.Wait()
+	val, ok := c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, 5, val)
+
+	c.Set(1, 7, 1)
+	c.Wait()
+	val, ok = c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, 7, val)
+
+	c.SetShouldUpdate(nil)
+	c.Set(1, 2, 1)
+	c.Wait()
+	val, ok = c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, 2, val)
+}
+
+func TestCacheGetAllowStale(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:            100,
+		MaxCost:                10,
+		IgnoreInternalCost:     true,
+		BufferItems:            64,
+		TtlTickerDurationInSec: 60,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.SetWithTTL(1, 1, 1, 10*time.Millisecond))
+	require.True(t, c.Set(2, 2, 1))
+	c.Wait()
+
+	val, stale, ok := c.GetAllowStale(1)
+	require.True(t, ok)
+	require.False(t, stale)
+	require.Equal(t, 1, val)
+
+	time.Sleep(20 * time.Millisecond)
+	_, ok = c.Get(1)
+	require.False(t, ok)
+	val, stale, ok = c.GetAllowStale(1)
+	require.True(t, ok)
+	require.True(t, stale)
+	require.Equal(t, 1, val)
+
+	val, stale, ok = c.GetAllowStale(2)
+	require.True(t, ok)
+	require.False(t, stale)
+	require.Equal(t, 2, val)
+
+	_, _, ok = c.GetAllowStale(3)
+	require.False(t, ok)
+}
+
+func TestCacheEvictSoonestExpiring(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            3,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		EvictionPolicy:     EvictSoonestExpiring,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.SetWithTTL(1, 1, 1, time.Minute))
+	require.True(t, c.SetWithTTL(2, 2, 1, 10*time.Second))
+	require.True(t, c.SetWithTTL(3, 3, 1, time.Hour))
+	c.Wait()
+	// Frequency doesn't matter.
+	c.WarmFrequency([]int{2}, []int{10})
+
+	require.True(t, c.Set(4, 4, 1))
+	c.Wait()
+	_, ok := c.Get(2)
+	require.False(t, ok)
+	require.True(t, c.Set(5, 5, 1))
+	c.Wait()
+	_, ok = c.Get(1)
+	require.False(t, ok)
+	for _, key := range []int{3, 4, 5} {
+		_, ok := c.Get(key)
+		require.True(t, ok, "key: %d", key)
+	}
+}
+
+func TestCacheVictimChan(t *testing.T) {
+	victims := make(chan Entry[int, int], 1)
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            2,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		VictimChan:         victims,
+		EvictionPolicy:     EvictSoonestExpiring,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.SetWithTTL(1, 10, 1, time.Minute))
+	require.True(t, c.SetWithTTL(2, 20, 1, time.Hour))
+	c.Wait()
+	require.True(t, c.Set(3, 30, 1))
+	c.Wait()
+	select {
+	case victim := <-victims:
+		require.Equal(t, 1, victim.OriginalKey)
+		require.Equal(t, 10, victim.Value)
+		require.Equal(t, int64(1), victim.Cost)
+	default:
+		t.Fatal("the victim should have been sent")
+	}
+
+	// Evictions don't block when the channel is full.
+	victims <- Entry[int, int]{}
+	require.True(t, c.Set(4, 40, 1))
+	c.Wait()
+	_, ok := c.Get(4)
+	require.True(t, ok)
+}
+
+func TestCachePin(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            4,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	for i := 0; i < 4; i++ {
+		c.Pin(i)
+		require.True(t, c.Set(i, i, 1))
+	}
+	c.Wait()
+	// Every key is pinned, so new keys, however hot, can't make room.
+	c.WarmFrequency([]int{10}, []int{10})
+	require.True(t, c.Set(10, 10, 1))
+	c.Wait()
+	_, ok := c.Get(10)
+	require.False(t, ok)
+	for i := 0; i < 4; i++ {
+		_, ok := c.Get(i)
+		require.True(t, ok)
+	}
+
+	c.Unpin(2)
+	require.True(t, c.Set(10, 10, 1))
+	c.Wait()
+	_, ok = c.Get(10)
+	require.True(t, ok)
+	_, ok = c.Get(2)
+	require.False(t, ok, "the only unpinned key should be evicted")
+}
+
+func TestCacheGetNoExpiry(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:            100,
+		MaxCost:                10,
+		IgnoreInternalCost:     true,
+		BufferItems:            64,
+		TtlTickerDurationInSec: 60,
+		Metrics:                true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.SetWithTTL(1, 1, 1, 10*time.Millisecond))
+	c.Wait()
+	time.Sleep(20 * time.Millisecond)
+	_, ok := c.Get(1)
+	require.False(t, ok)
+	val, ok := c.GetNoExpiry(1)
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+
+	_, ok = c.GetNoExpiry(2)
+	require.False(t, ok)
+	require.Equal(t, uint64(1), c.Metrics.Hits())
+	require.Equal(t, uint64(2), c.Metrics.Misses())
+}
+
+func TestCacheKeysExpired(t *testing.T) {
+	cleanups := make(chan int, 10)
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:            100,
+		MaxCost:                10,
+		IgnoreInternalCost:     true,
+		BufferItems:            64,
+		Metrics:                true,
+		TtlTickerDurationInSec: 1,
+		OnCleanup: func(numExpired int, took time.Duration) {
+			cleanups <- numExpired
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	for i := 0; i < 5; i++ {
+		require.True(t, c.SetWithTTL(i, i, 1, time.Millisecond))
+	}
+	require.True(t, c.Set(5, 5, 1))
+	c.Wait()
+
+	var expired int
+	for expired < 5 {
+		select {
+		case n := <-cleanups:
+			expired += n
+		case <-time.After(15 * time.Second):
+			t.Fatalf("only %d items expired", expired)
+		}
+	}
+	require.Equal(t, 5, expired)
+	require.Equal(t, uint64(5), c.Metrics.KeysExpired())
+	require.Equal(t, uint64(5), c.Metrics.KeysEvicted())
+}
+
+func TestCachePendingSets(t *testing.T) {
+	c, err := newTestCache()
+	require.NoError(t, err)
+	require.Zero(t, c.PendingSets())
+
+	// Stop the goroutine draining the buffer so that Sets pile up.
+	c.stop <- struct{}{}
+	<-c.done
+	for i := 0; i < 10; i++ {
+		c.Set(i, i, 1)
+	}
+	require.Equal(t, 10, c.PendingSets())
+
+	go c.processItems()
+	c.Wait()
+	require.Zero(t, c.PendingSets())
+	c.Close()
+
+	var nilCache *Cache[int, int]
+	require.Zero(t, nilCache.PendingSets())
+}
+
+type testLogger struct {
+	mu       sync.Mutex
+	warnings []string
+	errors   []string
+}
+
+func (l *testLogger) Warningf(format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.warnings = append(l.warnings, fmt.Sprintf(format, args...))
+}
+
+func (l *testLogger) Errorf(format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.errors = append(l.errors, fmt.Sprintf(format, args...))
+}
+
+func TestCacheRecoverPanic(t *testing.T) {
+	logger := &testLogger{}
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		Cost: func(value int) int64 {
+			if value < 0 {
+				panic("bad value")
+			}
+			return 1
+		},
+		Logger: logger,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.Set(1, -1, 0))
+	c.Wait()
+	_, ok := c.Get(1)
+	require.False(t, ok)
+
+	// The goroutine processing Sets is still alive.
+	require.True(t, c.Set(2, 2, 0))
+	c.Wait()
+	val, ok := c.Get(2)
+	require.True(t, ok)
+	require.Equal(t, 2, val)
+
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	require.Len(t, logger.errors, 1)
+	require.Contains(t, logger.errors[0], "bad value")
+}
+
+func TestCacheRecoverPanicKeepsBookkeeping(t *testing.T) {
+	logger := &testLogger{}
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            5,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		OnRemove: func(key, value int, reason RemoveReason) {
+			panic("bad removal")
+		},
+		Cost: func(value int) int64 {
+			if value < 0 {
+				panic("bad value")
+			}
+			return 1
+		},
+		Logger: logger,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	// Every victim is removed from the store, even though OnRemove panics.
+	for i := 0; i < 5; i++ {
+		require.True(t, c.Set(i, i, 1))
+	}
+	c.Wait()
+	for i := 0; i < 20; i++ {
+		c.Set(99, 99, 5)
+		c.Wait()
+		if _, ok := c.Get(99); ok {
+			break
+		}
+	}
+	require.Equal(t, 1, c.Len())
+	require.Equal(t, int64(5), c.UsedCost())
+
+	// An upserted item whose cost can't be computed is removed from the store.
+	_, inserted := c.GetOrSet(100, -1, 0)
+	require.True(t, inserted)
+	c.Wait()
+	_, ok := c.Get(100)
+	require.False(t, ok)
+
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	require.NotEmpty(t, logger.errors)
+}
+
+func TestCacheClear(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		c.Set(i, i, 1)
+	}
+	time.Sleep(wait)
+	require.Equal(t, uint64(10), c.Metrics.KeysAdded())
+
+	c.Clear()
+	require.Equal(t, uint64(0), c.Metrics.KeysAdded())
+
+	for i := 0; i < 10; i++ {
+		val, ok := c.Get(i)
+		require.False(t, ok)
+		require.Zero(t, val)
+	}
+}
+
+func TestCacheClearValues(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	c.WarmFrequency([]int{1}, []int{5})
+	for i := 0; i < 10; i++ {
+		require.True(t, c.Set(i, i, 1))
+	}
+	c.Wait()
+	require.Equal(t, uint64(10), c.Metrics.KeysAdded())
+
+	c.ClearValues()
+	require.Equal(t, int64(0), c.UsedCost())
+	require.Equal(t, uint64(10), c.Metrics.KeysAdded())
+	require.Equal(t, int64(5), c.EstimateFrequency(1))
+	for i := 0; i < 10; i++ {
+		_, ok := c.Get(i)
+		require.False(t, ok)
+	}
+
+	require.True(t, c.Set(1, 1, 1))
+	c.Wait()
+	val, ok := c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+}
+
+func TestCacheMetrics(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		c.Set(i, i, 1)
+	}
+	time.Sleep(wait)
+	m := c.Metrics
+	require.Equal(t, uint64(10), m.KeysAdded())
+}
+
+func TestMetrics(t *testing.T) {
+	newMetrics()
+}
+
+func TestNilMetrics(t *testing.T) {
+	var m *Metrics
+	for _, f := range []func() uint64{
+		m.Hits,
+		m.Misses,
 		m.KeysAdded,
 		m.KeysEvicted,
 		m.CostEvicted,
@@ -722,6 +1618,7 @@ func TestMetricsString(t *testing.T) {
 	m.add(keyAdd, 1, 1)
 	m.add(keyUpdate, 1, 1)
 	m.add(keyEvict, 1, 1)
+	m.add(keyExpire, 1, 1)
 	m.add(costAdd, 1, 1)
 	m.add(costEvict, 1, 1)
 	m.add(dropSets, 1, 1)
@@ -734,6 +1631,7 @@ func TestMetricsString(t *testing.T) {
 	require.Equal(t, uint64(1), m.KeysAdded())
 	require.Equal(t, uint64(1), m.KeysUpdated())
 	require.Equal(t, uint64(1), m.KeysEvicted())
+	require.Equal(t, uint64(1), m.KeysExpired())
 	require.Equal(t, uint64(1), m.CostAdded())
 	require.Equal(t, uint64(1), m.CostEvicted())
 	require.Equal(t, uint64(1), m.SetsDropped())
@@ -1006,3 +1904,978 @@ func TestCacheWithTTL(t *testing.T) {
 		})
 	}
 }
+
+func TestCacheCompareAndSwap(t *testing.T) {
+	c, err := NewCache(&Config[string, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.False(t, CompareAndSwap(c, "lock", 0, 1, 1))
+	require.True(t, c.SetWithTTL("lock", 0, 1, time.Hour))
+	c.Wait()
+
+	// Only one of the concurrent swaps from 0 succeeds.
+	var wg sync.WaitGroup
+	var swapped atomic.Int32
+	for i := 1; i <= 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if CompareAndSwap(c, "lock", 0, i, 2) {
+				swapped.Add(1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	require.Equal(t, int32(1), swapped.Load())
+
+	val, ok := c.Get("lock")
+	require.True(t, ok)
+	require.NotZero(t, val)
+	require.False(t, CompareAndSwap(c, "lock", 0, 9, 1))
+	require.True(t, CompareAndSwap(c, "lock", val, 0, 3))
+	val, ok = c.Get("lock")
+	require.True(t, ok)
+	require.Zero(t, val)
+
+	c.Wait()
+	require.Equal(t, int64(3), c.UsedCost())
+	ttl, ok := c.GetTTL("lock")
+	require.True(t, ok)
+	require.NotZero(t, ttl)
+}
+
+func TestCacheGetOrSet(t *testing.T) {
+	c, err := NewCache(&Config[string, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	// Exactly one of the concurrent calls inserts its value, and all of them
+	// get it.
+	var wg sync.WaitGroup
+	var inserted atomic.Int32
+	values := make([]int, 16)
+	for i := range values {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			val, ok := c.GetOrSet("key", i+1, 1)
+			if ok {
+				inserted.Add(1)
+			}
+			values[i] = val
+		}(i)
+	}
+	wg.Wait()
+	require.Equal(t, int32(1), inserted.Load())
+	for _, val := range values {
+		require.Equal(t, values[0], val)
+	}
+
+	val, ok := c.Get("key")
+	require.True(t, ok)
+	require.Equal(t, values[0], val)
+	val, ok = c.GetOrSet("key", 100, 1)
+	require.False(t, ok)
+	require.Equal(t, values[0], val)
+
+	c.Wait()
+	require.Equal(t, int64(1), c.UsedCost())
+}
+
+func TestCacheIncrement(t *testing.T) {
+	c, err := NewCache(&Config[string, int64]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				_, ok := Increment(c, "counter", 1, 1, 0)
+				require.True(t, ok)
+			}
+		}()
+	}
+	wg.Wait()
+	c.Wait()
+
+	val, ok := c.Get("counter")
+	require.True(t, ok)
+	require.Equal(t, int64(8000), val)
+	require.Equal(t, uint64(1), c.Metrics.KeysAdded())
+
+	n, ok := Increment(c, "counter", -8000, 1, 0)
+	require.True(t, ok)
+	require.Equal(t, int64(0), n)
+
+	n, ok = Increment(c, "window", 5, 1, time.Hour)
+	require.True(t, ok)
+	require.Equal(t, int64(5), n)
+	ttl, ok := c.GetTTL("window")
+	require.True(t, ok)
+	require.True(t, ttl > 0 && ttl <= time.Hour)
+
+	_, ok = Increment(c, "window", 1, 1, -time.Second)
+	require.False(t, ok)
+}
+
+func TestCacheGetOrSetExpired(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		DisableCleanup:     true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.SetWithTTL(1, 1, 1, 10*time.Millisecond))
+	c.Wait()
+	time.Sleep(2 * wait)
+	// The expired item wasn't cleaned up, and is replaced in place.
+	val, inserted := c.GetOrSet(1, 2, 3)
+	require.True(t, inserted)
+	require.Equal(t, 2, val)
+	c.Wait()
+	val, ok := c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, 2, val)
+	require.Equal(t, int64(3), c.UsedCost())
+}
+
+func TestCacheUpsertAfterPendingSet(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	// The Set is applied after GetOrSet inserted the key, which must stay.
+	c.Set(1, 1, 1)
+	val, _ := c.GetOrSet(1, 2, 1)
+	c.Wait()
+	got, ok := c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, val, got)
+
+	c.Set(2, 1, 1)
+	_, ok = Increment(c, 2, 1, 1, 0)
+	require.True(t, ok)
+	c.Wait()
+	_, ok = c.Get(2)
+	require.True(t, ok)
+	require.Equal(t, int64(2), c.UsedCost())
+}
+
+func TestCacheUpsertAfterPendingDel(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	// The Del is applied by the policy after GetOrSet inserted the key again,
+	// which must stay.
+	c.Set(1, 1, 1)
+	c.Wait()
+	c.Del(1)
+	val, inserted := c.GetOrSet(1, 2, 1)
+	require.True(t, inserted)
+	require.Equal(t, 2, val)
+	c.Wait()
+	val, ok := c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, 2, val)
+	require.Equal(t, int64(1), c.UsedCost())
+
+	// A Del after the insert still removes it.
+	c.Del(1)
+	c.Wait()
+	_, ok = c.Get(1)
+	require.False(t, ok)
+	require.Equal(t, int64(0), c.UsedCost())
+}
+
+func TestCacheUpsertExpiredOnRemove(t *testing.T) {
+	var mu sync.Mutex
+	var removed []int
+	var reasons []RemoveReason
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		DisableCleanup:     true,
+		OnRemove: func(key, value int, reason RemoveReason) {
+			mu.Lock()
+			defer mu.Unlock()
+			removed = append(removed, value)
+			reasons = append(reasons, reason)
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.SetWithTTL(1, 10, 1, 10*time.Millisecond))
+	c.Wait()
+	time.Sleep(2 * wait)
+	// The expired value is replaced in place, and reported once.
+	v, ok := Increment(c, 1, 1, 1, 0)
+	require.True(t, ok)
+	require.Equal(t, int64(1), v)
+	c.Wait()
+	mu.Lock()
+	require.Equal(t, []int{10}, removed)
+	require.Equal(t, []RemoveReason{RemoveExpired}, reasons)
+	mu.Unlock()
+}
+
+func TestCacheSynchronousSet(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		SynchronousSet:     true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	for i := 0; i < 10; i++ {
+		require.True(t, c.Set(i, i, 1))
+		val, ok := c.Get(i)
+		require.True(t, ok)
+		require.Equal(t, i, val)
+	}
+	require.Equal(t, int64(10), c.UsedCost())
+
+	require.True(t, c.Set(1, 10, 1))
+	val, ok := c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, 10, val)
+
+	c.Del(1)
+	_, ok = c.Get(1)
+	require.False(t, ok)
+	require.Equal(t, int64(9), c.UsedCost())
+
+	// Too costly to ever be admitted.
+	require.False(t, c.Set(100, 100, 20))
+
+	// The result is the admission of the value, even if it expired since.
+	require.True(t, c.SetWithTTL(200, 200, 1, time.Nanosecond))
+	_, ok = c.Get(200)
+	require.False(t, ok)
+}
+
+func TestCacheProcessGoroutinesResetVictims(t *testing.T) {
+	var mu sync.Mutex
+	removed := make(map[int]int)
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        10000,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		ProcessGoroutines:  4,
+		OnRemove: func(key, value int, reason RemoveReason) {
+			mu.Lock()
+			defer mu.Unlock()
+			removed[value]++
+		},
+	})
+	require.NoError(t, err)
+
+	// Keys evicted by one worker are set again through the others, so that the
+	// victims are deleted while their keys may be set again.
+	var wg sync.WaitGroup
+	accepted := make([][]int, 4)
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 20000; i++ {
+				val := g*20000 + i
+				if c.Set((g*7+i)%100, val, 1) {
+					accepted[g] = append(accepted[g], val)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	c.Wait()
+
+	// The store and the policy agree on the keys in the cache.
+	var stored int64
+	for key := 0; key < 100; key++ {
+		keyHash, conflictHash := c.keyToHash(key)
+		_, ok := c.storedItems.Get(keyHash, conflictHash)
+		require.Equal(t, c.cachePolicy.Has(keyHash), ok, "key %d", key)
+		if ok {
+			stored++
+		}
+	}
+	require.Equal(t, stored, c.UsedCost())
+
+	// Every value is removed exactly once, none being dropped unreported.
+	c.Close()
+	mu.Lock()
+	defer mu.Unlock()
+	for _, vals := range accepted {
+		for _, val := range vals {
+			require.Equal(t, 1, removed[val], "value %d", val)
+		}
+	}
+}
+
+func TestCacheProcessGoroutines(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        10000,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+		ProcessGoroutines:  4,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				key := g*1000 + i
+				c.Set(key, key, 1)
+				if i%2 == 0 {
+					c.Del(key)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	c.Wait()
+
+	require.LessOrEqual(t, c.Metrics.CostAdded()-c.Metrics.CostEvicted(), uint64(100))
+	for key := 0; key < 4000; key += 2 {
+		_, ok := c.Get(key)
+		require.False(t, ok, "key %d was deleted after it was set", key)
+	}
+
+	c.Clear()
+	require.True(t, c.Set(1, 1, 1))
+	c.Wait()
+	val, ok := c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+}
+
+func TestCacheGetSampleRate(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:   100,
+		MaxCost:       10,
+		BufferItems:   8,
+		Metrics:       true,
+		GetSampleRate: 8,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	// Count the sampled Gets as they are pushed, as the pooled stripes of the
+	// default buffer may be dropped before they are drained.
+	var sampled int
+	c.getBuf = newStripedRingBuffer(&testConsumer{
+		push: func(items []uint64) { sampled += len(items) },
+		save: true,
+	}, 1, 1)
+
+	for i := 0; i < 8000; i++ {
+		c.Get(1)
+	}
+	require.Greater(t, sampled, 500)
+	require.Less(t, sampled, 1500)
+	require.Equal(t, uint64(8000), c.Metrics.Misses())
+}
+
+func TestCacheRecost(t *testing.T) {
+	c, err := NewCache(&Config[int, *[]byte]{
+		NumCounters:        100,
+		MaxCost:            1000,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Cost: func(value *[]byte) int64 {
+			return int64(len(*value))
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	value := make([]byte, 10)
+	require.True(t, c.Set(1, &value, 0))
+	c.Wait()
+	keyHash, _ := c.HashOf(1)
+	require.Equal(t, int64(10), c.cachePolicy.Cost(keyHash))
+
+	value = append(value, make([]byte, 90)...)
+	require.True(t, c.Recost(1))
+	c.Wait()
+	require.Equal(t, int64(100), c.cachePolicy.Cost(keyHash))
+
+	require.False(t, c.Recost(2))
+}
+
+func TestCacheRecostAll(t *testing.T) {
+	var factor atomic.Int64
+	factor.Store(1)
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            1000,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Cost: func(value int) int64 {
+			return int64(value) * factor.Load()
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	for i := 1; i <= 10; i++ {
+		require.True(t, c.Set(i, i, 0))
+	}
+	c.Wait()
+	require.Equal(t, int64(55), c.UsedCost())
+
+	factor.Store(3)
+	c.RecostAll()
+	require.Equal(t, int64(165), c.UsedCost())
+	keyHash, _ := c.HashOf(4)
+	require.Equal(t, int64(12), c.cachePolicy.Cost(keyHash))
+
+	// The cache still works afterwards.
+	require.True(t, c.Set(11, 11, 0))
+	c.Wait()
+	require.Equal(t, int64(198), c.UsedCost())
+}
+
+func TestCacheHeadroom(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.Equal(t, int64(10), c.Headroom())
+	require.True(t, c.Set(1, 1, 3))
+	c.Wait()
+	require.Equal(t, int64(7), c.Headroom())
+	c.UpdateMaxCost(2)
+	require.Equal(t, int64(-1), c.Headroom())
+}
+
+type testTracer[K Key] struct {
+	mu   sync.Mutex
+	gets []string
+	sets []string
+}
+
+func (t *testTracer[K]) OnGet(key K, hit bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.gets = append(t.gets, fmt.Sprintf("%v:%v", key, hit))
+}
+
+func (t *testTracer[K]) OnSet(key K, cost int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sets = append(t.sets, fmt.Sprintf("%v:%d", key, cost))
+}
+
+func TestCacheTracer(t *testing.T) {
+	tracer := &testTracer[int]{}
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Tracer:             tracer,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.Set(1, 1, 3))
+	require.True(t, c.SetWithTTL(2, 2, 4, time.Hour))
+	c.Wait()
+	_, ok := c.Get(1)
+	require.True(t, ok)
+	_, ok = c.Get(3)
+	require.False(t, ok)
+	_, ok = c.GetNoExpiry(2)
+	require.True(t, ok)
+	_, _, ok = c.GetAllowStale(4)
+	require.False(t, ok)
+	_, ok = Increment(c, 5, 1, 1, 0)
+	require.True(t, ok)
+	_, inserted := c.GetOrSet(6, 6, 2)
+	require.True(t, inserted)
+	_, inserted = c.GetOrSet(6, 7, 2)
+	require.False(t, inserted)
+	_, err = c.GetOrCompute(7, 3, func() (int, error) { return 7, nil })
+	require.NoError(t, err)
+
+	require.Equal(t, []string{"1:3", "2:4", "5:1", "6:2", "7:3"}, tracer.sets)
+	require.Equal(t, []string{"1:true", "3:false", "2:true", "4:false", "5:false",
+		"6:false", "6:true", "7:false"}, tracer.gets)
+}
+
+func TestCacheDefaultTTL(t *testing.T) {
+	_, err := NewCache(&Config[int, int]{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		DefaultTTL:  -time.Second,
+	})
+	require.ErrorIs(t, err, ErrNegativeDefaultTTL)
+
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		DefaultTTL:         time.Hour,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.Set(1, 1, 1))
+	require.True(t, c.SetWithTTL(2, 2, 1, time.Minute))
+	require.True(t, c.SetWithTTL(3, 3, 1, 0))
+	c.Wait()
+
+	ttl, ok := c.GetTTL(1)
+	require.True(t, ok)
+	require.InDelta(t, time.Hour, ttl, float64(time.Minute))
+	ttl, ok = c.GetTTL(2)
+	require.True(t, ok)
+	require.InDelta(t, time.Minute, ttl, float64(time.Second))
+	ttl, ok = c.GetTTL(3)
+	require.True(t, ok)
+	require.Zero(t, ttl)
+}
+
+func TestCacheEntry(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters: 100,
+		MaxCost:     1000,
+		BufferItems: 64,
+		StoreKeys:   true,
+		// Keys 1 and 11 share a key hash, with different conflict hashes.
+		KeyToHash: func(key int) (uint64, uint64) {
+			return uint64(key % 10), uint64(key)
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	_, ok := c.Entry(1)
+	require.False(t, ok)
+
+	require.True(t, c.SetWithTTL(1, 10, 3, time.Hour))
+	c.Wait()
+
+	entry, ok := c.Entry(1)
+	require.True(t, ok)
+	require.Equal(t, uint64(1), entry.Key)
+	require.Equal(t, uint64(1), entry.Conflict)
+	require.Equal(t, 1, entry.OriginalKey)
+	require.Equal(t, 10, entry.Value)
+	require.Equal(t, 3+itemSize, entry.Cost)
+	require.WithinDuration(t, time.Now().Add(time.Hour), entry.Expiration, time.Minute)
+
+	// Get misses 11 because of the conflict hash, Entry shows what is stored.
+	_, ok = c.Get(11)
+	require.False(t, ok)
+	entry, ok = c.Entry(11)
+	require.True(t, ok)
+	require.Equal(t, uint64(1), entry.Conflict)
+	require.Equal(t, 1, entry.OriginalKey)
+}
+
+func TestCacheDisableCleanup(t *testing.T) {
+	var cleanups atomic.Int32
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:            100,
+		MaxCost:                10,
+		BufferItems:            64,
+		IgnoreInternalCost:     true,
+		TtlTickerDurationInSec: 1,
+		DisableCleanup:         true,
+		OnCleanup: func(int, time.Duration) {
+			cleanups.Add(1)
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	require.Nil(t, c.cleanupTicker)
+
+	require.True(t, c.SetWithTTL(1, 1, 1, 10*time.Millisecond))
+	c.Wait()
+	time.Sleep(1200 * time.Millisecond)
+
+	_, ok := c.Get(1)
+	require.False(t, ok)
+	// The expired item was never cleaned up.
+	require.Zero(t, cleanups.Load())
+	_, numKeys := c.ExpirationStats()
+	require.Equal(t, 1, numKeys)
+	require.Equal(t, int64(1), c.UsedCost())
+}
+
+func TestCacheOnExpire(t *testing.T) {
+	expired := make(chan string, 10)
+	c, err := NewCache(&Config[string, int]{
+		NumCounters:            100,
+		MaxCost:                1,
+		BufferItems:            64,
+		IgnoreInternalCost:     true,
+		TtlTickerDurationInSec: 1,
+		OnExpire: func(key string, value int) {
+			expired <- fmt.Sprintf("%s=%d", key, value)
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.SetWithTTL("a", 1, 1, 10*time.Millisecond))
+	c.Wait()
+	select {
+	case got := <-expired:
+		require.Equal(t, "a=1", got)
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnExpire wasn't called")
+	}
+
+	// Capacity evictions aren't expirations.
+	require.True(t, c.Set("b", 2, 1))
+	c.Wait()
+	for i := 0; i < 100; i++ {
+		c.Get("c")
+	}
+	c.Set("c", 3, 1)
+	c.Wait()
+	time.Sleep(1100 * time.Millisecond)
+	require.Empty(t, expired)
+}
+
+func TestCacheSetAndCost(t *testing.T) {
+	c, err := NewCache(&Config[int, string]{
+		NumCounters: 100,
+		MaxCost:     1000,
+		BufferItems: 64,
+		Cost: func(value string) int64 {
+			return int64(len(value))
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	ok, cost := c.SetAndCost(1, "abc", 0)
+	require.True(t, ok)
+	require.Equal(t, 3+itemSize, cost)
+	ok, cost = c.SetAndCost(2, "abc", 10)
+	require.True(t, ok)
+	require.Equal(t, 10+itemSize, cost)
+	c.Wait()
+	require.Equal(t, 13+2*itemSize, c.UsedCost())
+
+	c.Close()
+	ok, cost = c.SetAndCost(3, "abc", 0)
+	require.False(t, ok)
+	require.Zero(t, cost)
+}
+
+func TestCachePurgeExpired(t *testing.T) {
+	var expired atomic.Int32
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		DisableCleanup:     true,
+		OnExpire: func(int, int) {
+			expired.Add(1)
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	for i := 0; i < 10; i++ {
+		require.True(t, c.SetWithTTL(i, i, 1, 10*time.Millisecond))
+	}
+	require.True(t, c.SetWithTTL(10, 10, 1, time.Hour))
+	require.True(t, c.Set(11, 11, 1))
+	c.Wait()
+	require.Zero(t, c.PurgeExpired())
+	time.Sleep(20 * time.Millisecond)
+
+	require.Equal(t, 10, c.PurgeExpired())
+	require.Equal(t, int32(10), expired.Load())
+	require.Equal(t, int64(2), c.UsedCost())
+	_, numKeys := c.ExpirationStats()
+	require.Equal(t, 1, numKeys)
+	_, ok := c.Get(10)
+	require.True(t, ok)
+	require.Zero(t, c.PurgeExpired())
+}
+
+func TestCacheLen(t *testing.T) {
+	var c *Cache[int, int]
+	require.Zero(t, c.Len())
+
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	for i := 0; i < 10; i++ {
+		require.True(t, c.Set(i, i, 1))
+	}
+	require.True(t, c.SetWithTTL(10, 10, 1, time.Millisecond))
+	c.Wait()
+	time.Sleep(5 * time.Millisecond)
+	require.Equal(t, 10, c.Len())
+
+	c.Del(0)
+	c.Wait()
+	require.Equal(t, 9, c.Len())
+}
+
+func TestCacheWaitUntilCost(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	for i := 0; i < 5; i++ {
+		require.True(t, c.Set(i, i, 2))
+	}
+	c.Wait()
+	require.Equal(t, int64(10), c.UsedCost())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, c.WaitUntilCost(ctx, 4), context.DeadlineExceeded)
+
+	go func() {
+		for i := 0; i < 3; i++ {
+			c.Del(i)
+		}
+	}()
+	require.NoError(t, c.WaitUntilCost(context.Background(), 4))
+	require.LessOrEqual(t, c.UsedCost(), int64(4))
+}
+
+func TestCacheReplaceAll(t *testing.T) {
+	var evicted []int
+	var mu sync.Mutex
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		OnEvict: func(item *Item[int]) {
+			mu.Lock()
+			evicted = append(evicted, item.Value)
+			mu.Unlock()
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	for i := 0; i < 3; i++ {
+		require.True(t, c.Set(i, i, 1))
+	}
+	c.Wait()
+
+	c.ReplaceAll([]int{10, 11, 12}, []int{100, 110, 120}, func(v int) int64 { return 2 })
+	mu.Lock()
+	require.ElementsMatch(t, []int{0, 1, 2}, evicted)
+	mu.Unlock()
+	for i := 0; i < 3; i++ {
+		_, ok := c.Get(i)
+		require.False(t, ok)
+	}
+	for i := 10; i < 13; i++ {
+		val, ok := c.Get(i)
+		require.True(t, ok)
+		require.Equal(t, i*10, val)
+	}
+	require.Equal(t, int64(6), c.UsedCost())
+
+	// Entries beyond MaxCost are dropped.
+	c.ReplaceAll([]int{1, 2, 3}, []int{1, 2, 3}, func(v int) int64 { return 5 })
+	require.LessOrEqual(t, c.UsedCost(), int64(10))
+
+	// The cache keeps working afterwards.
+	require.True(t, c.Set(20, 20, 1))
+	c.Wait()
+	_, ok := c.Get(20)
+	require.True(t, ok)
+}
+
+func TestCacheMaxItemCostSeen(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.Zero(t, c.MaxItemCostSeen())
+	c.Set(1, 1, 5)
+	c.Set(2, 2, 30)
+	c.Set(3, 3, 10)
+	c.Wait()
+	require.Equal(t, int64(30), c.MaxItemCostSeen())
+
+	// It is a high-water mark, deleting the item doesn't lower it.
+	c.Del(2)
+	c.Wait()
+	require.Equal(t, int64(30), c.MaxItemCostSeen())
+
+	c.Set(1, 1, 40)
+	c.Wait()
+	require.Equal(t, int64(40), c.MaxItemCostSeen())
+
+	c.Clear()
+	require.Zero(t, c.MaxItemCostSeen())
+}
+
+func TestCacheRange(t *testing.T) {
+	c, err := NewCache(&Config[string, int]{
+		NumCounters:        100,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		StoreKeys:          true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	c.Set("a", 1, 1)
+	c.Set("b", 2, 1)
+	c.Set("c", 3, 1)
+	c.SetWithTTL("expired", 4, 1, time.Millisecond)
+	c.Wait()
+	time.Sleep(wait)
+
+	got := make(map[string]int)
+	require.NoError(t, c.Range(func(key string, value int) bool {
+		got[key] = value
+		return true
+	}))
+	require.Equal(t, map[string]int{"a": 1, "b": 2, "c": 3}, got)
+
+	n := 0
+	require.NoError(t, c.Range(func(key string, value int) bool {
+		n++
+		return false
+	}))
+	require.Equal(t, 1, n)
+
+	noKeys, err := NewCache(&Config[string, int]{
+		NumCounters: 100,
+		MaxCost:     100,
+		BufferItems: 64,
+	})
+	require.NoError(t, err)
+	defer noKeys.Close()
+	require.ErrorIs(t, noKeys.Range(func(key string, value int) bool {
+		return true
+	}), ErrKeysNotStored)
+}
+
+func TestCacheForEachExpiring(t *testing.T) {
+	c, err := NewCache(&Config[string, int]{
+		NumCounters:        100,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		StoreKeys:          true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	c.SetWithTTL("late", 3, 1, time.Hour)
+	c.SetWithTTL("soon", 1, 1, time.Minute)
+	c.SetWithTTL("sooner", 2, 1, 30*time.Second)
+	c.Set("never", 4, 1)
+	c.Wait()
+
+	var keys []string
+	require.NoError(t, c.ForEachExpiring(10*time.Minute,
+		func(key string, value int, remaining time.Duration) bool {
+			require.True(t, remaining > 0 && remaining <= 10*time.Minute)
+			keys = append(keys, key)
+			return true
+		}))
+	require.Equal(t, []string{"sooner", "soon"}, keys)
+
+	keys = keys[:0]
+	require.NoError(t, c.ForEachExpiring(2*time.Hour,
+		func(key string, value int, remaining time.Duration) bool {
+			keys = append(keys, key)
+			return len(keys) < 2
+		}))
+	require.Equal(t, []string{"sooner", "soon"}, keys)
+
+	noKeys, err := NewCache(&Config[string, int]{
+		NumCounters: 100,
+		MaxCost:     100,
+		BufferItems: 64,
+	})
+	require.NoError(t, err)
+	defer noKeys.Close()
+	require.ErrorIs(t, noKeys.ForEachExpiring(time.Hour,
+		func(key string, value int, remaining time.Duration) bool {
+			return true
+		}), ErrKeysNotStored)
+}
@@ -0,0 +1,120 @@
+/*
+ * Copyright 2024 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrComputePanicked is returned to the callers of GetOrCompute waiting for a
+// function which panicked.
+var ErrComputePanicked = errors.New("GetOrCompute function panicked")
+
+// computeCall is a GetOrCompute call in flight. value and err are set before
+// done is closed.
+type computeCall[V any] struct {
+	conflict uint64
+	done     chan struct{}
+	value    V
+	err      error
+}
+
+type computeShard[V any] struct {
+	sync.Mutex
+	calls map[uint64]*computeCall[V]
+}
+
+// GetOrCompute returns the value of key, calling fn to compute and store it if
+// the key is missing or expired. Concurrent calls for the same key share a
+// single call to fn: the others block until it returns and get its result.
+//
+// An error returned by fn is returned to all of them and nothing is stored. A
+// cost of 0 is computed with Config.Cost. Unlike Set, the value is written to
+// the store right away, so it is visible to Get as soon as GetOrCompute
+// returns; it is then admitted by the policy asynchronously, and may still be
+// rejected. The value expires after Config.DefaultTTL, if set.
+func (c *Cache[K, V]) GetOrCompute(key K, cost int64, fn func() (V, error)) (V, error) {
+	return c.GetOrComputeWithContext(context.Background(), key, cost, fn)
+}
+
+// GetOrComputeWithContext works like GetOrCompute, but returns ctx's error
+// without calling fn if ctx is done, and stops waiting for the call in flight
+// for the same key when ctx is done. A call to fn which started isn't stopped.
+func (c *Cache[K, V]) GetOrComputeWithContext(ctx context.Context, key K, cost int64,
+	fn func() (V, error)) (V, error) {
+	if err := ctx.Err(); err != nil {
+		return zeroValue[V](), err
+	}
+	if c == nil || c.isClosed.Load() {
+		return fn()
+	}
+	if value, ok := c.Get(key); ok {
+		return value, nil
+	}
+
+	keyHash, conflictHash := c.keyToHash(key)
+	shard := &c.computes[keyHash%numShards]
+	shard.Lock()
+	if call, ok := shard.calls[keyHash]; ok {
+		shard.Unlock()
+		if call.conflict != conflictHash {
+			// Another key with the same hash is being computed; it can't be
+			// shared.
+			return fn()
+		}
+		select {
+		case <-call.done:
+			return call.value, call.err
+		case <-ctx.Done():
+			return zeroValue[V](), ctx.Err()
+		}
+	}
+	call := &computeCall[V]{conflict: conflictHash, done: make(chan struct{})}
+	if shard.calls == nil {
+		shard.calls = make(map[uint64]*computeCall[V])
+	}
+	shard.calls[keyHash] = call
+	shard.Unlock()
+
+	defer func() {
+		shard.Lock()
+		delete(shard.calls, keyHash)
+		shard.Unlock()
+		close(call.done)
+	}()
+	// A previous call may have stored the value since the Get above.
+	if value, ok := c.storedItems.Get(keyHash, conflictHash); ok {
+		call.value = value
+		return value, nil
+	}
+	// Overwritten unless fn panics.
+	call.err = ErrComputePanicked
+	call.value, call.err = fn()
+	if call.err != nil {
+		return call.value, call.err
+	}
+	// A value Set in the meantime wins, so that every caller sees the same. The
+	// read was already traced by the Get above.
+	var inserted bool
+	call.value, inserted, _ = c.getOrSet(key, call.value, cost)
+	if inserted {
+		c.traceSet(key, cost)
+	}
+	return call.value, nil
+}
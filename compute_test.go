@@ -0,0 +1,145 @@
+package ristretto
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheGetOrCompute(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	var calls atomic.Int32
+	release := make(chan struct{})
+	compute := func() (int, error) {
+		calls.Add(1)
+		<-release
+		return 7, nil
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			val, err := c.GetOrCompute(1, 1, compute)
+			require.NoError(t, err)
+			require.Equal(t, 7, val)
+		}()
+	}
+	time.Sleep(wait)
+	close(release)
+	wg.Wait()
+	require.Equal(t, int32(1), calls.Load())
+
+	// The value is visible right away, without Wait.
+	val, ok := c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, 7, val)
+	val, err = c.GetOrCompute(1, 1, func() (int, error) {
+		t.Fatal("fn called for a cached key")
+		return 0, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 7, val)
+
+	errCompute := errors.New("compute failed")
+	_, err = c.GetOrCompute(2, 1, func() (int, error) {
+		return 0, errCompute
+	})
+	require.ErrorIs(t, err, errCompute)
+	_, ok = c.Get(2)
+	require.False(t, ok)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = c.GetOrComputeWithContext(ctx, 3, 1, func() (int, error) {
+		t.Fatal("fn called with a cancelled context")
+		return 0, nil
+	})
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func TestCacheGetOrComputeWaitCancelled(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = c.GetOrCompute(1, 1, func() (int, error) {
+			close(started)
+			<-release
+			return 1, nil
+		})
+	}()
+	<-started
+	defer func() {
+		close(release)
+		<-done
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	defer cancel()
+	_, err = c.GetOrComputeWithContext(ctx, 1, 1, func() (int, error) {
+		t.Fatal("fn called while another call is in flight")
+		return 0, nil
+	})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestCacheGetOrComputeConcurrentWrites(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	// A Del issued while fn runs is applied by the policy after the result
+	// is stored, and must not remove it.
+	c.Set(1, 1, 1)
+	c.Wait()
+	val, err := c.GetOrCompute(2, 1, func() (int, error) {
+		c.Del(1)
+		c.Del(2)
+		return 7, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 7, val)
+	c.Wait()
+	val, ok := c.Get(2)
+	require.True(t, ok)
+	require.Equal(t, 7, val)
+
+	// So must a Set issued while fn runs and applied after.
+	val, err = c.GetOrCompute(3, 1, func() (int, error) {
+		c.Set(3, 5, 1)
+		return 8, nil
+	})
+	require.NoError(t, err)
+	c.Wait()
+	got, ok := c.Get(3)
+	require.True(t, ok)
+	require.Equal(t, val, got)
+}
@@ -0,0 +1,144 @@
+/*
+ * Copyright 2024 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	// ErrNilKeyToHash is returned by NewCacheWithHasher when keyToHash is nil.
+	ErrNilKeyToHash = errors.New("keyToHash can't be nil")
+	// ErrHasherOnZeroHash is returned by NewCacheWithHasher when
+	// Config.OnZeroHash is set, since the keys it would be called with aren't
+	// known to the underlying cache.
+	ErrHasherOnZeroHash = errors.New("OnZeroHash isn't supported with keyToHash")
+)
+
+// HashedCache is a cache for keys of any comparable type, such as structs,
+// which don't satisfy Key. Keys are only known through the
+// hashes returned by the keyToHash function it was created with. It is created
+// by NewCacheWithHasher.
+type HashedCache[K comparable, V any] struct {
+	cache     *Cache[uint64, V]
+	keyToHash func(key K) (uint64, uint64)
+}
+
+// NewCacheWithHasher returns a cache whose keys are hashed by keyToHash, which
+// is required, and which must return a good 64-bit key hash and, to tell apart
+// keys with the same key hash, a conflict hash. As with Config.KeyToHash, a
+// zero conflict hash disables the conflict check.
+//
+// config configures the underlying cache, which is keyed by the key hashes.
+// Config.KeyToHash is ignored, and so is Config.StoreKeys, since the original
+// keys aren't kept. The Tracer and the callbacks taking a key, such as OnRemove
+// and OnExpire, are given the key hash instead. Config.OnZeroHash can't be set.
+func NewCacheWithHasher[K comparable, V any](config *Config[uint64, V],
+	keyToHash func(key K) (uint64, uint64)) (*HashedCache[K, V], error) {
+	if keyToHash == nil {
+		return nil, ErrNilKeyToHash
+	}
+	if config.OnZeroHash != nil {
+		return nil, ErrHasherOnZeroHash
+	}
+	cfg := *config
+	cfg.KeyToHash = nil
+	cfg.StoreKeys = false
+	cache, err := NewCache(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &HashedCache[K, V]{cache: cache, keyToHash: keyToHash}, nil
+}
+
+// Cache returns the underlying cache, keyed by the key hashes, e.g. to read its
+// Metrics or to update its MaxCost.
+func (h *HashedCache[K, V]) Cache() *Cache[uint64, V] {
+	return h.cache
+}
+
+// Get works like Cache.Get.
+func (h *HashedCache[K, V]) Get(key K) (V, bool) {
+	if h == nil || h.cache.isClosed.Load() {
+		return zeroValue[V](), false
+	}
+	keyHash, conflictHash := h.keyToHash(key)
+	value, ok := h.cache.get(keyHash, conflictHash)
+	if h.cache.tracer != nil {
+		h.cache.tracer.OnGet(keyHash, ok)
+	}
+	return value, ok
+}
+
+// Set works like Cache.Set.
+func (h *HashedCache[K, V]) Set(key K, value V, cost int64) bool {
+	if h == nil {
+		return false
+	}
+	return h.SetWithTTL(key, value, cost, h.cache.defaultTTL)
+}
+
+// SetWithTTL works like Cache.SetWithTTL.
+func (h *HashedCache[K, V]) SetWithTTL(key K, value V, cost int64, ttl time.Duration) bool {
+	if h == nil || h.cache.isClosed.Load() {
+		return false
+	}
+	keyHash, conflictHash := h.keyToHash(key)
+	if h.cache.tracer != nil {
+		h.cache.tracer.OnSet(keyHash, cost)
+	}
+	// The key hash stands for the key in the callbacks which need it.
+	var origKey any
+	if h.cache.storeKeys {
+		origKey = keyHash
+	}
+	return h.cache.set(keyHash, conflictHash, origKey, value, cost, ttl)
+}
+
+// Del works like Cache.Del.
+func (h *HashedCache[K, V]) Del(key K) {
+	if h == nil || h.cache.isClosed.Load() {
+		return
+	}
+	keyHash, conflictHash := h.keyToHash(key)
+	h.cache.del(keyHash, conflictHash)
+}
+
+// Wait works like Cache.Wait.
+func (h *HashedCache[K, V]) Wait() {
+	if h == nil {
+		return
+	}
+	h.cache.Wait()
+}
+
+// Clear works like Cache.Clear.
+func (h *HashedCache[K, V]) Clear() {
+	if h == nil {
+		return
+	}
+	h.cache.Clear()
+}
+
+// Close works like Cache.Close.
+func (h *HashedCache[K, V]) Close() {
+	if h == nil {
+		return
+	}
+	h.cache.Close()
+}
@@ -0,0 +1,107 @@
+package ristretto
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/stretchr/testify/require"
+)
+
+type hashedTestKey struct {
+	tenant string
+	id     int
+}
+
+func hashedTestKeyToHash(key hashedTestKey) (uint64, uint64) {
+	return uint64(key.id)<<32 ^ xxhash.Sum64String(key.tenant), uint64(key.id)
+}
+
+func TestNewCacheWithHasher(t *testing.T) {
+	_, err := NewCacheWithHasher[hashedTestKey](&Config[uint64, int]{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+	}, nil)
+	require.ErrorIs(t, err, ErrNilKeyToHash)
+
+	_, err = NewCacheWithHasher(&Config[uint64, int]{}, hashedTestKeyToHash)
+	require.ErrorIs(t, err, ErrZeroNumCounters)
+
+	c, err := NewCacheWithHasher(&Config[uint64, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		StoreKeys:          true,
+	}, hashedTestKeyToHash)
+	require.NoError(t, err)
+	defer c.Close()
+
+	a := hashedTestKey{tenant: "a", id: 1}
+	b := hashedTestKey{tenant: "b", id: 1}
+	require.True(t, c.Set(a, 1, 1))
+	require.True(t, c.Set(b, 2, 1))
+	c.Wait()
+
+	val, ok := c.Get(a)
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+	val, ok = c.Get(b)
+	require.True(t, ok)
+	require.Equal(t, 2, val)
+	require.Equal(t, int64(2), c.Cache().UsedCost())
+
+	c.Del(a)
+	_, ok = c.Get(a)
+	require.False(t, ok)
+
+	c.Clear()
+	_, ok = c.Get(b)
+	require.False(t, ok)
+}
+
+func TestNewCacheWithHasherCallbacks(t *testing.T) {
+	_, err := NewCacheWithHasher(&Config[uint64, int]{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		OnZeroHash:  func(key uint64) {},
+	}, hashedTestKeyToHash)
+	require.ErrorIs(t, err, ErrHasherOnZeroHash)
+
+	tracer := &testTracer[uint64]{}
+	var mu sync.Mutex
+	var removed []uint64
+	c, err := NewCacheWithHasher(&Config[uint64, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Tracer:             tracer,
+		OnRemove: func(key uint64, value int, reason RemoveReason) {
+			mu.Lock()
+			defer mu.Unlock()
+			removed = append(removed, key)
+		},
+	}, hashedTestKeyToHash)
+	require.NoError(t, err)
+	defer c.Close()
+
+	a := hashedTestKey{tenant: "a", id: 1}
+	keyHash, _ := hashedTestKeyToHash(a)
+	require.True(t, c.Set(a, 1, 1))
+	c.Wait()
+	_, ok := c.Get(a)
+	require.True(t, ok)
+	c.Del(a)
+
+	tracer.mu.Lock()
+	require.Equal(t, []string{fmt.Sprintf("%d:1", keyHash)}, tracer.sets)
+	require.Equal(t, []string{fmt.Sprintf("%d:true", keyHash)}, tracer.gets)
+	tracer.mu.Unlock()
+	mu.Lock()
+	require.Equal(t, []uint64{keyHash}, removed)
+	mu.Unlock()
+}
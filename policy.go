@@ -46,8 +46,14 @@ type defaultPolicy[V any] struct {
 }
 
 func newDefaultPolicy[V any](numCounters, maxCost int64) *defaultPolicy[V] {
+	return newDefaultPolicyWithBits[V](numCounters, maxCost, 4)
+}
+
+// newDefaultPolicyWithBits is newDefaultPolicy with sketch counters of
+// counterBits bits, 4 or 8.
+func newDefaultPolicyWithBits[V any](numCounters, maxCost int64, counterBits int) *defaultPolicy[V] {
 	p := &defaultPolicy[V]{
-		admit:   newTinyLFU(numCounters),
+		admit:   newTinyLFUWithBits(numCounters, counterBits),
 		evict:   newSampledLFU(maxCost),
 		itemsCh: make(chan []uint64, 3),
 		stop:    make(chan struct{}),
@@ -67,13 +73,22 @@ type policyPair struct {
 	cost int64
 }
 
+// SamplePair is an eviction candidate returned by Config.SampleFn. The policy
+// uses its own record of the cost of the key, so Cost may be left zero.
+type SamplePair struct {
+	Key  uint64
+	Cost int64
+}
+
 func (p *defaultPolicy[V]) processItems() {
 	for {
 		select {
 		case items := <-p.itemsCh:
 			p.Lock()
 			p.admit.Push(items)
+			p.evict.touch(items)
 			p.Unlock()
+			releaseRingBatch(items)
 		case <-p.stop:
 			p.done <- struct{}{}
 			return
@@ -81,6 +96,8 @@ func (p *defaultPolicy[V]) processItems() {
 	}
 }
 
+// Push hands keys to the admission policy, which takes ownership of the slice
+// and recycles it with releaseRingBatch, unless it returns false.
 func (p *defaultPolicy[V]) Push(keys []uint64) bool {
 	if p.isClosed {
 		return false
@@ -121,7 +138,7 @@ func (p *defaultPolicy[V]) Add(key uint64, cost int64) ([]*Item[V], bool) {
 	// If the execution reaches this point, the key doesn't exist in the cache.
 	// Calculate the remaining room in the cache (usually bytes).
 	room := p.evict.roomLeft(cost)
-	if room >= 0 {
+	if room >= 0 && !p.evict.keysFull() {
 		// There's enough room in the cache to store the new item without
 		// overflowing. Do that now and stop here.
 		p.evict.add(key, cost)
@@ -139,17 +156,35 @@ func (p *defaultPolicy[V]) Add(key uint64, cost int64) ([]*Item[V], bool) {
 	// As items are evicted they will be appended to victims.
 	victims := make([]*Item[V], 0)
 
-	// Delete victims until there's enough space or a minKey is found that has
-	// more hits than incoming item.
-	for ; room < 0; room = p.evict.roomLeft(cost) {
+	// Delete victims until there's enough space (and a free key slot, if
+	// maxKeys is set) or a minKey is found that has more hits than incoming item.
+	for ; room < 0 || p.evict.keysFull(); room = p.evict.roomLeft(cost) {
+		if limit := p.evict.maxEvictions; limit > 0 && len(victims) >= limit {
+			// Making room would take too many victims, keep them instead.
+			p.restore(victims)
+			p.metrics.add(rejectSets, key, 1)
+			return nil, false
+		}
+		if victim, ok := p.evict.soonestExpiring(len(victims) + lfuSample); ok {
+			// Items expiring soonest are evicted regardless of their frequency.
+			p.evict.del(victim.key)
+			victims = append(victims, &Item[V]{
+				Key:  victim.key,
+				Cost: victim.cost,
+			})
+			continue
+		}
+
 		// Fill up empty slots in sample.
 		sample = p.evict.fillSample(sample)
 
 		// Find minimally used item in sample.
 		minKey, minHits, minId, minCost := uint64(0), int64(math.MaxInt64), 0, int64(0)
 		for i, pair := range sample {
-			// Look up hit count for sample key.
-			if hits := p.admit.Estimate(pair.key); hits < minHits {
+			// Look up hit count for sample key. Ties go to the least recently
+			// accessed key, if recency is tracked.
+			hits := p.admit.Estimate(pair.key)
+			if hits < minHits || (hits == minHits && p.evict.lessRecent(pair.key, minKey)) {
 				minKey, minHits, minId, minCost = pair.key, hits, i, pair.cost
 			}
 		}
@@ -179,6 +214,46 @@ func (p *defaultPolicy[V]) Add(key uint64, cost int64) ([]*Item[V], bool) {
 	return victims, true
 }
 
+// Shrink evicts the least valuable keys until the used cost is within the max
+// cost, and returns them. Pinned keys are never evicted.
+func (p *defaultPolicy[V]) Shrink() []*Item[V] {
+	p.Lock()
+	defer p.Unlock()
+
+	var victims []*Item[V]
+	sample := make([]*policyPair, 0, lfuSample)
+	for p.evict.roomLeft(0) < 0 {
+		sample = p.evict.fillSample(sample[:0])
+		if len(sample) == 0 {
+			break
+		}
+		victim := sample[0]
+		minHits := p.admit.Estimate(victim.key)
+		for _, pair := range sample[1:] {
+			hits := p.admit.Estimate(pair.key)
+			if hits < minHits || (hits == minHits && p.evict.lessRecent(pair.key, victim.key)) {
+				victim, minHits = pair, hits
+			}
+		}
+		p.evict.del(victim.key)
+		victims = append(victims, &Item[V]{
+			Key:  victim.key,
+			Cost: victim.cost,
+		})
+	}
+	return victims
+}
+
+// restore tracks the victims of an Add again, undoing their eviction. The
+// policy must be locked.
+func (p *defaultPolicy[V]) restore(victims []*Item[V]) {
+	for _, victim := range victims {
+		p.evict.add(victim.Key, victim.Cost)
+		p.metrics.add(costEvict, victim.Key, ^(uint64(victim.Cost) - 1))
+		p.metrics.add(keyEvict, victim.Key, ^uint64(0))
+	}
+}
+
 func (p *defaultPolicy[V]) Has(key uint64) bool {
 	p.Lock()
 	_, exists := p.evict.keyCosts[key]
@@ -186,12 +261,43 @@ func (p *defaultPolicy[V]) Has(key uint64) bool {
 	return exists
 }
 
+// Pin prevents key from being picked as an eviction victim until it is
+// unpinned.
+func (p *defaultPolicy[V]) Pin(key uint64) {
+	p.Lock()
+	defer p.Unlock()
+	if p.evict.pinned == nil {
+		p.evict.pinned = make(map[uint64]struct{})
+	}
+	p.evict.pinned[key] = struct{}{}
+}
+
+// Unpin lets key be evicted again.
+func (p *defaultPolicy[V]) Unpin(key uint64) {
+	p.Lock()
+	delete(p.evict.pinned, key)
+	p.Unlock()
+}
+
 func (p *defaultPolicy[V]) Del(key uint64) {
 	p.Lock()
 	p.evict.del(key)
 	p.Unlock()
 }
 
+// MaxCostSeen returns the largest cost of a key admitted since the policy was
+// created or cleared.
+func (p *defaultPolicy[V]) MaxCostSeen() int64 {
+	return p.evict.maxCostSeen.Load()
+}
+
+// Used returns the total cost of the keys tracked by the policy.
+func (p *defaultPolicy[V]) Used() int64 {
+	p.Lock()
+	defer p.Unlock()
+	return p.evict.used
+}
+
 func (p *defaultPolicy[V]) Cap() int64 {
 	p.Lock()
 	capacity := p.evict.getMaxCost() - p.evict.used
@@ -215,6 +321,53 @@ func (p *defaultPolicy[V]) Cost(key uint64) int64 {
 	return -1
 }
 
+// Estimate returns the TinyLFU frequency estimate for the key.
+func (p *defaultPolicy[V]) Estimate(key uint64) int64 {
+	p.Lock()
+	defer p.Unlock()
+	return p.admit.Estimate(key)
+}
+
+// Increment records a single access of the key.
+func (p *defaultPolicy[V]) Increment(key uint64) {
+	p.Lock()
+	p.admit.Increment(key)
+	p.Unlock()
+}
+
+// Warm increments the frequency of each of keys[i] counts[i] times, as if they
+// had been accessed that many times.
+func (p *defaultPolicy[V]) Warm(keys []uint64, counts []int) {
+	p.Lock()
+	defer p.Unlock()
+	for i := 0; i < len(keys) && i < len(counts); i++ {
+		p.admit.IncrementBy(keys[i], counts[i])
+	}
+}
+
+// ResizeCounters replaces the TinyLFU admission structures with new ones sized
+// for numCounters. The frequency history is lost, but the counter width is kept.
+func (p *defaultPolicy[V]) ResizeCounters(numCounters int64) {
+	p.Lock()
+	defer p.Unlock()
+	counterBits := 4
+	if p.admit.freq.wide {
+		counterBits = 8
+	}
+	decaying := p.admit.decaying
+	p.admit = newTinyLFUWithBits(numCounters, counterBits)
+	p.admit.decaying = decaying
+}
+
+// Decay scales down all the admission frequencies by factor, which must be
+// within (0, 1). Once Decay is called, the frequencies are no longer halved
+// after every numCounters increments, see Config.DecayHalfLife.
+func (p *defaultPolicy[V]) Decay(factor float64) {
+	p.Lock()
+	defer p.Unlock()
+	p.admit.decay(factor)
+}
+
 func (p *defaultPolicy[V]) Clear() {
 	p.Lock()
 	p.admit.clear()
@@ -222,6 +375,14 @@ func (p *defaultPolicy[V]) Clear() {
 	p.Unlock()
 }
 
+// ClearCosts forgets every key and its cost, but keeps the admission frequency
+// history.
+func (p *defaultPolicy[V]) ClearCosts() {
+	p.Lock()
+	p.evict.clear()
+	p.Unlock()
+}
+
 func (p *defaultPolicy[V]) Close() {
 	if p.isClosed {
 		return
@@ -262,6 +423,30 @@ type sampledLFU struct {
 	used     int64
 	metrics  *Metrics
 	keyCosts map[uint64]int64
+	// maxKeys caps the number of keys tracked, independent of cost. Zero means
+	// no limit.
+	maxKeys int64
+	// sampleFn, if set, picks the eviction candidates instead of the random
+	// map iteration.
+	sampleFn func(keyCosts map[uint64]int64, n int) []SamplePair
+	// soonestFn, if set, returns up to n of the keys expiring first, which
+	// are then evicted first, see EvictSoonestExpiring.
+	soonestFn func(n int) []uint64
+	// maxEvictions caps the number of victims a single add may evict. Zero
+	// means no cap.
+	maxEvictions int
+	// pinned holds the keys which must not be evicted. It is nil until a key
+	// is pinned.
+	pinned map[uint64]struct{}
+	// maxCostSeen is the largest cost of a key ever tracked. It is only
+	// written with the policy lock held, but read atomically.
+	maxCostSeen atomic.Int64
+	// lastAccess holds the tick of the last access of each key, which breaks
+	// ties between eviction candidates. It is nil unless recency is tracked,
+	// see Config.TrackRecency.
+	lastAccess map[uint64]uint64
+	// tick is incremented on every access recorded in lastAccess.
+	tick uint64
 }
 
 func newSampledLFU(maxCost int64) *sampledLFU {
@@ -283,11 +468,22 @@ func (p *sampledLFU) roomLeft(cost int64) int64 {
 	return p.getMaxCost() - (p.used + cost)
 }
 
+// keysFull returns true if adding another key would exceed maxKeys.
+func (p *sampledLFU) keysFull() bool {
+	return p.maxKeys > 0 && int64(len(p.keyCosts)) >= p.maxKeys
+}
+
 func (p *sampledLFU) fillSample(in []*policyPair) []*policyPair {
 	if len(in) >= lfuSample {
 		return in
 	}
+	if p.sampleFn != nil {
+		return p.fillSampleWith(in)
+	}
 	for key, cost := range p.keyCosts {
+		if p.isPinned(key) {
+			continue
+		}
 		in = append(in, &policyPair{key, cost})
 		if len(in) >= lfuSample {
 			return in
@@ -296,6 +492,74 @@ func (p *sampledLFU) fillSample(in []*policyPair) []*policyPair {
 	return in
 }
 
+// fillSampleWith fills the sample with the candidates returned by sampleFn,
+// skipping unknown keys and keys already in the sample.
+func (p *sampledLFU) fillSampleWith(in []*policyPair) []*policyPair {
+outer:
+	for _, pair := range p.sampleFn(p.keyCosts, lfuSample-len(in)) {
+		cost, ok := p.keyCosts[pair.Key]
+		if !ok || p.isPinned(pair.Key) {
+			continue
+		}
+		for _, s := range in {
+			if s.key == pair.Key {
+				continue outer
+			}
+		}
+		in = append(in, &policyPair{pair.Key, cost})
+		if len(in) >= lfuSample {
+			break
+		}
+	}
+	return in
+}
+
+// soonestExpiring returns the tracked and unpinned key expiring first, among
+// the first n keys returned by soonestFn. Keys evicted but still in the store
+// are returned by soonestFn as well, which is why n must account for them.
+func (p *sampledLFU) soonestExpiring(n int) (policyPair, bool) {
+	if p.soonestFn == nil {
+		return policyPair{}, false
+	}
+	for _, key := range p.soonestFn(n) {
+		if cost, ok := p.keyCosts[key]; ok && !p.isPinned(key) {
+			return policyPair{key, cost}, true
+		}
+	}
+	return policyPair{}, false
+}
+
+// touch records an access to the keys which are tracked, if recency is
+// tracked.
+func (p *sampledLFU) touch(keys []uint64) {
+	if p.lastAccess == nil {
+		return
+	}
+	for _, key := range keys {
+		if _, ok := p.keyCosts[key]; ok {
+			p.touchKey(key)
+		}
+	}
+}
+
+func (p *sampledLFU) touchKey(key uint64) {
+	if p.lastAccess != nil {
+		p.tick++
+		p.lastAccess[key] = p.tick
+	}
+}
+
+// lessRecent returns true if a was last accessed before b. It is always false
+// unless recency is tracked.
+func (p *sampledLFU) lessRecent(a, b uint64) bool {
+	return p.lastAccess != nil && p.lastAccess[a] < p.lastAccess[b]
+}
+
+func (p *sampledLFU) isPinned(key uint64) bool {
+	_, ok := p.pinned[key]
+	return ok
+}
+
 func (p *sampledLFU) del(key uint64) {
 	cost, ok := p.keyCosts[key]
 	if !ok {
@@ -303,6 +567,7 @@ func (p *sampledLFU) del(key uint64) {
 	}
 	p.used -= cost
 	delete(p.keyCosts, key)
+	delete(p.lastAccess, key)
 	p.metrics.add(costEvict, key, uint64(cost))
 	p.metrics.add(keyEvict, key, 1)
 }
@@ -310,6 +575,14 @@ func (p *sampledLFU) del(key uint64) {
 func (p *sampledLFU) add(key uint64, cost int64) {
 	p.keyCosts[key] = cost
 	p.used += cost
+	p.trackMaxCost(cost)
+	p.touchKey(key)
+}
+
+func (p *sampledLFU) trackMaxCost(cost int64) {
+	if cost > p.maxCostSeen.Load() {
+		p.maxCostSeen.Store(cost)
+	}
 }
 
 func (p *sampledLFU) updateIfHas(key uint64, cost int64) bool {
@@ -326,6 +599,8 @@ func (p *sampledLFU) updateIfHas(key uint64, cost int64) bool {
 		}
 		p.used += cost - prev
 		p.keyCosts[key] = cost
+		p.trackMaxCost(cost)
+		p.touchKey(key)
 		return true
 	}
 	return false
@@ -334,6 +609,10 @@ func (p *sampledLFU) updateIfHas(key uint64, cost int64) bool {
 func (p *sampledLFU) clear() {
 	p.used = 0
 	p.keyCosts = make(map[uint64]int64)
+	p.maxCostSeen.Store(0)
+	if p.lastAccess != nil {
+		p.lastAccess = make(map[uint64]uint64)
+	}
 }
 
 // tinyLFU is an admission helper that keeps track of access frequency using
@@ -344,13 +623,25 @@ type tinyLFU struct {
 	door    *z.Bloom
 	incrs   int64
 	resetAt int64
+	// decaying is set once the frequencies are aged by decay instead of being
+	// halved every resetAt increments.
+	decaying bool
+	// doorAge is the factor by which the frequencies decayed since the
+	// doorkeeper was last cleared.
+	doorAge float64
 }
 
 func newTinyLFU(numCounters int64) *tinyLFU {
+	return newTinyLFUWithBits(numCounters, 4)
+}
+
+// newTinyLFUWithBits is newTinyLFU with sketch counters of counterBits bits.
+func newTinyLFUWithBits(numCounters int64, counterBits int) *tinyLFU {
 	return &tinyLFU{
-		freq:    newCmSketch(numCounters),
+		freq:    newCmSketchWithBits(numCounters, counterBits),
 		door:    z.NewBloomFilter(float64(numCounters), 0.01),
 		resetAt: numCounters,
+		doorAge: 1,
 	}
 }
 
@@ -375,11 +666,23 @@ func (p *tinyLFU) Increment(key uint64) {
 		p.freq.Increment(key)
 	}
 	p.incrs++
-	if p.incrs >= p.resetAt {
+	if p.incrs >= p.resetAt && !p.decaying {
 		p.reset()
 	}
 }
 
+// IncrementBy increments the key n times. Increments beyond what the counters
+// can hold are skipped, so that they don't needlessly trigger a reset.
+func (p *tinyLFU) IncrementBy(key uint64, n int) {
+	// The doorkeeper accounts for one hit, and the sketch for the rest.
+	if limit := int(p.freq.MaxCount()) + 1; n > limit {
+		n = limit
+	}
+	for i := 0; i < n; i++ {
+		p.Increment(key)
+	}
+}
+
 func (p *tinyLFU) reset() {
 	// Zero out incrs.
 	p.incrs = 0
@@ -389,8 +692,60 @@ func (p *tinyLFU) reset() {
 	p.freq.Reset()
 }
 
+// decay scales down the sketch counters by factor. The doorkeeper can't be
+// scaled, so it is cleared every time the counters are halved overall, which
+// is what reset does as well.
+func (p *tinyLFU) decay(factor float64) {
+	p.decaying = true
+	p.freq.Decay(factor)
+	p.doorAge *= factor
+	if p.doorAge <= 0.5 {
+		p.door.Clear()
+		p.doorAge = 1
+	}
+}
+
 func (p *tinyLFU) clear() {
 	p.incrs = 0
 	p.door.Clear()
 	p.freq.Clear()
 }
+
+// FrequencyEstimator is an approximate frequency counter, built from the same
+// count-min sketch and doorkeeper bloom filter that the cache uses for
+// admission. Every numCounters additions, all counts are halved so that old
+// accesses fade away. Estimates saturate at 16.
+//
+// FrequencyEstimator is not safe for concurrent use.
+type FrequencyEstimator struct {
+	lfu *tinyLFU
+}
+
+// NewFrequencyEstimator returns a FrequencyEstimator sized to track about
+// numCounters keys. See Config.NumCounters for how to choose it.
+func NewFrequencyEstimator(numCounters int64) (*FrequencyEstimator, error) {
+	switch {
+	case numCounters == 0:
+		return nil, ErrZeroNumCounters
+	case numCounters < 0:
+		return nil, ErrNegativeNumCounters
+	case numCounters > maxNumCounters:
+		return nil, ErrTooManyNumCounters
+	}
+	return &FrequencyEstimator{lfu: newTinyLFU(numCounters)}, nil
+}
+
+// Add records an access of key.
+func (e *FrequencyEstimator) Add(key uint64) {
+	e.lfu.Increment(key)
+}
+
+// Estimate returns the approximate number of accesses of key.
+func (e *FrequencyEstimator) Estimate(key uint64) int64 {
+	return e.lfu.Estimate(key)
+}
+
+// Reset forgets all accesses.
+func (e *FrequencyEstimator) Reset() {
+	e.lfu.clear()
+}
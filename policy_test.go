@@ -1,6 +1,7 @@
 package ristretto
 
 import (
+	"sort"
 	"testing"
 	"time"
 
@@ -81,6 +82,70 @@ func TestPolicyAdd(t *testing.T) {
 	require.False(t, added)
 }
 
+func TestPolicyAddMaxKeys(t *testing.T) {
+	p := newDefaultPolicy[int](1000, 100)
+	p.evict.maxKeys = 3
+	for i := uint64(1); i <= 3; i++ {
+		victims, added := p.Add(i, 1)
+		require.True(t, added)
+		require.Empty(t, victims)
+	}
+	// Make the incoming key hotter than the existing ones so it gets admitted.
+	p.admit.Increment(4)
+	p.admit.Increment(4)
+	victims, added := p.Add(4, 1)
+	require.True(t, added)
+	require.Len(t, victims, 1)
+	require.Len(t, p.evict.keyCosts, 3)
+	require.Equal(t, int64(3), p.evict.used)
+}
+
+func TestPolicyAddMaxEvictions(t *testing.T) {
+	p := newDefaultPolicy[int](1000, 10)
+	p.evict.maxEvictions = 2
+	for i := uint64(1); i <= 10; i++ {
+		_, added := p.Add(i, 1)
+		require.True(t, added)
+	}
+	for i := 0; i < 5; i++ {
+		p.admit.Increment(100)
+	}
+	// Making room would take 5 victims.
+	victims, added := p.Add(100, 5)
+	require.False(t, added)
+	require.Empty(t, victims)
+	require.Len(t, p.evict.keyCosts, 10)
+	require.Equal(t, int64(10), p.evict.used)
+
+	victims, added = p.Add(100, 2)
+	require.True(t, added)
+	require.Len(t, victims, 2)
+	require.Equal(t, int64(10), p.evict.used)
+}
+
+func TestPolicyAddTrackRecency(t *testing.T) {
+	p := newDefaultPolicy[int](1000, 4)
+	p.evict.lastAccess = make(map[uint64]uint64)
+	for i := uint64(1); i <= 4; i++ {
+		_, added := p.Add(i, 1)
+		require.True(t, added)
+	}
+	// All the keys have the same frequency, 3 was accessed least recently.
+	p.evict.touch([]uint64{2, 1, 4})
+	p.Update(2, 1)
+
+	victims, added := p.Add(5, 1)
+	require.True(t, added)
+	require.Len(t, victims, 1)
+	require.Equal(t, uint64(3), victims[0].Key)
+	require.NotContains(t, p.evict.lastAccess, uint64(3))
+
+	victims, added = p.Add(6, 1)
+	require.True(t, added)
+	require.Len(t, victims, 1)
+	require.Equal(t, uint64(1), victims[0].Key)
+}
+
 func TestPolicyHas(t *testing.T) {
 	p := newDefaultPolicy[int](100, 10)
 	p.Add(1, 1)
@@ -119,6 +184,29 @@ func TestPolicyCost(t *testing.T) {
 	require.Equal(t, int64(-1), p.Cost(2))
 }
 
+func TestPolicyEstimate(t *testing.T) {
+	p := newDefaultPolicy[int](100, 10)
+	p.itemsCh <- []uint64{1, 2, 2}
+	time.Sleep(wait)
+	require.Equal(t, int64(2), p.Estimate(2))
+	require.Equal(t, int64(1), p.Estimate(1))
+	require.Equal(t, int64(0), p.Estimate(3))
+}
+
+func TestPolicyResizeCounters(t *testing.T) {
+	p := newDefaultPolicy[int](100, 10)
+	p.itemsCh <- []uint64{1, 1, 1}
+	time.Sleep(wait)
+	require.Equal(t, int64(3), p.Estimate(1))
+
+	p.ResizeCounters(1000)
+	require.Equal(t, int64(0), p.Estimate(1))
+	p.Lock()
+	require.Equal(t, int64(1000), p.admit.resetAt)
+	require.Equal(t, uint64(1023), p.admit.freq.mask)
+	p.Unlock()
+}
+
 func TestPolicyClear(t *testing.T) {
 	p := newDefaultPolicy[int](100, 10)
 	p.Add(1, 1)
@@ -220,6 +308,34 @@ func TestSampledLFUSample(t *testing.T) {
 	require.Equal(t, 4, len(sample))
 }
 
+func TestSampledLFUSampleFn(t *testing.T) {
+	p := newDefaultPolicy[int](100, 3)
+	defer p.Close()
+	// Always offer the smallest keys first, plus a key that isn't tracked.
+	p.evict.sampleFn = func(keyCosts map[uint64]int64, n int) []SamplePair {
+		keys := make([]uint64, 0, len(keyCosts))
+		for k := range keyCosts {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+		out := []SamplePair{{Key: 100}}
+		for _, k := range keys {
+			out = append(out, SamplePair{Key: k})
+		}
+		return out
+	}
+	for k := uint64(1); k <= 3; k++ {
+		_, added := p.Add(k, 1)
+		require.True(t, added)
+	}
+	for k := uint64(4); k <= 6; k++ {
+		victims, added := p.Add(k, 1)
+		require.True(t, added)
+		require.Len(t, victims, 1)
+		require.Equal(t, k-3, victims[0].Key)
+	}
+}
+
 func TestTinyLFUIncrement(t *testing.T) {
 	a := newTinyLFU(4)
 	a.Increment(1)
@@ -251,6 +367,21 @@ func TestTinyLFUPush(t *testing.T) {
 	require.Equal(t, int64(6), a.incrs)
 }
 
+func TestTinyLFUDecay(t *testing.T) {
+	a := newTinyLFUWithBits(16, 8)
+	a.Push([]uint64{1, 1, 1, 1, 1})
+	a.decay(0.5)
+	require.True(t, a.decaying)
+	require.Equal(t, int64(2), a.freq.Estimate(1))
+	require.False(t, a.door.Has(1), "the doorkeeper should be cleared after a half-life")
+
+	// Once decaying, the count triggered reset is disabled.
+	for i := 0; i < 20; i++ {
+		a.Increment(1)
+	}
+	require.Equal(t, int64(21), a.freq.Estimate(1))
+}
+
 func TestTinyLFUClear(t *testing.T) {
 	a := newTinyLFU(16)
 	a.Push([]uint64{1, 3, 3, 3})
@@ -258,3 +389,21 @@ func TestTinyLFUClear(t *testing.T) {
 	require.Equal(t, int64(0), a.incrs)
 	require.Equal(t, int64(0), a.Estimate(3))
 }
+
+func TestFrequencyEstimator(t *testing.T) {
+	_, err := NewFrequencyEstimator(0)
+	require.ErrorIs(t, err, ErrZeroNumCounters)
+
+	e, err := NewFrequencyEstimator(100)
+	require.NoError(t, err)
+	e.Add(1)
+	e.Add(1)
+	e.Add(1)
+	e.Add(2)
+	require.Equal(t, int64(3), e.Estimate(1))
+	require.Equal(t, int64(1), e.Estimate(2))
+	require.Equal(t, int64(0), e.Estimate(3))
+
+	e.Reset()
+	require.Equal(t, int64(0), e.Estimate(1))
+}
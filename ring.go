@@ -26,6 +26,34 @@ type ringConsumer interface {
 	Push([]uint64) bool
 }
 
+// ringFree holds the batches drained from the stripes which the consumers are
+// done with, so that draining a stripe doesn't allocate in the steady state. A
+// channel is used rather than a sync.Pool, as putting a slice into a Pool
+// allocates.
+var ringFree = make(chan []uint64, 64)
+
+// newRingBatch returns an empty batch that can hold capa items, reusing a
+// released one if possible.
+func newRingBatch(capa int) []uint64 {
+	select {
+	case b := <-ringFree:
+		if cap(b) >= capa {
+			return b[:0]
+		}
+	default:
+	}
+	return make([]uint64, 0, capa)
+}
+
+// releaseRingBatch hands a batch passed to ringConsumer.Push back for reuse.
+// The consumer must not use the batch afterwards.
+func releaseRingBatch(b []uint64) {
+	select {
+	case ringFree <- b:
+	default:
+	}
+}
+
 // ringStripe is a singular ring buffer that is not concurrent safe.
 type ringStripe struct {
 	cons ringConsumer
@@ -49,7 +77,7 @@ func (s *ringStripe) Push(item uint64) {
 	if len(s.data) >= s.capa {
 		// Send elements to consumer and create a new ring stripe.
 		if s.cons.Push(s.data) {
-			s.data = make([]uint64, 0, s.capa)
+			s.data = newRingBatch(s.capa)
 		} else {
 			s.data = s.data[:0]
 		}
@@ -63,6 +91,17 @@ func (s *ringStripe) Push(item uint64) {
 // (section III part A).
 type ringBuffer struct {
 	pool *sync.Pool
+	// stripes is only set for buffers created by newStripedRingBuffer, in which
+	// case pool is nil.
+	stripes []lockedRingStripe
+}
+
+// lockedRingStripe guards a stripe of a striped ring buffer.
+type lockedRingStripe struct {
+	sync.Mutex
+	*ringStripe
+	// Pad to a cache line so that neighbouring stripes don't false share.
+	_ [64 - 16]byte
 }
 
 // newRingBuffer returns a striped ring buffer. The Consumer in ringConfig will
@@ -81,9 +120,28 @@ func newRingBuffer(cons ringConsumer, capa int64) *ringBuffer {
 	}
 }
 
+// newStripedRingBuffer returns a ring buffer with a fixed number of stripes,
+// each guarded by a mutex. Items are spread between the stripes by their value,
+// which is expected to be a hash. Unlike the sync.Pool based buffer, stripes are
+// never lost to GC.
+func newStripedRingBuffer(cons ringConsumer, capa int64, numStripes int) *ringBuffer {
+	b := &ringBuffer{stripes: make([]lockedRingStripe, numStripes)}
+	for i := range b.stripes {
+		b.stripes[i].ringStripe = newRingStripe(cons, capa)
+	}
+	return b
+}
+
 // Push adds an element to one of the internal stripes and possibly drains if
 // the stripe becomes full.
 func (b *ringBuffer) Push(item uint64) {
+	if b.stripes != nil {
+		stripe := &b.stripes[item%uint64(len(b.stripes))]
+		stripe.Lock()
+		stripe.Push(item)
+		stripe.Unlock()
+		return
+	}
 	// Reuse or create a new stripe.
 	stripe := b.pool.Get().(*ringStripe)
 	stripe.Push(item)
@@ -68,3 +68,54 @@ func TestRingConsumer(t *testing.T) {
 	require.NotEqual(t, 0, l)
 	require.True(t, l <= 100)
 }
+
+func TestRingStriped(t *testing.T) {
+	mu := &sync.Mutex{}
+	drainItems := make(map[uint64]struct{})
+	r := newStripedRingBuffer(&testConsumer{
+		push: func(items []uint64) {
+			mu.Lock()
+			defer mu.Unlock()
+			for i := range items {
+				drainItems[items[i]] = struct{}{}
+			}
+		},
+		save: true,
+	}, 4, 8)
+	require.Len(t, r.stripes, 8)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 32; i++ {
+				r.Push(uint64(g*32 + i))
+			}
+		}(g)
+	}
+	wg.Wait()
+	// Each stripe saw a multiple of its capacity, so nothing is left behind.
+	require.Len(t, drainItems, 128)
+}
+
+func TestRingBatchReuse(t *testing.T) {
+	// Drain ringFree, which other tests may have filled.
+	for len(ringFree) > 0 {
+		<-ringFree
+	}
+	s := newRingStripe(&testConsumer{
+		push: releaseRingBatch,
+		save: true,
+	}, 16)
+	allocs := testing.AllocsPerRun(100, func() {
+		for i := 0; i < 16; i++ {
+			s.Push(uint64(i))
+		}
+	})
+	require.Zero(t, allocs, "drained batches should be reused")
+
+	require.Len(t, newRingBatch(4), 0)
+	releaseRingBatch(make([]uint64, 0, 4))
+	require.Equal(t, 32, cap(newRingBatch(32)), "too small batches shouldn't be reused")
+}
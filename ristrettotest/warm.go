@@ -0,0 +1,44 @@
+/*
+ * Copyright 2024 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package ristrettotest provides helpers for load testing code that uses a
+// ristretto Cache.
+package ristrettotest
+
+import (
+	"strconv"
+
+	"github.com/dgraph-io/ristretto/v2"
+	"github.com/dgraph-io/ristretto/v2/sim"
+)
+
+// WarmZipfian sets n keys drawn from a Zipfian distribution over [0, n] into
+// the cache, using newValue to build the value of each key and a cost of 1.
+// Keys are the decimal representation of the generated numbers, so popular
+// keys are set many times, like they would be in a real workload. It waits for
+// the Sets to be applied before returning.
+func WarmZipfian[V any](c *ristretto.Cache[string, V], n int, newValue func(key string) V) {
+	if n <= 0 {
+		return
+	}
+	keys := sim.NewZipfian(1.0001, 1, uint64(n))
+	for i := 0; i < n; i++ {
+		k, _ := keys()
+		key := strconv.FormatUint(k, 10)
+		c.Set(key, newValue(key), 1)
+	}
+	c.Wait()
+}
@@ -0,0 +1,29 @@
+package ristrettotest
+
+import (
+	"testing"
+
+	"github.com/dgraph-io/ristretto/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWarmZipfian(t *testing.T) {
+	c, err := ristretto.NewCache(&ristretto.Config[string, []byte]{
+		NumCounters:        1000,
+		MaxCost:            100,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	WarmZipfian(c, 1000, func(key string) []byte { return []byte(key) })
+	require.NotZero(t, c.Metrics.KeysAdded())
+	require.LessOrEqual(t, c.Metrics.CostAdded()-c.Metrics.CostEvicted(), uint64(100))
+
+	// The most popular key is by far the most likely one to be in the cache.
+	val, ok := c.Get("0")
+	require.True(t, ok)
+	require.Equal(t, []byte("0"), val)
+}
@@ -20,36 +20,61 @@ import (
 	"fmt"
 	"math/rand"
 	"time"
+
+	"github.com/dgraph-io/ristretto/v2/z"
 )
 
 // cmSketch is a Count-Min sketch implementation with 4-bit counters, heavily
-// based on Damian Gryski's CM4 [1].
+// based on Damian Gryski's CM4 [1]. It can optionally use 8-bit counters for
+// more dynamic range, at twice the memory.
 //
 // [1]: https://github.com/dgryski/go-tinylfu/blob/master/cm4.go
 type cmSketch struct {
 	rows [cmDepth]cmRow
 	seed [cmDepth]uint64
 	mask uint64
+	// wide is true when each counter takes a full byte instead of a nibble.
+	wide bool
 }
 
 const (
 	// cmDepth is the number of counter copies to store (think of it as rows).
 	cmDepth = 4
+	// maxCount is the maximum value a 4-bit counter can hold.
+	maxCount = 15
+	// maxCountWide is the maximum value an 8-bit counter can hold.
+	maxCountWide = 255
+	// maxNumCounters is the largest number of counters a sketch can have, as
+	// rounding anything above it up to a power of 2 overflows an int64.
+	maxNumCounters = 1 << 62
 )
 
 func newCmSketch(numCounters int64) *cmSketch {
-	if numCounters == 0 {
+	return newCmSketchWithBits(numCounters, 4)
+}
+
+// newCmSketchWithBits returns a sketch with numCounters counters per row, each
+// of them counterBits wide. counterBits must be 4 or 8.
+func newCmSketchWithBits(numCounters int64, counterBits int) *cmSketch {
+	if numCounters == 0 || numCounters > maxNumCounters {
 		panic("cmSketch: bad numCounters")
 	}
+	if counterBits != 4 && counterBits != 8 {
+		panic("cmSketch: bad counterBits")
+	}
 	// Get the next power of 2 for better cache performance.
 	numCounters = next2Power(numCounters)
-	sketch := &cmSketch{mask: uint64(numCounters - 1)}
+	sketch := &cmSketch{mask: uint64(numCounters - 1), wide: counterBits == 8}
 	// Initialize rows of counters and seeds.
 	// Cryptographic precision not needed
 	source := rand.New(rand.NewSource(time.Now().UnixNano())) //nolint:gosec
 	for i := 0; i < cmDepth; i++ {
 		sketch.seed[i] = source.Uint64()
-		sketch.rows[i] = newCmRow(numCounters)
+		if sketch.wide {
+			sketch.rows[i] = make(cmRow, numCounters)
+		} else {
+			sketch.rows[i] = newCmRow(numCounters)
+		}
 	}
 	return sketch
 }
@@ -57,7 +82,11 @@ func newCmSketch(numCounters int64) *cmSketch {
 // Increment increments the count(ers) for the specified key.
 func (s *cmSketch) Increment(hashed uint64) {
 	for i := range s.rows {
-		s.rows[i].increment((hashed ^ s.seed[i]) & s.mask)
+		if s.wide {
+			s.rows[i].incrementWide((hashed ^ s.seed[i]) & s.mask)
+		} else {
+			s.rows[i].increment((hashed ^ s.seed[i]) & s.mask)
+		}
 	}
 }
 
@@ -65,7 +94,12 @@ func (s *cmSketch) Increment(hashed uint64) {
 func (s *cmSketch) Estimate(hashed uint64) int64 {
 	min := byte(255)
 	for i := range s.rows {
-		val := s.rows[i].get((hashed ^ s.seed[i]) & s.mask)
+		var val byte
+		if s.wide {
+			val = s.rows[i][(hashed^s.seed[i])&s.mask]
+		} else {
+			val = s.rows[i].get((hashed ^ s.seed[i]) & s.mask)
+		}
 		if val < min {
 			min = val
 		}
@@ -73,10 +107,36 @@ func (s *cmSketch) Estimate(hashed uint64) int64 {
 	return int64(min)
 }
 
+// MaxCount returns the maximum value a counter can hold.
+func (s *cmSketch) MaxCount() int64 {
+	if s.wide {
+		return maxCountWide
+	}
+	return maxCount
+}
+
 // Reset halves all counter values.
 func (s *cmSketch) Reset() {
 	for _, r := range s.rows {
-		r.reset()
+		if s.wide {
+			r.resetWide()
+		} else {
+			r.reset()
+		}
+	}
+}
+
+// Decay multiplies all counter values by factor, which must be within (0, 1).
+// Counters are rounded up or down at random, in proportion to the fractional
+// part, so that small counts decay on average by factor too instead of being
+// zeroed at once.
+func (s *cmSketch) Decay(factor float64) {
+	for _, r := range s.rows {
+		if s.wide {
+			r.decayWide(factor)
+		} else {
+			r.decay(factor)
+		}
 	}
 }
 
@@ -106,11 +166,19 @@ func (r cmRow) increment(n uint64) {
 	// Counter value.
 	v := (r[i] >> s) & 0x0f
 	// Only increment if not max value (overflow wrap is bad for LFU).
-	if v < 15 {
+	if v < maxCount {
 		r[i] += 1 << s
 	}
 }
 
+// incrementWide increments the n-th counter of a row holding one counter per
+// byte.
+func (r cmRow) incrementWide(n uint64) {
+	if r[n] < maxCountWide {
+		r[n]++
+	}
+}
+
 func (r cmRow) reset() {
 	// Halve each counter.
 	for i := range r {
@@ -118,6 +186,46 @@ func (r cmRow) reset() {
 	}
 }
 
+func (r cmRow) resetWide() {
+	// Halve each counter.
+	for i := range r {
+		r[i] >>= 1
+	}
+}
+
+func (r cmRow) decay(factor float64) {
+	for i, b := range r {
+		if b == 0 {
+			continue
+		}
+		lo := decayCounter(b&0x0f, factor)
+		hi := decayCounter(b>>4, factor)
+		r[i] = hi<<4 | lo
+	}
+}
+
+func (r cmRow) decayWide(factor float64) {
+	for i, b := range r {
+		if b != 0 {
+			r[i] = decayCounter(b, factor)
+		}
+	}
+}
+
+// decayCounter returns v*factor, randomly rounded to one of the two nearest
+// integers so that the expected value is exact.
+func decayCounter(v byte, factor float64) byte {
+	if v == 0 {
+		return 0
+	}
+	scaled := float64(v) * factor
+	n := byte(scaled)
+	if float64(z.FastRand())/(1<<32) < scaled-float64(n) {
+		n++
+	}
+	return n
+}
+
 func (r cmRow) clear() {
 	// Zero each counter.
 	for i := range r {
@@ -134,7 +242,8 @@ func (r cmRow) string() string {
 	return s
 }
 
-// next2Power rounds x up to the next power of 2, if it's not already one.
+// next2Power rounds x up to the next power of 2, if it's not already one. x must
+// not be greater than maxNumCounters, otherwise the result overflows.
 func next2Power(x int64) int64 {
 	x--
 	x |= x >> 1
@@ -47,6 +47,32 @@ func TestSketchReset(t *testing.T) {
 	require.Equal(t, int64(2), s.Estimate(1))
 }
 
+func TestSketchDecay(t *testing.T) {
+	s := newCmSketchWithBits(16, 8)
+	for i := 0; i < 200; i++ {
+		s.Increment(1)
+	}
+	s.Increment(2)
+	s.Decay(0.5)
+	require.Equal(t, int64(100), s.Estimate(1))
+	require.LessOrEqual(t, s.Estimate(2), int64(1))
+
+	narrow := newCmSketch(16)
+	for i := 0; i < 12; i++ {
+		narrow.Increment(1)
+	}
+	narrow.Decay(0.25)
+	require.Equal(t, int64(3), narrow.Estimate(1))
+
+	// Small counts decay by the factor on average rather than all at once.
+	var sum int
+	for i := 0; i < 1000; i++ {
+		require.LessOrEqual(t, decayCounter(1, 0.5), byte(1))
+		sum += int(decayCounter(1, 0.5))
+	}
+	require.InDelta(t, 500, sum, 100)
+}
+
 func TestSketchClear(t *testing.T) {
 	s := newCmSketch(16)
 	for i := 0; i < 16; i++ {
@@ -58,7 +84,34 @@ func TestSketchClear(t *testing.T) {
 	}
 }
 
+func TestSketchCounterBits(t *testing.T) {
+	narrow := newCmSketch(16)
+	wide := newCmSketchWithBits(16, 8)
+	for i := 0; i < 100; i++ {
+		narrow.Increment(1)
+		wide.Increment(1)
+	}
+	require.Equal(t, int64(maxCount), narrow.Estimate(1))
+	require.Equal(t, int64(100), wide.Estimate(1))
+	require.Equal(t, int64(maxCountWide), wide.MaxCount())
+
+	for i := 0; i < 300; i++ {
+		wide.Increment(2)
+	}
+	require.Equal(t, int64(maxCountWide), wide.Estimate(2))
+
+	wide.Reset()
+	require.Equal(t, int64(50), wide.Estimate(1))
+	require.Equal(t, int64(127), wide.Estimate(2))
+
+	require.Panics(t, func() { newCmSketchWithBits(16, 5) })
+	require.Panics(t, func() { newCmSketch(maxNumCounters + 1) })
+}
+
 func TestNext2Power(t *testing.T) {
+	require.Equal(t, int64(maxNumCounters), next2Power(maxNumCounters))
+	require.Equal(t, int64(maxNumCounters), next2Power(maxNumCounters-1))
+
 	sz := 12 << 30
 	szf := float64(sz) * 0.01
 	val := int64(szf)
@@ -0,0 +1,243 @@
+/*
+ * Copyright 2024 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ErrKeysNotStored is returned by Range, ForEachExpiring, Snapshot and
+// SaveToFile when the cache doesn't keep the original keys, see
+// Config.StoreKeys.
+var ErrKeysNotStored = errors.New("Config.StoreKeys must be set to iterate over the cache")
+
+// snapshotVersion is the version of the snapshot format written by SaveToFile.
+const snapshotVersion = 1
+
+type snapshotHeader struct {
+	Version int
+}
+
+// SnapshotEntry is a single item of a snapshot, as returned by Snapshot and
+// saved by SaveToFile. Cost doesn't include the internal cost of the item.
+// Expiration is zero for items without a TTL.
+type SnapshotEntry[K Key, V any] struct {
+	Key        K
+	Value      V
+	Cost       int64
+	Expiration time.Time
+}
+
+// snapshot calls fn for every item admitted by the policy, until fn returns
+// false. The entry passed to fn is only valid for the duration of the call.
+// The caller checks Config.StoreKeys.
+func (c *Cache[K, V]) snapshot(fn func(entry *SnapshotEntry[K, V]) bool) {
+	var entry SnapshotEntry[K, V]
+	c.storedItems.Iter(func(key any, value V) bool {
+		keyHash, _ := c.keyToHash(key.(K))
+		entry = SnapshotEntry[K, V]{
+			Key:        key.(K),
+			Value:      value,
+			Cost:       c.cachePolicy.Cost(keyHash),
+			Expiration: c.storedItems.Expiration(keyHash),
+		}
+		if entry.Cost < 0 {
+			// Not admitted by the policy yet.
+			return true
+		}
+		if !c.ignoreInternalCost {
+			entry.Cost -= itemSize
+		}
+		return fn(&entry)
+	})
+}
+
+// Snapshot returns the items of the cache, with their cost and expiration, so
+// that they can be handed to NewCacheFromEntries, e.g. to move the contents of
+// a cache to a new instance within the same process. Keys and values are not
+// copied. It requires Config.StoreKeys, and doesn't include Sets still buffered.
+func (c *Cache[K, V]) Snapshot() ([]SnapshotEntry[K, V], error) {
+	if c == nil || c.isClosed.Load() {
+		return nil, nil
+	}
+	if !c.storeKeys {
+		return nil, ErrKeysNotStored
+	}
+	var entries []SnapshotEntry[K, V]
+	c.snapshot(func(entry *SnapshotEntry[K, V]) bool {
+		entries = append(entries, *entry)
+		return true
+	})
+	return entries, nil
+}
+
+// NewCacheFromEntries returns a new cache created with config, and filled with
+// entries, e.g. as returned by Snapshot. Unlike with Sets, the entries are
+// stored directly, without going through the Set buffer, so they are all
+// visible once it returns. They are still admitted by the policy, so the ones
+// that don't fit within MaxCost are dropped. Entries that already expired are
+// skipped. If Cost is zero, it is computed by Config.Cost if set.
+func NewCacheFromEntries[K Key, V any](config *Config[K, V],
+	entries []SnapshotEntry[K, V]) (*Cache[K, V], error) {
+	c, err := NewCache(config)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	admitted := make(map[uint64]*Item[V], len(entries))
+	for _, entry := range entries {
+		if !entry.Expiration.IsZero() && !entry.Expiration.After(now) {
+			continue
+		}
+		keyHash, conflictHash := c.keyToHash(entry.Key)
+		i := &Item[V]{
+			flag:       itemNew,
+			Key:        keyHash,
+			Conflict:   conflictHash,
+			Value:      entry.Value,
+			Cost:       entry.Cost,
+			Expiration: entry.Expiration,
+		}
+		if i.Cost == 0 && c.cost != nil {
+			i.Cost = c.cost(i.Value)
+		}
+		if !c.ignoreInternalCost {
+			i.Cost += itemSize
+		}
+		if c.storeKeys {
+			i.origKey = entry.Key
+		}
+		victims, added := c.cachePolicy.Add(keyHash, i.Cost)
+		for _, victim := range victims {
+			delete(admitted, victim.Key)
+		}
+		// If two keys share the same hash, the policy only admits the first.
+		if added {
+			admitted[keyHash] = i
+		}
+	}
+	// Nobody else has access to the cache yet, so the store can be filled
+	// without stopping processItems.
+	for _, i := range admitted {
+		c.storedItems.Set(i)
+		c.Metrics.add(keyAdd, i.Key, 1)
+	}
+	return c, nil
+}
+
+// SaveToFile writes the items of the cache to path, using encoding/gob, so that
+// they can be restored with LoadFromFile, e.g. after a restart. Keys and values
+// must be encodable by gob. The file is written to a temporary file which is
+// synced and then renamed to path, so path is never left partially written.
+// Expired items are skipped. It requires Config.StoreKeys, and doesn't include
+// Sets still buffered.
+func (c *Cache[K, V]) SaveToFile(path string) (rerr error) {
+	if c == nil || c.isClosed.Load() {
+		return nil
+	}
+	if !c.storeKeys {
+		return ErrKeysNotStored
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if rerr != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	w := bufio.NewWriter(f)
+	enc := gob.NewEncoder(w)
+	if err := enc.Encode(snapshotHeader{Version: snapshotVersion}); err != nil {
+		return err
+	}
+	c.snapshot(func(entry *SnapshotEntry[K, V]) bool {
+		err = enc.Encode(entry)
+		return err == nil
+	})
+	if err != nil {
+		return fmt.Errorf("while encoding the cache: %w", err)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// LoadFromFile sets the items saved to path by SaveToFile, with the cost and the
+// remaining TTL they had. Items that expired since are skipped. Like with Set,
+// items can be rejected by the policy, e.g. if the cache is smaller than the one
+// that was saved. It waits for the items to be applied before returning.
+func (c *Cache[K, V]) LoadFromFile(path string) error {
+	if c == nil || c.isClosed.Load() {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := gob.NewDecoder(bufio.NewReader(f))
+	var header snapshotHeader
+	if err := dec.Decode(&header); err != nil {
+		return fmt.Errorf("while decoding the snapshot header: %w", err)
+	}
+	if header.Version != snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version: %d", header.Version)
+	}
+
+	defer c.Wait()
+	for {
+		var entry SnapshotEntry[K, V]
+		switch err := dec.Decode(&entry); {
+		case err == io.EOF:
+			return nil
+		case err != nil:
+			return fmt.Errorf("while decoding the snapshot: %w", err)
+		}
+		var ttl time.Duration
+		if !entry.Expiration.IsZero() {
+			if ttl = time.Until(entry.Expiration); ttl <= 0 {
+				continue
+			}
+		}
+		if !c.SetWithTTL(entry.Key, entry.Value, entry.Cost, ttl) {
+			// The Set buffer may be full, let it drain and try again.
+			c.Wait()
+			c.SetWithTTL(entry.Key, entry.Value, entry.Cost, ttl)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package ristretto
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newSnapshotTestCache(t *testing.T) *Cache[string, int] {
+	c, err := NewCache(&Config[string, int]{
+		NumCounters: 100,
+		MaxCost:     1 << 20,
+		BufferItems: 64,
+		StoreKeys:   true,
+	})
+	require.NoError(t, err)
+	return c
+}
+
+func TestCacheSaveLoadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.snap")
+
+	c := newSnapshotTestCache(t)
+	defer c.Close()
+	require.True(t, c.Set("a", 1, 10))
+	require.True(t, c.SetWithTTL("b", 2, 20, time.Hour))
+	require.True(t, c.SetWithTTL("c", 3, 30, 50*time.Millisecond))
+	c.Wait()
+	require.NoError(t, c.SaveToFile(path))
+	matches, err := filepath.Glob(path + "*")
+	require.NoError(t, err)
+	require.Equal(t, []string{path}, matches, "the temporary file should be gone")
+
+	time.Sleep(100 * time.Millisecond)
+	c2 := newSnapshotTestCache(t)
+	defer c2.Close()
+	require.NoError(t, c2.LoadFromFile(path))
+
+	val, ok := c2.Get("a")
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+	keyHash, _ := c2.HashOf("a")
+	require.Equal(t, 10+itemSize, c2.cachePolicy.Cost(keyHash))
+
+	val, ok = c2.Get("b")
+	require.True(t, ok)
+	require.Equal(t, 2, val)
+	ttl, ok := c2.GetTTL("b")
+	require.True(t, ok)
+	require.True(t, ttl > 59*time.Minute && ttl <= time.Hour)
+
+	_, ok = c2.Get("c")
+	require.False(t, ok, "expired items shouldn't be loaded")
+}
+
+func TestCacheSaveToFileWithoutKeys(t *testing.T) {
+	c, err := NewCache(&Config[string, int]{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	require.ErrorIs(t, c.SaveToFile(filepath.Join(t.TempDir(), "cache.snap")), ErrKeysNotStored)
+}
+
+func TestNewCacheFromEntries(t *testing.T) {
+	c := newSnapshotTestCache(t)
+	defer c.Close()
+	require.True(t, c.Set("a", 1, 10))
+	require.True(t, c.SetWithTTL("b", 2, 20, time.Hour))
+	c.Wait()
+	entries, err := c.Snapshot()
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+
+	entries = append(entries, SnapshotEntry[string, int]{
+		Key:        "c",
+		Value:      3,
+		Cost:       30,
+		Expiration: time.Now().Add(-time.Second),
+	})
+	c2, err := NewCacheFromEntries(&Config[string, int]{
+		NumCounters: 100,
+		MaxCost:     1000,
+		BufferItems: 64,
+		StoreKeys:   true,
+	}, entries)
+	require.NoError(t, err)
+	defer c2.Close()
+
+	// The entries are visible without waiting on the Set buffer.
+	val, ok := c2.Get("a")
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+	keyHash, _ := c2.HashOf("a")
+	require.Equal(t, 10+itemSize, c2.cachePolicy.Cost(keyHash))
+
+	val, ok = c2.Get("b")
+	require.True(t, ok)
+	require.Equal(t, 2, val)
+	ttl, ok := c2.GetTTL("b")
+	require.True(t, ok)
+	require.True(t, ttl > 59*time.Minute && ttl <= time.Hour)
+
+	_, ok = c2.Get("c")
+	require.False(t, ok, "expired entries shouldn't be added")
+
+	entries2, err := c2.Snapshot()
+	require.NoError(t, err)
+	require.Len(t, entries2, 2)
+}
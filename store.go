@@ -17,6 +17,7 @@
 package ristretto
 
 import (
+	"sort"
 	"sync"
 	"time"
 )
@@ -40,22 +41,97 @@ type storeItem[V any] struct {
 type store[V any] interface {
 	// Get returns the value associated with the key parameter.
 	Get(uint64, uint64) (V, bool)
+	// GetAllowStale is like Get, but also returns values past their
+	// expiration which haven't been cleaned up yet, flagging them as stale.
+	GetAllowStale(uint64, uint64) (V, bool, bool)
+	// GetNoExpiry is like Get, but doesn't check the expiration at all.
+	GetNoExpiry(uint64, uint64) (V, bool)
 	// Expiration returns the expiration time for this key.
 	Expiration(uint64) time.Time
+	// Entry returns the item stored under the key hash, whatever its conflict
+	// hash and even if it expired, along with its original key if known.
+	Entry(uint64) (storeItem[V], any, bool)
 	// Set adds the key-value pair to the Map or updates the value if it's
 	// already present. The key-value pair is passed as a pointer to an
-	// item object.
-	Set(*Item[V])
-	// Del deletes the key-value pair from the Map.
-	Del(uint64, uint64) (uint64, V)
+	// item object. It returns false if the value was not stored, either
+	// because of a conflict or because ShouldUpdate refused it.
+	Set(*Item[V]) bool
+	// Del deletes the key-value pair from the Map. The returned bool is true
+	// if an item was actually removed.
+	Del(uint64, uint64) (uint64, V, bool)
+	// DelDeferred applies a Del which was issued earlier: it works like Del,
+	// but keeps an item inserted by Upsert since, whose admission is pending.
+	DelDeferred(uint64, uint64) (uint64, V, bool)
+	// Upsert atomically replaces the value of the item with fn(current, true),
+	// keeping its expiration, or stores the item with the value fn(zero, false)
+	// if it is missing or expired. inserted is true if the value was stored,
+	// in which case the item is pending until it is passed to Admit or
+	// DelInserted. expired is the expired item that was replaced, if any. ok
+	// is false if another key is stored under the same hash.
+	Upsert(i *Item[V], fn func(cur V, found bool) V) (value V, expired *Item[V], inserted, ok bool)
+	// Admit ends the pending state of an item inserted by Upsert, and returns
+	// whether its key is still in the store.
+	Admit(i *Item[V]) bool
+	// DelInserted deletes an item inserted by Upsert which the policy
+	// rejected, unless it was replaced since by another Upsert.
+	DelInserted(i *Item[V]) (V, bool)
 	// Update attempts to update the key with a new value and returns true if
 	// successful.
 	Update(*Item[V]) (V, bool)
+	// CompareAndSwap atomically replaces the value of the item with i.Value,
+	// keeping its expiration, if it is present, unexpired and eq returns true
+	// for its current value, which is returned.
+	CompareAndSwap(i *Item[V], eq func(cur V) bool) (V, bool)
 	// Cleanup removes items that have an expired TTL.
 	Cleanup(policy *defaultPolicy[V], onEvict func(item *Item[V]))
+	// PurgeExpired removes all the items whose TTL passed, including the ones
+	// Cleanup would only remove later.
+	PurgeExpired(policy *defaultPolicy[V], onEvict func(item *Item[V]))
 	// Clear clears all contents of the store.
 	Clear(onEvict func(item *Item[V]))
+	// Replace replaces all contents of the store with items, which must not
+	// expire, and calls onEvict on the previous contents. Readers see either
+	// the previous contents or the new ones, never a mix.
+	Replace(items []*Item[V], onEvict func(item *Item[V]))
 	SetShouldUpdateFn(f updateFn[V])
+	// SetShardFn replaces the function mapping key hashes to shards. It must
+	// be called before the store is used.
+	SetShardFn(f func(keyHash uint64) uint64)
+	// TrackCreationTime makes the store record the time each key was first
+	// inserted.
+	TrackCreationTime()
+	// Created returns the time the key was first inserted, if creation times
+	// are being tracked.
+	Created(uint64) (time.Time, bool)
+	// SetMaxExpirationBuckets bounds the number of expiration buckets kept
+	// after each Cleanup. The buckets expiring first are cleaned up early to
+	// stay within the bound. Zero means no bound.
+	SetMaxExpirationBuckets(n int)
+	// SetMaxCleanupKeys bounds the number of expired keys removed per Cleanup.
+	// The rest are removed by the following calls. Zero means no bound.
+	SetMaxCleanupKeys(n int)
+	// Len returns the number of unexpired items.
+	Len() int
+	// ExpirationStats returns the number of expiration buckets and the number
+	// of keys tracked in them.
+	ExpirationStats() (numBuckets, numKeys int)
+	// SoonestExpiring returns up to n keys among the ones expiring first.
+	SoonestExpiring(n int) []uint64
+	// IterExpiring calls fn with the original key, the value and the
+	// expiration of the items which haven't expired yet but will by deadline,
+	// soonest first, until fn returns false. It only sees items whose original
+	// key is known.
+	IterExpiring(deadline time.Time, fn func(key any, value V, expiration time.Time) bool)
+	// TrackKeys makes the store keep the original key of each item.
+	TrackKeys()
+	// Iter calls fn with the original key and the value of every unexpired
+	// item, until fn returns false. It only sees items whose original key is
+	// known.
+	Iter(fn func(key any, value V) bool)
+	// IterHashes calls fn with the key hash and the value of every item, the
+	// expired ones included, until fn returns false. fn must not use the
+	// store.
+	IterHashes(fn func(keyHash uint64, value V) bool)
 }
 
 // newStore returns the default store implementation.
@@ -65,9 +141,19 @@ func newStore[V any]() store[V] {
 
 const numShards uint64 = 256
 
+// MixShardFn is a Config.ShardFn for key hashes whose low bits are skewed. It
+// picks the shard from the high bits of the key hash multiplied by an odd
+// constant (Fibonacci hashing), which depend on all of its bits.
+func MixShardFn(keyHash uint64) uint64 {
+	return (keyHash * 0x9E3779B97F4A7C15) >> 56
+}
+
 type shardedMap[V any] struct {
 	shards    []*lockedMap[V]
 	expiryMap *expirationMap[V]
+	// shardFn maps key hashes to shards, modulo numShards. If nil, the key
+	// hash itself is used.
+	shardFn func(keyHash uint64) uint64
 }
 
 func newShardedMap[V any]() *shardedMap[V] {
@@ -81,41 +167,190 @@ func newShardedMap[V any]() *shardedMap[V] {
 	return sm
 }
 
+// shardIndex returns the index of the shard holding key.
+func (sm *shardedMap[V]) shardIndex(key uint64) uint64 {
+	if sm.shardFn != nil {
+		return sm.shardFn(key) % numShards
+	}
+	return key % numShards
+}
+
+func (sm *shardedMap[V]) shard(key uint64) *lockedMap[V] {
+	return sm.shards[sm.shardIndex(key)]
+}
+
+func (sm *shardedMap[V]) SetShardFn(f func(keyHash uint64) uint64) {
+	sm.shardFn = f
+}
+
 func (m *shardedMap[V]) SetShouldUpdateFn(f updateFn[V]) {
 	for i := range m.shards {
 		m.shards[i].setShouldUpdateFn(f)
 	}
 }
 
+func (sm *shardedMap[V]) TrackCreationTime() {
+	for i := range sm.shards {
+		sm.shards[i].trackCreationTime()
+	}
+}
+
+func (sm *shardedMap[V]) Created(key uint64) (time.Time, bool) {
+	return sm.shard(key).Created(key)
+}
+
+func (sm *shardedMap[V]) SetMaxExpirationBuckets(n int) {
+	sm.expiryMap.Lock()
+	sm.expiryMap.maxBuckets = n
+	sm.expiryMap.Unlock()
+}
+
+func (sm *shardedMap[V]) SetMaxCleanupKeys(n int) {
+	sm.expiryMap.Lock()
+	sm.expiryMap.maxPerCleanup = n
+	sm.expiryMap.Unlock()
+}
+
+func (sm *shardedMap[V]) ExpirationStats() (int, int) {
+	return sm.expiryMap.stats()
+}
+
+func (sm *shardedMap[V]) SoonestExpiring(n int) []uint64 {
+	return sm.expiryMap.soonest(n)
+}
+
+func (sm *shardedMap[V]) IterExpiring(deadline time.Time,
+	fn func(key any, value V, expiration time.Time) bool) {
+	type entry struct {
+		key        any
+		value      V
+		expiration time.Time
+	}
+	now := time.Now()
+	var entries []entry
+	for _, k := range sm.expiryMap.keysUntil(deadline) {
+		shard := sm.shard(k)
+		shard.RLock()
+		item, ok := shard.data[k]
+		origKey := shard.keys[k]
+		shard.RUnlock()
+		if !ok || origKey == nil || item.expiration.IsZero() ||
+			!item.expiration.After(now) || item.expiration.After(deadline) {
+			continue
+		}
+		entries = append(entries, entry{key: origKey, value: item.value, expiration: item.expiration})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].expiration.Before(entries[j].expiration)
+	})
+	for _, e := range entries {
+		if !fn(e.key, e.value, e.expiration) {
+			return
+		}
+	}
+}
+
+func (sm *shardedMap[V]) TrackKeys() {
+	for i := range sm.shards {
+		sm.shards[i].trackKeys()
+	}
+}
+
+func (sm *shardedMap[V]) Iter(fn func(key any, value V) bool) {
+	for _, shard := range sm.shards {
+		if !shard.iter(fn) {
+			return
+		}
+	}
+}
+
+func (sm *shardedMap[V]) IterHashes(fn func(keyHash uint64, value V) bool) {
+	for _, shard := range sm.shards {
+		shard.RLock()
+		for k, item := range shard.data {
+			if !fn(k, item.value) {
+				shard.RUnlock()
+				return
+			}
+		}
+		shard.RUnlock()
+	}
+}
+
 func (sm *shardedMap[V]) Get(key, conflict uint64) (V, bool) {
-	return sm.shards[key%numShards].get(key, conflict)
+	return sm.shard(key).get(key, conflict)
+}
+
+func (sm *shardedMap[V]) GetNoExpiry(key, conflict uint64) (V, bool) {
+	return sm.shard(key).getNoExpiry(key, conflict)
+}
+
+func (sm *shardedMap[V]) GetAllowStale(key, conflict uint64) (V, bool, bool) {
+	return sm.shard(key).getAllowStale(key, conflict)
 }
 
 func (sm *shardedMap[V]) Expiration(key uint64) time.Time {
-	return sm.shards[key%numShards].Expiration(key)
+	return sm.shard(key).Expiration(key)
 }
 
-func (sm *shardedMap[V]) Set(i *Item[V]) {
+func (sm *shardedMap[V]) Entry(key uint64) (storeItem[V], any, bool) {
+	return sm.shard(key).entry(key)
+}
+
+func (sm *shardedMap[V]) Set(i *Item[V]) bool {
 	if i == nil {
 		// If item is nil make this Set a no-op.
-		return
+		return false
 	}
 
-	sm.shards[i.Key%numShards].Set(i)
+	return sm.shard(i.Key).Set(i)
+}
+
+func (sm *shardedMap[V]) Del(key, conflict uint64) (uint64, V, bool) {
+	return sm.shard(key).Del(key, conflict)
+}
+
+func (sm *shardedMap[V]) DelDeferred(key, conflict uint64) (uint64, V, bool) {
+	return sm.shard(key).delDeferred(key, conflict)
+}
+
+func (sm *shardedMap[V]) Upsert(i *Item[V], fn func(V, bool) V) (V, *Item[V], bool, bool) {
+	return sm.shard(i.Key).upsert(i, fn)
+}
+
+func (sm *shardedMap[V]) Admit(i *Item[V]) bool {
+	return sm.shard(i.Key).admit(i)
+}
+
+func (sm *shardedMap[V]) DelInserted(i *Item[V]) (V, bool) {
+	return sm.shard(i.Key).delInserted(i)
 }
 
-func (sm *shardedMap[V]) Del(key, conflict uint64) (uint64, V) {
-	return sm.shards[key%numShards].Del(key, conflict)
+func (sm *shardedMap[V]) CompareAndSwap(i *Item[V], eq func(V) bool) (V, bool) {
+	return sm.shard(i.Key).compareAndSwap(i, eq)
 }
 
 func (sm *shardedMap[V]) Update(newItem *Item[V]) (V, bool) {
-	return sm.shards[newItem.Key%numShards].Update(newItem)
+	return sm.shard(newItem.Key).Update(newItem)
 }
 
 func (sm *shardedMap[V]) Cleanup(policy *defaultPolicy[V], onEvict func(item *Item[V])) {
 	sm.expiryMap.cleanup(sm, policy, onEvict)
 }
 
+func (sm *shardedMap[V]) Len() int {
+	now := time.Now()
+	var n int
+	for _, shard := range sm.shards {
+		n += shard.len(now)
+	}
+	return n
+}
+
+func (sm *shardedMap[V]) PurgeExpired(policy *defaultPolicy[V], onEvict func(item *Item[V])) {
+	sm.expiryMap.purge(sm, policy, onEvict)
+}
+
 func (sm *shardedMap[V]) Clear(onEvict func(item *Item[V])) {
 	for i := uint64(0); i < numShards; i++ {
 		sm.shards[i].Clear(onEvict)
@@ -123,11 +358,92 @@ func (sm *shardedMap[V]) Clear(onEvict func(item *Item[V])) {
 	sm.expiryMap.clear()
 }
 
+func (sm *shardedMap[V]) Replace(items []*Item[V], onEvict func(item *Item[V])) {
+	// Build the new shards first, so that the shards are only locked for the
+	// swap.
+	type shardData struct {
+		data    map[uint64]storeItem[V]
+		created map[uint64]int64
+		keys    map[uint64]any
+	}
+	next := make([]shardData, numShards)
+	for i := range next {
+		next[i].data = make(map[uint64]storeItem[V])
+		if sm.shards[i].created != nil {
+			next[i].created = make(map[uint64]int64)
+		}
+		if sm.shards[i].keys != nil {
+			next[i].keys = make(map[uint64]any)
+		}
+	}
+	now := time.Now().UnixNano()
+	for _, i := range items {
+		sd := next[sm.shardIndex(i.Key)]
+		sd.data[i.Key] = storeItem[V]{
+			key:      i.Key,
+			conflict: i.Conflict,
+			value:    i.Value,
+		}
+		if sd.created != nil {
+			sd.created[i.Key] = now
+		}
+		if sd.keys != nil && i.origKey != nil {
+			sd.keys[i.Key] = i.origKey
+		}
+	}
+
+	prev := make([]map[uint64]storeItem[V], numShards)
+	prevKeys := make([]map[uint64]any, numShards)
+	for _, shard := range sm.shards {
+		shard.Lock()
+	}
+	for i, shard := range sm.shards {
+		prev[i] = shard.data
+		prevKeys[i] = shard.keys
+		shard.data = next[i].data
+		shard.created = next[i].created
+		shard.keys = next[i].keys
+		shard.pending = nil
+	}
+	sm.expiryMap.clear()
+	for _, shard := range sm.shards {
+		shard.Unlock()
+	}
+
+	if onEvict == nil {
+		return
+	}
+	i := &Item[V]{}
+	for idx, data := range prev {
+		for _, si := range data {
+			i.Key = si.key
+			i.Conflict = si.conflict
+			i.Value = si.value
+			i.Expiration = si.expiration
+			i.origKey = prevKeys[idx][si.key]
+			onEvict(i)
+		}
+	}
+}
+
 type lockedMap[V any] struct {
 	sync.RWMutex
 	data         map[uint64]storeItem[V]
 	em           *expirationMap[V]
 	shouldUpdate updateFn[V]
+	// created holds the creation time (in unix nanoseconds) of each key. It is
+	// nil unless creation times are being tracked, so that caches not using
+	// it don't pay for the extra memory.
+	created map[uint64]int64
+	// keys holds the original key of each item. It is nil unless keys are
+	// being tracked.
+	keys map[uint64]any
+	// pending holds the generation of the items inserted by upsert whose
+	// admission by the policy is pending. Deletes applied by the policy
+	// goroutine were issued before such an insert, so they leave it alone.
+	pending map[uint64]uint64
+	// gen numbers the inserts made by upsert.
+	gen uint64
 }
 
 func newLockedMap[V any](em *expirationMap[V]) *lockedMap[V] {
@@ -141,9 +457,95 @@ func newLockedMap[V any](em *expirationMap[V]) *lockedMap[V] {
 }
 
 func (m *lockedMap[V]) setShouldUpdateFn(f updateFn[V]) {
+	m.Lock()
+	defer m.Unlock()
 	m.shouldUpdate = f
 }
 
+func (m *lockedMap[V]) trackKeys() {
+	m.Lock()
+	defer m.Unlock()
+	if m.keys == nil {
+		m.keys = make(map[uint64]any)
+	}
+}
+
+// iter calls fn for every unexpired item with a known original key. fn is
+// called on a snapshot of the shard, without holding the lock, so that it may
+// use the cache. It returns false if fn asked to stop.
+func (m *lockedMap[V]) iter(fn func(key any, value V) bool) bool {
+	type entry struct {
+		key   any
+		value V
+	}
+	now := time.Now()
+	m.RLock()
+	entries := make([]entry, 0, len(m.keys))
+	for k, origKey := range m.keys {
+		item, ok := m.data[k]
+		if !ok || (!item.expiration.IsZero() && now.After(item.expiration)) {
+			continue
+		}
+		entries = append(entries, entry{key: origKey, value: item.value})
+	}
+	m.RUnlock()
+
+	for _, e := range entries {
+		if !fn(e.key, e.value) {
+			return false
+		}
+	}
+	return true
+}
+
+// len returns the number of items which haven't expired by now.
+func (m *lockedMap[V]) len(now time.Time) int {
+	m.RLock()
+	defer m.RUnlock()
+	n := len(m.data)
+	for _, item := range m.data {
+		if !item.expiration.IsZero() && now.After(item.expiration) {
+			n--
+		}
+	}
+	return n
+}
+
+func (m *lockedMap[V]) trackCreationTime() {
+	m.Lock()
+	defer m.Unlock()
+	if m.created == nil {
+		m.created = make(map[uint64]int64)
+	}
+}
+
+func (m *lockedMap[V]) Created(key uint64) (time.Time, bool) {
+	m.RLock()
+	defer m.RUnlock()
+	if m.created == nil {
+		return time.Time{}, false
+	}
+	ts, ok := m.created[key]
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(0, ts), true
+}
+
+func (m *lockedMap[V]) getAllowStale(key, conflict uint64) (V, bool, bool) {
+	m.RLock()
+	item, ok := m.data[key]
+	m.RUnlock()
+	if !ok {
+		return zeroValue[V](), false, false
+	}
+	if conflict != 0 && (conflict != item.conflict) {
+		return zeroValue[V](), false, false
+	}
+	stale := !item.expiration.IsZero() && time.Now().After(item.expiration)
+	return item.value, stale, true
+}
+
 func (m *lockedMap[V]) get(key, conflict uint64) (V, bool) {
 	m.RLock()
 	item, ok := m.data[key]
@@ -162,36 +564,70 @@ func (m *lockedMap[V]) get(key, conflict uint64) (V, bool) {
 	return item.value, true
 }
 
+func (m *lockedMap[V]) getNoExpiry(key, conflict uint64) (V, bool) {
+	m.RLock()
+	item, ok := m.data[key]
+	m.RUnlock()
+	if !ok || (conflict != 0 && conflict != item.conflict) {
+		return zeroValue[V](), false
+	}
+	return item.value, true
+}
+
 func (m *lockedMap[V]) Expiration(key uint64) time.Time {
 	m.RLock()
 	defer m.RUnlock()
 	return m.data[key].expiration
 }
 
-func (m *lockedMap[V]) Set(i *Item[V]) {
+func (m *lockedMap[V]) entry(key uint64) (storeItem[V], any, bool) {
+	m.RLock()
+	defer m.RUnlock()
+	item, ok := m.data[key]
+	if !ok {
+		return storeItem[V]{}, nil, false
+	}
+	var origKey any
+	if m.keys != nil {
+		origKey = m.keys[key]
+	}
+	return item, origKey, true
+}
+
+func (m *lockedMap[V]) Set(i *Item[V]) bool {
 	if i == nil {
 		// If the item is nil make this Set a no-op.
-		return
+		return false
 	}
 
 	m.Lock()
 	defer m.Unlock()
+	if _, ok := m.pending[i.Key]; ok {
+		// The key was inserted by upsert after this Set was issued.
+		return false
+	}
 	item, ok := m.data[i.Key]
 
 	if ok {
 		// The item existed already. We need to check the conflict key and reject the
 		// update if they do not match. Only after that the expiration map is updated.
 		if i.Conflict != 0 && (i.Conflict != item.conflict) {
-			return
+			return false
 		}
 		if m.shouldUpdate != nil && !m.shouldUpdate(i.Value, item.value) {
-			return
+			return false
 		}
 		m.em.update(i.Key, i.Conflict, item.expiration, i.Expiration)
 	} else {
 		// The value is not in the map already. There's no need to return anything.
 		// Simply add the expiration map.
 		m.em.add(i.Key, i.Conflict, i.Expiration)
+		if m.created != nil {
+			m.created[i.Key] = time.Now().UnixNano()
+		}
+	}
+	if m.keys != nil && i.origKey != nil {
+		m.keys[i.Key] = i.origKey
 	}
 
 	m.data[i.Key] = storeItem[V]{
@@ -200,17 +636,32 @@ func (m *lockedMap[V]) Set(i *Item[V]) {
 		value:      i.Value,
 		expiration: i.Expiration,
 	}
+	return true
+}
+
+func (m *lockedMap[V]) Del(key, conflict uint64) (uint64, V, bool) {
+	m.Lock()
+	defer m.Unlock()
+	return m.del(key, conflict)
 }
 
-func (m *lockedMap[V]) Del(key, conflict uint64) (uint64, V) {
+func (m *lockedMap[V]) delDeferred(key, conflict uint64) (uint64, V, bool) {
 	m.Lock()
 	defer m.Unlock()
+	if _, ok := m.pending[key]; ok {
+		return 0, zeroValue[V](), false
+	}
+	return m.del(key, conflict)
+}
+
+// del deletes the item. m must be locked.
+func (m *lockedMap[V]) del(key, conflict uint64) (uint64, V, bool) {
 	item, ok := m.data[key]
 	if !ok {
-		return 0, zeroValue[V]()
+		return 0, zeroValue[V](), false
 	}
 	if conflict != 0 && (conflict != item.conflict) {
-		return 0, zeroValue[V]()
+		return 0, zeroValue[V](), false
 	}
 
 	if !item.expiration.IsZero() {
@@ -218,7 +669,105 @@ func (m *lockedMap[V]) Del(key, conflict uint64) (uint64, V) {
 	}
 
 	delete(m.data, key)
-	return item.conflict, item.value
+	if m.created != nil {
+		delete(m.created, key)
+	}
+	if m.keys != nil {
+		delete(m.keys, key)
+	}
+	delete(m.pending, key)
+	return item.conflict, item.value, true
+}
+
+func (m *lockedMap[V]) upsert(i *Item[V], fn func(V, bool) V) (V, *Item[V], bool, bool) {
+	m.Lock()
+	defer m.Unlock()
+	item, ok := m.data[i.Key]
+	if ok && i.Conflict != 0 && (i.Conflict != item.conflict) {
+		return zeroValue[V](), nil, false, false
+	}
+	if ok && (item.expiration.IsZero() || time.Now().Before(item.expiration)) {
+		item.value = fn(item.value, true)
+		m.data[i.Key] = item
+		return item.value, nil, false, true
+	}
+
+	var expired *Item[V]
+	if ok {
+		// The item expired but wasn't cleaned up yet. It is still known to the
+		// policy, so it is replaced in place.
+		expired = &Item[V]{
+			Key:        i.Key,
+			Conflict:   item.conflict,
+			Value:      item.value,
+			Expiration: item.expiration,
+		}
+		if m.keys != nil {
+			expired.origKey = m.keys[i.Key]
+		}
+		m.em.update(i.Key, i.Conflict, item.expiration, i.Expiration)
+	} else {
+		m.em.add(i.Key, i.Conflict, i.Expiration)
+		if m.created != nil {
+			m.created[i.Key] = time.Now().UnixNano()
+		}
+	}
+	if m.keys != nil && i.origKey != nil {
+		m.keys[i.Key] = i.origKey
+	}
+	i.Value = fn(zeroValue[V](), false)
+	m.data[i.Key] = storeItem[V]{
+		key:        i.Key,
+		conflict:   i.Conflict,
+		value:      i.Value,
+		expiration: i.Expiration,
+	}
+	if m.pending == nil {
+		m.pending = make(map[uint64]uint64)
+	}
+	m.gen++
+	i.gen = m.gen
+	m.pending[i.Key] = i.gen
+	return i.Value, expired, true, true
+}
+
+func (m *lockedMap[V]) admit(i *Item[V]) bool {
+	m.Lock()
+	defer m.Unlock()
+	if gen, ok := m.pending[i.Key]; ok && gen == i.gen {
+		delete(m.pending, i.Key)
+	}
+	item, ok := m.data[i.Key]
+	return ok && (i.Conflict == 0 || i.Conflict == item.conflict)
+}
+
+func (m *lockedMap[V]) delInserted(i *Item[V]) (V, bool) {
+	m.Lock()
+	defer m.Unlock()
+	if gen, ok := m.pending[i.Key]; !ok || gen != i.gen {
+		return zeroValue[V](), false
+	}
+	_, value, ok := m.del(i.Key, i.Conflict)
+	return value, ok
+}
+
+func (m *lockedMap[V]) compareAndSwap(i *Item[V], eq func(V) bool) (V, bool) {
+	m.Lock()
+	defer m.Unlock()
+	item, ok := m.data[i.Key]
+	if !ok || (i.Conflict != 0 && i.Conflict != item.conflict) {
+		return zeroValue[V](), false
+	}
+	if !item.expiration.IsZero() && time.Now().After(item.expiration) {
+		return zeroValue[V](), false
+	}
+	if !eq(item.value) {
+		return zeroValue[V](), false
+	}
+	prev := item.value
+	item.value = i.Value
+	m.data[i.Key] = item
+	return prev, true
 }
 
 func (m *lockedMap[V]) Update(newItem *Item[V]) (V, bool) {
@@ -255,8 +804,17 @@ func (m *lockedMap[V]) Clear(onEvict func(item *Item[V])) {
 			i.Key = si.key
 			i.Conflict = si.conflict
 			i.Value = si.value
+			i.Expiration = si.expiration
+			i.origKey = m.keys[si.key]
 			onEvict(i)
 		}
 	}
 	m.data = make(map[uint64]storeItem[V])
+	if m.created != nil {
+		m.created = make(map[uint64]int64)
+	}
+	if m.keys != nil {
+		m.keys = make(map[uint64]any)
+	}
+	m.pending = nil
 }
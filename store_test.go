@@ -176,6 +176,39 @@ func TestStoreCollision(t *testing.T) {
 	require.NotEmpty(t, val)
 }
 
+func TestStoreShardFn(t *testing.T) {
+	// Key hashes which are all multiples of numShards land in a single shard,
+	// unless they are mixed.
+	usedShards := func(s *shardedMap[int]) int {
+		var used int
+		for _, shard := range s.shards {
+			if len(shard.data) > 0 {
+				used++
+			}
+		}
+		return used
+	}
+	for _, mix := range []bool{false, true} {
+		s := newShardedMap[int]()
+		if mix {
+			s.SetShardFn(MixShardFn)
+		}
+		for k := uint64(1); k <= 1000; k++ {
+			require.True(t, s.Set(&Item[int]{Key: k * numShards, Conflict: k, Value: int(k)}))
+		}
+		for k := uint64(1); k <= 1000; k++ {
+			val, ok := s.Get(k*numShards, k)
+			require.True(t, ok)
+			require.Equal(t, int(k), val)
+		}
+		if mix {
+			require.Greater(t, usedShards(s), int(numShards)*3/4)
+		} else {
+			require.Equal(t, 1, usedShards(s))
+		}
+	}
+}
+
 func TestStoreExpiration(t *testing.T) {
 	s := newStore[int]()
 	key, conflict := z.KeyToHash(1)
@@ -259,3 +292,64 @@ func BenchmarkStoreUpdate(b *testing.B) {
 		}
 	})
 }
+
+// largeValue is used to compare storing big values by value and by pointer.
+type largeValue struct {
+	data [512]byte
+}
+
+func BenchmarkStoreSetLargeValue(b *testing.B) {
+	b.Run("value", func(b *testing.B) {
+		s := newStore[largeValue]()
+		key, conflict := z.KeyToHash(1)
+		var v largeValue
+		b.ResetTimer()
+		for n := 0; n < b.N; n++ {
+			s.Set(&Item[largeValue]{Key: key, Conflict: conflict, Value: v})
+			s.Get(key, conflict)
+		}
+	})
+	b.Run("pointer", func(b *testing.B) {
+		s := newStore[*largeValue]()
+		key, conflict := z.KeyToHash(1)
+		v := &largeValue{}
+		b.ResetTimer()
+		for n := 0; n < b.N; n++ {
+			s.Set(&Item[*largeValue]{Key: key, Conflict: conflict, Value: v})
+			s.Get(key, conflict)
+		}
+	})
+}
+
+// BenchmarkStoreGetSmallValue compares looking up small values stored by value,
+// which live inline in the map buckets of the store, with values stored by
+// pointer, which need one more indirection per lookup.
+func BenchmarkStoreGetSmallValue(b *testing.B) {
+	const numKeys = 1 << 20
+	b.Run("value", func(b *testing.B) {
+		s := newStore[[16]byte]()
+		for k := uint64(1); k <= numKeys; k++ {
+			s.Set(&Item[[16]byte]{Key: k, Conflict: k, Value: [16]byte{byte(k)}})
+		}
+		b.ResetTimer()
+		for n := 0; n < b.N; n++ {
+			k := uint64(n)*7919%numKeys + 1
+			if v, _ := s.Get(k, k); v[0] != byte(k) {
+				b.Fatal("unexpected value")
+			}
+		}
+	})
+	b.Run("pointer", func(b *testing.B) {
+		s := newStore[*[16]byte]()
+		for k := uint64(1); k <= numKeys; k++ {
+			s.Set(&Item[*[16]byte]{Key: k, Conflict: k, Value: &[16]byte{byte(k)}})
+		}
+		b.ResetTimer()
+		for n := 0; n < b.N; n++ {
+			k := uint64(n)*7919%numKeys + 1
+			if v, _ := s.Get(k, k); v[0] != byte(k) {
+				b.Fatal("unexpected value")
+			}
+		}
+	})
+}
@@ -0,0 +1,86 @@
+/*
+ * Copyright 2024 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+// SyncMapCompat is a live view of a Cache with the method set of sync.Map, so
+// that code written against sync.Map can be moved to a bounded cache with few
+// changes. It is returned by Cache.AsSyncMap.
+//
+// The semantics differ from sync.Map in a few ways:
+//   - Store is asynchronous, like Cache.Set. A Load right after a Store may
+//     not see the value, and the value may be dropped by the admission policy.
+//   - Values can be evicted or expire at any time.
+//   - LoadOrStore and LoadAndDelete are not atomic.
+//   - Range only sees items set while Config.StoreKeys is true. Without it,
+//     Range never calls f.
+type SyncMapCompat[K Key, V any] struct {
+	c *Cache[K, V]
+}
+
+// AsSyncMap returns a sync.Map-like view of the cache. See SyncMapCompat for
+// how it differs from sync.Map.
+func (c *Cache[K, V]) AsSyncMap() SyncMapCompat[K, V] {
+	return SyncMapCompat[K, V]{c: c}
+}
+
+// Load returns the value stored for key, if any.
+func (m SyncMapCompat[K, V]) Load(key K) (value V, ok bool) {
+	return m.c.Get(key)
+}
+
+// Store sets the value for key. The cost is computed by Config.Cost if it is
+// set, and is 1 otherwise.
+func (m SyncMapCompat[K, V]) Store(key K, value V) {
+	m.c.Set(key, value, m.defaultCost())
+}
+
+// LoadOrStore returns the existing value for key if present. Otherwise, it
+// stores value and returns it. loaded is true if the value was loaded.
+func (m SyncMapCompat[K, V]) LoadOrStore(key K, value V) (actual V, loaded bool) {
+	if v, ok := m.c.Get(key); ok {
+		return v, true
+	}
+	m.c.Set(key, value, m.defaultCost())
+	return value, false
+}
+
+// LoadAndDelete deletes the value for key, returning the previous value if any.
+func (m SyncMapCompat[K, V]) LoadAndDelete(key K) (value V, loaded bool) {
+	value, loaded = m.c.Get(key)
+	m.c.Del(key)
+	return value, loaded
+}
+
+// Delete deletes the value for key.
+func (m SyncMapCompat[K, V]) Delete(key K) {
+	m.c.Del(key)
+}
+
+// Range calls f for each key and value in the cache, until f returns false.
+// It requires Config.StoreKeys, and calls f for nothing otherwise, since
+// sync.Map's Range has no error to return. f may use the cache.
+func (m SyncMapCompat[K, V]) Range(f func(key K, value V) bool) {
+	_ = m.c.Range(f)
+}
+
+func (m SyncMapCompat[K, V]) defaultCost() int64 {
+	if m.c.cost != nil {
+		// A cost of 0 makes the cache use Config.Cost.
+		return 0
+	}
+	return 1
+}
@@ -0,0 +1,76 @@
+package ristretto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyncMapCompat(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		StoreKeys:          true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	m := c.AsSyncMap()
+
+	m.Store(1, 10)
+	c.Wait()
+	v, ok := m.Load(1)
+	require.True(t, ok)
+	require.Equal(t, 10, v)
+
+	v, loaded := m.LoadOrStore(1, 20)
+	require.True(t, loaded)
+	require.Equal(t, 10, v)
+	v, loaded = m.LoadOrStore(2, 20)
+	require.False(t, loaded)
+	require.Equal(t, 20, v)
+	c.Wait()
+
+	seen := make(map[int]int)
+	m.Range(func(key, value int) bool {
+		seen[key] = value
+		return true
+	})
+	require.Equal(t, map[int]int{1: 10, 2: 20}, seen)
+
+	calls := 0
+	m.Range(func(key, value int) bool {
+		calls++
+		return false
+	})
+	require.Equal(t, 1, calls)
+
+	v, loaded = m.LoadAndDelete(1)
+	require.True(t, loaded)
+	require.Equal(t, 10, v)
+	_, ok = m.Load(1)
+	require.False(t, ok)
+
+	m.Delete(2)
+	_, ok = m.Load(2)
+	require.False(t, ok)
+}
+
+func TestSyncMapCompatRangeWithoutKeys(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	m := c.AsSyncMap()
+	m.Store(1, 1)
+	c.Wait()
+	m.Range(func(key, value int) bool {
+		t.Fatal("Range should not see items without StoreKeys")
+		return true
+	})
+}
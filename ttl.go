@@ -17,6 +17,7 @@
 package ristretto
 
 import (
+	"sort"
 	"sync"
 	"time"
 )
@@ -42,8 +43,20 @@ type bucket map[uint64]uint64
 // expirationMap is a map of bucket number to the corresponding bucket.
 type expirationMap[V any] struct {
 	sync.RWMutex
-	buckets              map[int64]bucket
+	buckets map[int64]bucket
+	// order holds the numbers of buckets in increasing order, so that the
+	// buckets expiring first are found without sorting them each time.
+	order                []int64
 	lastCleanedBucketNum int64
+	// maxBuckets bounds the number of buckets kept after a cleanup. Zero means
+	// no bound.
+	maxBuckets int
+	// due holds the buckets which came due, but whose keys weren't all
+	// cleaned up yet because of maxPerCleanup.
+	due []bucket
+	// maxPerCleanup bounds the number of keys cleaned up per call to cleanup.
+	// Zero means no bound.
+	maxPerCleanup int
 }
 
 func newExpirationMap[V any]() *expirationMap[V] {
@@ -69,8 +82,7 @@ func (m *expirationMap[_]) add(key, conflict uint64, expiration time.Time) {
 
 	b, ok := m.buckets[bucketNum]
 	if !ok {
-		b = make(bucket)
-		m.buckets[bucketNum] = b
+		b = m.newBucket(bucketNum)
 	}
 	b[key] = conflict
 }
@@ -87,6 +99,8 @@ func (m *expirationMap[_]) update(key, conflict uint64, oldExpTime, newExpTime t
 	oldBucket, ok := m.buckets[oldBucketNum]
 	if ok {
 		delete(oldBucket, key)
+	} else if !oldExpTime.IsZero() && oldBucketNum <= m.lastCleanedBucketNum {
+		m.delDue(key)
 	}
 
 	// Items that don't expire don't need to be in the expiration map.
@@ -97,12 +111,41 @@ func (m *expirationMap[_]) update(key, conflict uint64, oldExpTime, newExpTime t
 	newBucketNum := storageBucket(newExpTime)
 	newBucket, ok := m.buckets[newBucketNum]
 	if !ok {
-		newBucket = make(bucket)
-		m.buckets[newBucketNum] = newBucket
+		newBucket = m.newBucket(newBucketNum)
 	}
 	newBucket[key] = conflict
 }
 
+// newBucket creates the bucket bucketNum and adds it to the order. The caller
+// must hold the lock.
+func (m *expirationMap[_]) newBucket(bucketNum int64) bucket {
+	b := make(bucket)
+	m.buckets[bucketNum] = b
+	idx := sort.Search(len(m.order), func(i int) bool { return m.order[i] >= bucketNum })
+	m.order = append(m.order, 0)
+	copy(m.order[idx+1:], m.order[idx:])
+	m.order[idx] = bucketNum
+	return b
+}
+
+// takeBuckets removes and returns the first n buckets of the order. The caller
+// must hold the lock.
+func (m *expirationMap[_]) takeBuckets(n int) []bucket {
+	buckets := make([]bucket, 0, n)
+	for _, bucketNum := range m.order[:n] {
+		buckets = append(buckets, m.buckets[bucketNum])
+		delete(m.buckets, bucketNum)
+	}
+	m.order = m.order[n:]
+	return buckets
+}
+
+// numUntil returns the number of buckets up to and including bucketNum. The
+// caller must hold the lock.
+func (m *expirationMap[_]) numUntil(bucketNum int64) int {
+	return sort.Search(len(m.order), func(i int) bool { return m.order[i] > bucketNum })
+}
+
 func (m *expirationMap[_]) del(key uint64, expiration time.Time) {
 	if m == nil {
 		return
@@ -113,11 +156,22 @@ func (m *expirationMap[_]) del(key uint64, expiration time.Time) {
 	defer m.Unlock()
 	_, ok := m.buckets[bucketNum]
 	if !ok {
+		if bucketNum <= m.lastCleanedBucketNum {
+			m.delDue(key)
+		}
 		return
 	}
 	delete(m.buckets[bucketNum], key)
 }
 
+// delDue removes key from the due buckets, which it may still be in after its
+// bucket came due. The caller must hold the lock.
+func (m *expirationMap[_]) delDue(key uint64) {
+	for _, b := range m.due {
+		delete(b, key)
+	}
+}
+
 // cleanup removes all the items in the bucket that was just completed. It deletes
 // those items from the store, and calls the onEvict function on those items.
 // This function is meant to be called periodically.
@@ -129,30 +183,127 @@ func (m *expirationMap[V]) cleanup(store store[V], policy *defaultPolicy[V], onE
 	m.Lock()
 	now := time.Now()
 	currentBucketNum := cleanupBucket(now)
-	// Clean up all buckets up to and including currentBucketNum, starting from
-	// (but not including) the last one that was cleaned up
-	var buckets []bucket
-	for bucketNum := m.lastCleanedBucketNum + 1; bucketNum <= currentBucketNum; bucketNum++ {
-		// With an empty bucket, we don't need to add it to the Clean list
-		if b := m.buckets[bucketNum]; b != nil {
-			buckets = append(buckets, b)
+	// Clean up all buckets up to and including currentBucketNum. The ones up to
+	// the last one that was cleaned up are gone already.
+	buckets := m.takeBuckets(m.numUntil(currentBucketNum))
+	m.lastCleanedBucketNum = currentBucketNum
+	m.due = append(m.due, buckets...)
+	due := m.takeDue()
+	forced := m.overflow()
+	m.Unlock()
+
+	m.evict(due, now, store, policy, onEvict)
+	// The items in the overflowing buckets haven't expired yet, so they are
+	// removed without checking their expiration.
+	m.evict(forced, time.Time{}, store, policy, onEvict)
+
+	cleanedBucketsCount := len(buckets) + len(forced)
+
+	return cleanedBucketsCount
+}
+
+// purge removes all the expired items, without waiting for their buckets to be
+// complete as cleanup does, and regardless of maxPerCleanup.
+func (m *expirationMap[V]) purge(store store[V], policy *defaultPolicy[V], onEvict func(item *Item[V])) {
+	if m == nil {
+		return
+	}
+
+	m.Lock()
+	now := time.Now()
+	currentBucketNum := cleanupBucket(now)
+	buckets := append(m.due, m.takeBuckets(m.numUntil(currentBucketNum))...)
+	m.due = nil
+	if currentBucketNum > m.lastCleanedBucketNum {
+		m.lastCleanedBucketNum = currentBucketNum
+	}
+	// The bucket being filled holds items which haven't expired yet, so it
+	// is kept. Its expired items are removed from it when deleted from the
+	// store.
+	var partial bucket
+	if b := m.buckets[storageBucket(now)]; len(b) > 0 {
+		partial = make(bucket, len(b))
+		for key, conflict := range b {
+			partial[key] = conflict
 		}
-		delete(m.buckets, bucketNum)
+		buckets = append(buckets, partial)
 	}
-	m.lastCleanedBucketNum = currentBucketNum
 	m.Unlock()
 
+	m.evict(buckets, now, store, policy, onEvict)
+}
+
+// takeDue removes and returns up to maxPerCleanup keys from the due buckets, or
+// all of them if there's no bound. The caller must hold the lock.
+func (m *expirationMap[V]) takeDue() []bucket {
+	if m.maxPerCleanup <= 0 {
+		due := m.due
+		m.due = nil
+		return due
+	}
+	var out []bucket
+	budget := m.maxPerCleanup
+	for len(m.due) > 0 && budget > 0 {
+		b := m.due[0]
+		if len(b) <= budget {
+			out = append(out, b)
+			budget -= len(b)
+			m.due = m.due[1:]
+			continue
+		}
+		part := make(bucket, budget)
+		for key, conflict := range b {
+			if budget == 0 {
+				break
+			}
+			part[key] = conflict
+			delete(b, key)
+			budget--
+		}
+		out = append(out, part)
+	}
+	if len(m.due) == 0 {
+		m.due = nil
+	}
+	return out
+}
+
+// overflow removes and returns the buckets expiring first, until no more than
+// maxBuckets are left. The caller must hold the lock.
+func (m *expirationMap[V]) overflow() []bucket {
+	if m.maxBuckets <= 0 || len(m.order) <= m.maxBuckets {
+		return nil
+	}
+	return m.takeBuckets(len(m.order) - m.maxBuckets)
+}
+
+// evict removes the items in buckets from the store and the policy. If now is
+// not zero, items that haven't expired by then are skipped; if it is, the items
+// are removed regardless, and marked as overflowing.
+func (m *expirationMap[V]) evict(buckets []bucket, now time.Time, store store[V],
+	policy *defaultPolicy[V], onEvict func(item *Item[V])) {
 	for _, keys := range buckets {
 		for key, conflict := range keys {
 			expr := store.Expiration(key)
-			// Sanity check. Verify that the store agrees that this key is expired.
-			if expr.After(now) {
+			// Sanity check. Verify that the store agrees that this key is expired,
+			// and that it still has a TTL at all.
+			if expr.IsZero() || (!now.IsZero() && expr.After(now)) {
 				continue
 			}
 
 			cost := policy.Cost(key)
 			policy.Del(key)
-			_, value := store.Del(key, conflict)
+			// The original key, if known, is gone once the item is deleted.
+			var origKey any
+			if onEvict != nil {
+				_, origKey, _ = store.Entry(key)
+			}
+			_, value, ok := store.Del(key, conflict)
+			if !ok {
+				// The item was already removed (or replaced under a different
+				// conflict key), so there's nothing left to evict.
+				continue
+			}
 
 			if onEvict != nil {
 				onEvict(&Item[V]{Key: key,
@@ -160,14 +311,85 @@ func (m *expirationMap[V]) cleanup(store store[V], policy *defaultPolicy[V], onE
 					Value:      value,
 					Cost:       cost,
 					Expiration: expr,
+					origKey:    origKey,
+					overflow:   now.IsZero(),
 				})
 			}
 		}
 	}
+}
 
-	cleanedBucketsCount := len(buckets)
+// keysUntil returns the keys of the buckets which may hold items expiring by
+// deadline.
+func (m *expirationMap[V]) keysUntil(deadline time.Time) []uint64 {
+	if m == nil {
+		return nil
+	}
 
-	return cleanedBucketsCount
+	m.RLock()
+	defer m.RUnlock()
+	var keys []uint64
+	for _, b := range m.due {
+		for key := range b {
+			keys = append(keys, key)
+		}
+	}
+	last := storageBucket(deadline)
+	for bucketNum, b := range m.buckets {
+		if bucketNum > last {
+			continue
+		}
+		for key := range b {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// soonest returns up to n keys of the buckets expiring first, the due buckets
+// included. Keys of the same bucket come in no particular order.
+func (m *expirationMap[V]) soonest(n int) []uint64 {
+	if m == nil {
+		return nil
+	}
+
+	m.RLock()
+	defer m.RUnlock()
+	keys := make([]uint64, 0, n)
+	for _, b := range m.due {
+		for key := range b {
+			if len(keys) == n {
+				return keys
+			}
+			keys = append(keys, key)
+		}
+	}
+	for _, bucketNum := range m.order {
+		for key := range m.buckets[bucketNum] {
+			if len(keys) == n {
+				return keys
+			}
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// stats returns the number of buckets and the number of keys in them.
+func (m *expirationMap[V]) stats() (numBuckets, numKeys int) {
+	if m == nil {
+		return 0, 0
+	}
+
+	m.RLock()
+	defer m.RUnlock()
+	for _, b := range m.buckets {
+		numKeys += len(b)
+	}
+	for _, b := range m.due {
+		numKeys += len(b)
+	}
+	return len(m.buckets), numKeys
 }
 
 // clear clears the expirationMap, the caller is responsible for properly
@@ -179,6 +401,8 @@ func (m *expirationMap[V]) clear() {
 
 	m.Lock()
 	m.buckets = make(map[int64]bucket)
+	m.order = nil
+	m.due = nil
 	m.lastCleanedBucketNum = cleanupBucket(time.Now())
 	m.Unlock()
 }
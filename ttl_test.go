@@ -75,3 +75,109 @@ func TestExpirationMapCleanup(t *testing.T) {
 		)
 	})
 }
+
+func TestExpirationMapMaxBuckets(t *testing.T) {
+	s := newShardedMap[int]()
+	p := newDefaultPolicy[int](100, 10)
+	s.SetMaxExpirationBuckets(1)
+
+	now := time.Now()
+	for i := 1; i <= 3; i++ {
+		s.Set(&Item[int]{Key: uint64(i), Conflict: uint64(i), Value: i,
+			Expiration: now.Add(time.Duration(i) * time.Minute)})
+	}
+	numBuckets, numKeys := s.ExpirationStats()
+	require.Equal(t, 3, numBuckets)
+	require.Equal(t, 3, numKeys)
+
+	var evicted []uint64
+	s.Cleanup(p, func(item *Item[int]) {
+		evicted = append(evicted, item.Key)
+	})
+	require.ElementsMatch(t, []uint64{1, 2}, evicted)
+	_, ok := s.Get(3, 3)
+	require.True(t, ok, "the bucket expiring last should be kept")
+
+	numBuckets, numKeys = s.ExpirationStats()
+	require.Equal(t, 1, numBuckets)
+	require.Equal(t, 1, numKeys)
+}
+
+func TestExpirationMapMaxCleanupKeys(t *testing.T) {
+	s := newShardedMap[int]()
+	p := newDefaultPolicy[int](100, 10)
+	s.SetMaxCleanupKeys(2)
+
+	expiration := time.Now().Add(-10 * time.Second)
+	for i := 1; i <= 5; i++ {
+		s.Set(&Item[int]{Key: uint64(i), Conflict: uint64(i), Value: i, Expiration: expiration})
+	}
+	// Make the bucket of the items due on the next cleanup.
+	s.expiryMap.lastCleanedBucketNum = storageBucket(expiration) - 1
+
+	var evicted int
+	onEvict := func(item *Item[int]) { evicted++ }
+	for _, want := range []int{2, 4, 5, 5} {
+		s.Cleanup(p, onEvict)
+		require.Equal(t, want, evicted)
+		_, numKeys := s.ExpirationStats()
+		require.Equal(t, 5-want, numKeys)
+	}
+}
+
+func TestExpirationMapDueUpdated(t *testing.T) {
+	s := newShardedMap[int]()
+	p := newDefaultPolicy[int](100, 10)
+	s.SetMaxCleanupKeys(1)
+
+	expiration := time.Now().Add(-10 * time.Second)
+	for i := 1; i <= 3; i++ {
+		s.Set(&Item[int]{Key: uint64(i), Conflict: uint64(i), Value: i, Expiration: expiration})
+	}
+	s.expiryMap.lastCleanedBucketNum = storageBucket(expiration) - 1
+
+	var evicted []int
+	onEvict := func(item *Item[int]) { evicted = append(evicted, item.Value) }
+	s.Cleanup(p, onEvict)
+	require.Len(t, evicted, 1)
+
+	// The other keys are still due; they are set again without a TTL, or
+	// deleted, and must leave the due buckets.
+	var kept, deleted uint64
+	for i := uint64(1); i <= 3; i++ {
+		if _, ok := s.GetNoExpiry(i, i); !ok {
+			continue
+		}
+		if kept == 0 {
+			kept = i
+			s.Set(&Item[int]{Key: i, Conflict: i, Value: 10})
+		} else {
+			deleted = i
+			s.Del(i, i)
+		}
+	}
+	_, numKeys := s.ExpirationStats()
+	require.Zero(t, numKeys)
+
+	s.Cleanup(p, onEvict)
+	s.Cleanup(p, onEvict)
+	require.Len(t, evicted, 1)
+	val, ok := s.Get(kept, kept)
+	require.True(t, ok)
+	require.Equal(t, 10, val)
+	_, ok = s.Get(deleted, deleted)
+	require.False(t, ok)
+}
+
+func TestExpirationMapSoonest(t *testing.T) {
+	em := newExpirationMap[int]()
+	now := time.Now()
+	for _, i := range []int{3, 1, 4, 2} {
+		em.add(uint64(i), 0, now.Add(time.Duration(i)*time.Minute))
+	}
+	require.Equal(t, []uint64{1, 2, 3}, em.soonest(3))
+
+	// Moving a key to a new bucket keeps the order.
+	em.update(3, 0, now.Add(3*time.Minute), now.Add(30*time.Second))
+	require.Equal(t, []uint64{3, 1, 2, 4}, em.soonest(4))
+}
@@ -219,6 +219,8 @@ func (a *Allocator) MaxAlloc() int {
 
 const nodeAlign = unsafe.Sizeof(uint64(0)) - 1
 
+// AllocateAligned returns a zeroed out slice of sz bytes starting at an 8 byte aligned address. Like
+// Allocate, it is safe for concurrent use.
 func (a *Allocator) AllocateAligned(sz int) []byte {
 	tsz := sz + int(nodeAlign)
 	out := a.Allocate(tsz)
@@ -231,7 +233,7 @@ func (a *Allocator) AllocateAligned(sz int) []byte {
 	aligned := (addr + nodeAlign) & ^nodeAlign
 	start := int(aligned - addr)
 
-	return out[start : start+sz]
+	return out[start : start+sz : start+sz]
 }
 
 func (a *Allocator) Copy(buf []byte) []byte {
@@ -275,6 +277,9 @@ func (a *Allocator) addBufferAt(bufIdx, minSz int) {
 	a.buffers[bufIdx] = buf
 }
 
+// Allocate returns a slice of sz bytes, which isn't zeroed out if the allocator was reset. It is safe
+// for concurrent use, with allocations of any sizes. The slice has a capacity of sz, so appending
+// to it reallocates it instead of overwriting the next allocation.
 func (a *Allocator) Allocate(sz int) []byte {
 	if a == nil {
 		return make([]byte, sz)
@@ -303,7 +308,8 @@ func (a *Allocator) Allocate(sz int) []byte {
 			// We added a new buffer. Let's acquire slice the right way by going back to the top.
 			continue
 		}
-		data := buf[posIdx-sz : posIdx]
+		// Cap the slice, so that appending to it doesn't overwrite the next allocation.
+		data := buf[posIdx-sz : posIdx : posIdx]
 		return data
 	}
 }
@@ -312,6 +318,9 @@ type AllocatorPool struct {
 	numGets int64
 	allocCh chan *Allocator
 	closer  *Closer
+	// reaper starts the freeupAllocators goroutine. It's only needed once an
+	// allocator is pooled, so pools which are never returned to don't run it.
+	reaper sync.Once
 }
 
 func NewAllocatorPool(sz int) *AllocatorPool {
@@ -319,10 +328,15 @@ func NewAllocatorPool(sz int) *AllocatorPool {
 		allocCh: make(chan *Allocator, sz),
 		closer:  NewCloser(1),
 	}
-	go a.freeupAllocators()
 	return a
 }
 
+func (p *AllocatorPool) startReaper() {
+	p.reaper.Do(func() {
+		go p.freeupAllocators()
+	})
+}
+
 func (p *AllocatorPool) Get(sz int, tag string) *Allocator {
 	if p == nil {
 		return NewAllocator(sz, tag)
@@ -346,6 +360,7 @@ func (p *AllocatorPool) Return(a *Allocator) {
 		return
 	}
 	a.TrimTo(400 << 20)
+	p.startReaper()
 
 	select {
 	case p.allocCh <- a:
@@ -359,6 +374,8 @@ func (p *AllocatorPool) Release() {
 	if p == nil {
 		return
 	}
+	// The reaper drains the pool on close, so make sure it's running.
+	p.startReaper()
 	p.closer.SignalAndWait()
 }
 
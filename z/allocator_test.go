@@ -179,6 +179,79 @@ func TestAllocateConcurrent(t *testing.T) {
 	}
 }
 
+func TestAllocateConcurrentMixed(t *testing.T) {
+	a := NewAllocator(63, "test")
+	defer a.Release()
+
+	N := 4096
+	M := 16
+	var wg sync.WaitGroup
+	bufs := make([][][]byte, M)
+	for i := 0; i < M; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < N; j++ {
+				sz := 1 + (i*N+j)%300
+				var buf []byte
+				if j%2 == 0 {
+					buf = a.Allocate(sz)
+				} else {
+					buf = a.AllocateAligned(sz)
+					if uintptr(unsafe.Pointer(&buf[0]))%8 != 0 {
+						panic("expected an aligned buffer")
+					}
+				}
+				if len(buf) != sz || cap(buf) != sz {
+					panic("expected a buffer of the requested size")
+				}
+				for k := range buf {
+					buf[k] = byte(i)
+				}
+				// Appending to the previous, full buffer must copy it rather than write over
+				// the bytes allocated after it, which the checks below would catch.
+				if j > 0 {
+					prev := bufs[i][j-1]
+					_ = append(prev, 0xff)
+				}
+				bufs[i] = append(bufs[i], buf)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	type span struct{ lo, hi uintptr }
+	var spans []span
+	for i, bs := range bufs {
+		for _, b := range bs {
+			for _, c := range b {
+				require.Equal(t, byte(i), c)
+			}
+			lo := uintptr(unsafe.Pointer(&b[0]))
+			spans = append(spans, span{lo, lo + uintptr(len(b))})
+		}
+	}
+	sort.Slice(spans, func(i, j int) bool {
+		return spans[i].lo < spans[j].lo
+	})
+	for i := 1; i < len(spans); i++ {
+		require.LessOrEqual(t, spans[i-1].hi, spans[i].lo)
+	}
+}
+
+func TestAllocatorPool(t *testing.T) {
+	// A pool that never had anything returned to it must still release cleanly.
+	NewAllocatorPool(2).Release()
+
+	p := NewAllocatorPool(2)
+	a := p.Get(64, "test")
+	p.Return(a)
+	require.Equal(t, a, p.Get(64, "reused"))
+	require.Equal(t, "reused", a.Tag)
+	p.Return(a)
+	p.Release()
+}
+
 func BenchmarkAllocate(b *testing.B) {
 	a := NewAllocator(15, "test")
 	b.RunParallel(func(pb *testing.PB) {
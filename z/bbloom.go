@@ -23,8 +23,9 @@ package z
 import (
 	"bytes"
 	"encoding/json"
-	"log"
+	"fmt"
 	"math"
+	"sync/atomic"
 	"unsafe"
 )
 
@@ -59,7 +60,7 @@ func NewBloomFilter(params ...float64) (bloomfilter *Bloom) {
 			entries, locs = uint64(params[0]), uint64(params[1])
 		}
 	} else {
-		log.Fatal("usage: New(float64(number_of_entries), float64(number_of_hashlocations))" +
+		panic("usage: New(float64(number_of_entries), float64(number_of_hashlocations))" +
 			" i.e. New(float64(1000), float64(3)) or New(float64(number_of_entries)," +
 			" float64(number_of_hashlocations)) i.e. New(float64(1000), float64(0.03))")
 	}
@@ -131,6 +132,56 @@ func (bl *Bloom) AddIfNotHas(hash uint64) bool {
 	return true
 }
 
+// AddHashConcurrent is like Add, but uses atomic word operations so that it can
+// be called concurrently with other AddHashConcurrent and HasConcurrent calls
+// on the same filter. It is slower than Add, which remains the default.
+func (bl *Bloom) AddHashConcurrent(hash uint64) {
+	h := hash >> bl.shift
+	l := hash << bl.shift >> bl.shift
+	for i := uint64(0); i < bl.setLocs; i++ {
+		bl.setConcurrent((h + i*l) & bl.size)
+		atomic.AddUint64(&bl.ElemNum, 1)
+	}
+}
+
+// HasConcurrent is like Has, but safe to call concurrently with
+// AddHashConcurrent.
+func (bl *Bloom) HasConcurrent(hash uint64) bool {
+	h := hash >> bl.shift
+	l := hash << bl.shift >> bl.shift
+	for i := uint64(0); i < bl.setLocs; i++ {
+		if !bl.isSetConcurrent((h + i*l) & bl.size) {
+			return false
+		}
+	}
+	return true
+}
+
+// wordMask returns the mask for bit[idx] within its uint64 word. The mask is
+// built byte-wise so that it matches the layout used by Set and IsSet
+// regardless of the platform's endianness.
+func wordMask(idx uint64) uint64 {
+	var m uint64
+	ptr := unsafe.Pointer(uintptr(unsafe.Pointer(&m)) + uintptr((idx%64)>>3))
+	*(*uint8)(ptr) = mask[idx%8]
+	return m
+}
+
+func (bl *Bloom) setConcurrent(idx uint64) {
+	word := &bl.bitset[idx>>6]
+	m := wordMask(idx)
+	for {
+		old := atomic.LoadUint64(word)
+		if old&m != 0 || atomic.CompareAndSwapUint64(word, old, old|m) {
+			return
+		}
+	}
+}
+
+func (bl *Bloom) isSetConcurrent(idx uint64) bool {
+	return atomic.LoadUint64(&bl.bitset[idx>>6])&wordMask(idx) != 0
+}
+
 // TotalSize returns the total size of the bloom filter.
 func (bl *Bloom) TotalSize() int {
 	// The bl struct has 5 members and each one is 8 byte. The bitset is a
@@ -204,7 +255,7 @@ func (bl Bloom) JSONMarshal() []byte {
 	}
 	data, err := json.Marshal(bloomImEx)
 	if err != nil {
-		log.Fatal("json.Marshal failed: ", err)
+		panic(fmt.Sprintf("json.Marshal failed: %v", err))
 	}
 	return data
 }
@@ -3,6 +3,7 @@ package z
 import (
 	"crypto/rand"
 	"fmt"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -71,6 +72,34 @@ func TestM_JSON(t *testing.T) {
 	require.Equal(t, shallBe, cnt2)
 }
 
+func TestBloomConcurrent(t *testing.T) {
+	bl := NewBloomFilter(float64(n*10), float64(7))
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := g; i < len(wordlist1); i += 8 {
+				bl.AddHashConcurrent(MemHash(wordlist1[i]))
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	for i := range wordlist1 {
+		hash := MemHash(wordlist1[i])
+		require.True(t, bl.HasConcurrent(hash))
+		// The concurrent and non-concurrent paths share the same bit layout.
+		require.True(t, bl.Has(hash))
+	}
+	require.Equal(t, uint64(len(wordlist1)*7), bl.ElemNum)
+
+	bl2 := NewBloomFilter(float64(n*10), float64(7))
+	bl2.Add(MemHash(wordlist1[0]))
+	require.True(t, bl2.HasConcurrent(MemHash(wordlist1[0])))
+}
+
 func BenchmarkM_New(b *testing.B) {
 	for r := 0; r < b.N; r++ {
 		_ = NewBloomFilter(float64(n*10), float64(7))
@@ -110,3 +139,7 @@ func BenchmarkM_Has(b *testing.B) {
 		}
 	}
 }
+
+func TestBloomBadParams(t *testing.T) {
+	require.Panics(t, func() { NewBloomFilter(100) })
+}
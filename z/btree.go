@@ -17,36 +17,108 @@
 package z
 
 import (
+	"encoding/binary"
 	"fmt"
 	"math"
 	"os"
 	"reflect"
+	"runtime"
 	"strings"
 	"unsafe"
 
 	"github.com/dgraph-io/ristretto/v2/z/simd"
+	"github.com/pkg/errors"
 )
 
 var (
+	// pageSize is the node size of the trees created by NewTree.
 	pageSize = os.Getpagesize()
 	maxKeys  = (pageSize / 16) - 1
-	//nolint:unused
-	oneThird = int(float64(maxKeys) / 3)
 )
 
 const (
 	absoluteMax = uint64(math.MaxUint64 - 1)
 	minSize     = 1 << 20
+	// minPageSize is the smallest node size, which holds 4 keys. With fewer keys, splits leave
+	// nodes so empty that the tree degenerates.
+	minPageSize = 80
 )
 
 // Tree represents the structure for custom mmaped B+ tree.
 // It supports keys in range [1, math.MaxUint64-1] and values [1, math.Uint64].
 type Tree struct {
+	treePages
+	freePage uint64
+	stats    TreeStats
+}
+
+// treePages holds the nodes of a tree, in pages of pageSize bytes carved out of a buffer. Page 0
+// isn't used, so that a zero page ID means no page. It is shared by Tree and Tree128.
+type treePages struct {
 	buffer   *Buffer
 	data     []byte
 	nextPage uint64
-	freePage uint64
-	stats    TreeStats
+	pageSize int
+}
+
+// openPages backs the pages by the file at path, which holds the pages written by a previous
+// tree, if any.
+func (p *treePages) openPages(path string) error {
+	var err error
+	// Open the buffer from disk and set it to the maximum allocated size.
+	p.buffer, err = NewBufferPersistent(path, minSize)
+	if err != nil {
+		return err
+	}
+	p.buffer.offset = uint64(len(p.buffer.buf))
+	p.data = p.buffer.Bytes()
+	return nil
+}
+
+// resetPages drops all the pages.
+func (p *treePages) resetPages() {
+	// The trees rely on uninitialized data being zeroed out, so we need to Memclr
+	// the data before using it again.
+	Memclr(p.buffer.buf)
+	p.buffer.Reset()
+	p.buffer.AllocateOffset(minSize)
+	p.data = p.buffer.Bytes()
+	p.nextPage = 1
+}
+
+// allocPage adds a page at the end, and returns its ID.
+func (p *treePages) allocPage() uint64 {
+	pageId := p.nextPage
+	p.nextPage++
+	offset := int(pageId) * p.pageSize
+	reqSize := offset + p.pageSize
+	if reqSize > len(p.data) {
+		p.buffer.AllocateOffset(reqSize - len(p.data))
+		p.data = p.buffer.Bytes()
+	}
+	return pageId
+}
+
+// page returns the page pid, or nil for page 0.
+func (p *treePages) page(pid uint64) []uint64 {
+	// page does not exist
+	if pid == 0 {
+		return nil
+	}
+	start := p.pageSize * int(pid)
+	return BytesToUint64Slice(p.data[start : start+p.pageSize])
+}
+
+// findNextPage sets nextPage after the pages of a tree loaded from disk. Both node layouts store
+// the page ID in the second to last word, which is only zero for pages never used.
+func (p *treePages) findNextPage() {
+	p.nextPage = 1
+	for int(p.nextPage)*p.pageSize < len(p.data) {
+		if n := p.page(p.nextPage); n[len(n)-2] == 0 {
+			break
+		}
+		p.nextPage++
+	}
 }
 
 func (t *Tree) initRootNode() {
@@ -56,29 +128,41 @@ func (t *Tree) initRootNode() {
 	t.Set(absoluteMax, 0)
 }
 
-// NewTree returns an in-memory B+ tree.
+// NewTree returns an in-memory B+ tree, whose nodes are the size of an OS page.
 func NewTree(tag string) *Tree {
+	return NewTreeWithPageSize(tag, pageSize)
+}
+
+// NewTreeWithPageSize returns an in-memory B+ tree whose nodes are pageSz bytes, each holding
+// pageSz/16 - 1 keys. Larger nodes make the tree shallower, at the cost of a longer search within
+// each node, so the best size depends on the number of keys and on the access pattern. pageSz
+// must be a multiple of 16, and at least 80. It needn't be a multiple of the OS page size, as
+// nodes aren't paged in and out individually.
+func NewTreeWithPageSize(tag string, pageSz int) *Tree {
 	const defaultTag = "tree"
 	if tag == "" {
 		tag = defaultTag
 	}
-	t := &Tree{buffer: NewBuffer(minSize, tag)}
+	if pageSz < minPageSize || pageSz%16 != 0 {
+		panic(fmt.Sprintf("NewTreeWithPageSize: invalid page size %d", pageSz))
+	}
+	t := &Tree{treePages: treePages{buffer: NewBuffer(minSize, tag), pageSize: pageSz}}
 	t.Reset()
 	return t
 }
 
 // NewTree returns a persistent on-disk B+ tree.
 func NewTreePersistent(path string) (*Tree, error) {
-	t := &Tree{}
-	var err error
+	return newTreePersistent(path, pageSize)
+}
 
-	// Open the buffer from disk and set it to the maximum allocated size.
-	t.buffer, err = NewBufferPersistent(path, minSize)
-	if err != nil {
+// newTreePersistent returns a persistent on-disk B+ tree whose nodes are pageSz bytes. The file
+// doesn't record the page size, so it must be opened with the one it was written with.
+func newTreePersistent(path string, pageSz int) (*Tree, error) {
+	t := &Tree{treePages: treePages{pageSize: pageSz}}
+	if err := t.openPages(path); err != nil {
 		return nil, err
 	}
-	t.buffer.offset = uint64(len(t.buffer.buf))
-	t.data = t.buffer.Bytes()
 
 	// pageID can never be 0 if the tree has been initialized.
 	root := t.node(1)
@@ -99,14 +183,7 @@ func NewTreePersistent(path string) (*Tree, error) {
 // in-memory, but are lost when loading from disk.
 func (t *Tree) reinit() {
 	// Calculate t.nextPage by finding the first node whose pageID is not set.
-	t.nextPage = 1
-	for int(t.nextPage)*pageSize < len(t.data) {
-		n := t.node(t.nextPage)
-		if n.pageID() == 0 {
-			break
-		}
-		t.nextPage++
-	}
+	t.findNextPage()
 	maxPageId := t.nextPage - 1
 
 	// Calculate t.freePage by finding the page to which no other page points.
@@ -152,18 +229,119 @@ func (t *Tree) reinit() {
 
 // Reset resets the tree and truncates it to maxSz.
 func (t *Tree) Reset() {
-	// Tree relies on uninitialized data being zeroed out, so we need to Memclr
-	// the data before using it again.
-	Memclr(t.buffer.buf)
-	t.buffer.Reset()
-	t.buffer.AllocateOffset(minSize)
-	t.data = t.buffer.Bytes()
+	t.resetPages()
 	t.stats = TreeStats{}
-	t.nextPage = 1
 	t.freePage = 0
 	t.initRootNode()
 }
 
+// Clone writes the current state of the tree to a new file at path, which is
+// truncated if it exists, and returns a persistent tree backed by it. The clone
+// is independent of t: writes to one are not seen by the other. Like every
+// other Tree method, Clone must not run concurrently with writes to t.
+func (t *Tree) Clone(path string) (*Tree, error) {
+	// The file layout is the same as that of the buffer, padding included.
+	if err := os.WriteFile(path, t.buffer.buf[:t.buffer.offset], 0666); err != nil {
+		return nil, errors.Wrapf(err, "while cloning tree to %s", path)
+	}
+	return newTreePersistent(path, t.pageSize)
+}
+
+// Compact rebuilds the tree from its live keys, dropping the free pages left by DeleteBelow and
+// DeleteRange, and shrinks the memory or the file backing it accordingly. It needs memory for a
+// copy of the compacted tree while it runs.
+func (t *Tree) Compact() error {
+	type kv struct{ k, v uint64 }
+	kvs := make([]kv, 0, t.stats.NumLeafKeys)
+	t.IterateKV(func(k, v uint64) uint64 {
+		kvs = append(kvs, kv{k, v})
+		return 0
+	})
+	nt := NewTreeWithPageSize(t.buffer.tag, t.pageSize)
+	for _, e := range kvs {
+		nt.Set(e.k, e.v)
+	}
+
+	if t.buffer.bufType == UseMmap {
+		// Keep the same file, and copy the compacted tree over.
+		defer nt.Close()
+		sz := int(nt.buffer.offset)
+		if err := t.buffer.mmapFile.Truncate(int64(sz)); err != nil {
+			return errors.Wrapf(err, "while truncating tree to %d bytes", sz)
+		}
+		t.buffer.buf = t.buffer.mmapFile.Data
+		copy(t.buffer.buf, nt.buffer.buf[:sz])
+		t.buffer.curSz = sz
+		t.buffer.offset = uint64(sz)
+	} else {
+		if err := t.buffer.Release(); err != nil {
+			return err
+		}
+		t.buffer = nt.buffer
+	}
+	t.data = t.buffer.Bytes()
+	t.nextPage = nt.nextPage
+	t.freePage = 0
+	t.stats = nt.stats
+	return nil
+}
+
+// treeRecordSize is the size of a key-value pair written by Marshal.
+const treeRecordSize = 16
+
+// Marshal appends every key-value pair of the tree to b, in key order, as 16 byte records holding the
+// key and then the value, both little endian. Unlike the page file of a persistent tree, this format
+// doesn't depend on the page size, so it can be read back with UnmarshalTree on any machine.
+func (t *Tree) Marshal(b *Buffer) {
+	it := t.Iterator()
+	for {
+		k, v, ok := it.Next()
+		if !ok {
+			return
+		}
+		rec := b.Allocate(treeRecordSize)
+		binary.LittleEndian.PutUint64(rec[0:8], k)
+		binary.LittleEndian.PutUint64(rec[8:16], v)
+	}
+}
+
+// UnmarshalTree returns a new in-memory tree holding the key-value pairs written to b by Marshal.
+// It panics if b doesn't hold a whole number of records.
+func UnmarshalTree(b *Buffer) *Tree {
+	data := b.Bytes()
+	if len(data)%treeRecordSize != 0 {
+		panic(fmt.Sprintf("UnmarshalTree: %d bytes isn't a multiple of %d", len(data), treeRecordSize))
+	}
+	t := NewTree("UnmarshalTree")
+	for ; len(data) > 0; data = data[treeRecordSize:] {
+		t.Set(binary.LittleEndian.Uint64(data[0:8]), binary.LittleEndian.Uint64(data[8:16]))
+	}
+	return t
+}
+
+// Prefault reads every page used by the tree, so that later lookups don't stall on page faults.
+// It is meant to be called after a bulk load, before latency sensitive reads. For a tree backed by
+// a file, it also re-enables read-ahead on the mapping, which makes faulting pages in sequentially
+// faster. The pages can still be reclaimed by the OS under memory pressure.
+func (t *Tree) Prefault() error {
+	used := t.data[:int(t.nextPage)*t.pageSize]
+	if t.buffer.bufType == UseMmap {
+		// Madvise needs a page aligned address, so advise the whole mapping.
+		if err := Madvise(t.buffer.mmapFile.Data, true); err != nil {
+			return errors.Wrapf(err, "while enabling read-ahead")
+		}
+	}
+	// Touch one byte per OS page; tree pages can span several of them.
+	var sum byte
+	step := os.Getpagesize()
+	for i := 0; i < len(used); i += step {
+		sum += used[i]
+	}
+	// Keep the reads from being optimized away.
+	runtime.KeepAlive(sum)
+	return nil
+}
+
 // Close releases the memory used by the tree.
 func (t *Tree) Close() error {
 	if t == nil {
@@ -186,14 +364,14 @@ type TreeStats struct {
 func (t *Tree) Stats() TreeStats {
 	numPages := int(t.nextPage - 1)
 	out := TreeStats{
-		Bytes:        numPages * pageSize,
+		Bytes:        numPages * t.pageSize,
 		Allocated:    len(t.data),
 		NumLeafKeys:  t.stats.NumLeafKeys,
 		NumPages:     numPages,
 		NumPagesFree: t.stats.NumPagesFree,
-		PageSize:     pageSize,
+		PageSize:     t.pageSize,
 	}
-	out.Occupancy = 100.0 * float64(out.NumLeafKeys) / float64(maxKeys*numPages)
+	out.Occupancy = 100.0 * float64(out.NumLeafKeys) / float64(t.node(1).maxKeys()*numPages)
 	return out
 }
 
@@ -216,14 +394,7 @@ func (t *Tree) newNode(bit uint64) node {
 		pageId = t.freePage
 		t.stats.NumPagesFree--
 	} else {
-		pageId = t.nextPage
-		t.nextPage++
-		offset := int(pageId) * pageSize
-		reqSize := offset + pageSize
-		if reqSize > len(t.data) {
-			t.buffer.AllocateOffset(reqSize - len(t.data))
-			t.data = t.buffer.Bytes()
-		}
+		pageId = t.allocPage()
 	}
 	n := t.node(pageId)
 	if t.freePage > 0 {
@@ -231,7 +402,7 @@ func (t *Tree) newNode(bit uint64) node {
 	}
 	zeroOut(n)
 	n.setBit(bit)
-	n.setAt(keyOffset(maxKeys), pageId)
+	n.setAt(keyOffset(n.maxKeys()), pageId)
 	return n
 }
 
@@ -246,12 +417,7 @@ func zeroOut(data []uint64) {
 }
 
 func (t *Tree) node(pid uint64) node {
-	// page does not exist
-	if pid == 0 {
-		return nil
-	}
-	start := pageSize * int(pid)
-	return getNode(t.data[start : start+pageSize])
+	return node(t.page(pid))
 }
 
 // Set sets the key-value pair in the tree.
@@ -265,11 +431,11 @@ func (t *Tree) Set(k, v uint64) {
 		left := t.newNode(root.bits())
 		// Re-read the root as the underlying buffer for tree might have changed during split.
 		root = t.node(1)
-		copy(left[:keyOffset(maxKeys)], root)
+		copy(left[:keyOffset(root.maxKeys())], root)
 		left.setNumKeys(root.numKeys())
 
 		// reset the root node.
-		zeroOut(root[:keyOffset(maxKeys)])
+		zeroOut(root[:keyOffset(root.maxKeys())])
 		root.setNumKeys(0)
 
 		// set the pointers for left and right child in the root node.
@@ -289,7 +455,7 @@ func (t *Tree) set(pid, k, v uint64) node {
 
 	// This is an internal node.
 	idx := n.search(k)
-	if idx >= maxKeys {
+	if idx >= n.maxKeys() {
 		panic("search returned index >= maxKeys")
 	}
 	// If no key at idx.
@@ -349,6 +515,45 @@ func (t *Tree) get(n node, k uint64) uint64 {
 	return t.get(child, k)
 }
 
+// GetBatch looks up sortedKeys, which must be sorted in ascending order, and
+// returns their values in the same order, with zero for keys not present. The
+// leaf found for a key is reused for the following keys as long as they fall in
+// its range, so runs of nearby keys are served without descending the tree.
+func (t *Tree) GetBatch(sortedKeys []uint64) []uint64 {
+	vals := make([]uint64, len(sortedKeys))
+	var leaf node
+	var hi uint64
+	for i, k := range sortedKeys {
+		if k == math.MaxUint64 || k == 0 {
+			panic("Does not support getting MaxUint64/Zero")
+		}
+		if leaf == nil || k > hi {
+			if leaf, hi = t.leaf(k); leaf == nil {
+				continue
+			}
+		}
+		vals[i] = leaf.get(k)
+	}
+	return vals
+}
+
+// leaf returns the leaf node which would hold k, along with the largest key
+// that leaf can hold. It returns a nil node if no leaf can hold k.
+func (t *Tree) leaf(k uint64) (node, uint64) {
+	n := t.node(1)
+	hi := uint64(math.MaxUint64)
+	for !n.isLeaf() {
+		idx := n.search(k)
+		if idx == n.numKeys() || n.key(idx) == 0 {
+			return nil, 0
+		}
+		hi = n.key(idx)
+		n = t.node(n.uint64(valOffset(idx)))
+		assert(n != nil)
+	}
+	return n, hi
+}
+
 // DeleteBelow deletes all keys with value under ts.
 func (t *Tree) DeleteBelow(ts uint64) {
 	root := t.node(1)
@@ -384,13 +589,59 @@ func (t *Tree) compact(n node, ts uint64) int {
 	return n.compact(1)
 }
 
+// DeleteRange deletes all keys in the range [lo, hi]. Leaf pages left empty are
+// returned to the free list.
+func (t *Tree) DeleteRange(lo, hi uint64) {
+	if lo == 0 {
+		lo = 1
+	}
+	if lo > hi {
+		return
+	}
+	root := t.node(1)
+	t.deleteRange(root, lo, hi)
+	assert(root.numKeys() >= 1)
+}
+
+func (t *Tree) deleteRange(n node, lo, hi uint64) int {
+	if n.isLeaf() {
+		before := n.numKeys()
+		numKeys := n.deleteRange(lo, hi)
+		t.stats.NumLeafKeys -= before - n.numKeys()
+		return numKeys
+	}
+	// Not leaf. Child i holds the keys in (key(i-1), key(i)].
+	N := n.numKeys()
+	var prev uint64
+	for i := 0; i < N; i++ {
+		k := n.key(i)
+		assert(k > 0)
+		if k < lo || prev >= hi {
+			prev = k
+			continue
+		}
+		prev = k
+		childID := n.uint64(valOffset(i))
+		child := t.node(childID)
+		if rem := t.deleteRange(child, lo, hi); rem == 0 && i < N-1 {
+			// Same as in compact, drop the child unless it holds the max key.
+			t.stats.NumLeafKeys -= child.numKeys()
+			child.setAt(0, t.freePage)
+			t.freePage = childID
+			n.setAt(valOffset(i), 0)
+			t.stats.NumPagesFree++
+		}
+	}
+	return n.compact(1)
+}
+
 func (t *Tree) iterate(n node, fn func(node)) {
 	fn(n)
 	if n.isLeaf() {
 		return
 	}
 	// Explore children.
-	for i := 0; i < maxKeys; i++ {
+	for i := 0; i < n.maxKeys(); i++ {
 		if n.key(i) == 0 {
 			return
 		}
@@ -434,13 +685,93 @@ func (t *Tree) IterateKV(f func(key, val uint64) (newVal uint64)) {
 	})
 }
 
+// TreeIterator iterates over the keys and values of a Tree in key order. Unlike
+// IterateKV, it can be paused and resumed at will. The tree must not be
+// modified while iterating; call Seek again after modifying it.
+type TreeIterator struct {
+	t *Tree
+	// path holds the pages on the way from the root to the current leaf, along
+	// with the index of the current entry in each of them.
+	path []iterFrame
+}
+
+type iterFrame struct {
+	pid uint64
+	idx int
+}
+
+// Iterator returns an iterator positioned at the smallest key of the tree.
+func (t *Tree) Iterator() *TreeIterator {
+	it := &TreeIterator{t: t}
+	it.Seek(0)
+	return it
+}
+
+// Seek positions the iterator at the smallest key >= k.
+func (it *TreeIterator) Seek(k uint64) {
+	it.path = it.path[:0]
+	pid := uint64(1)
+	for {
+		n := it.t.node(pid)
+		idx := n.search(k)
+		it.path = append(it.path, iterFrame{pid: pid, idx: idx})
+		if n.isLeaf() || idx == n.numKeys() {
+			return
+		}
+		if pid = n.val(idx); pid == 0 {
+			// This child was freed, Next moves on to its sibling.
+			return
+		}
+	}
+}
+
+// Next returns the current key and value and advances the iterator. ok is false
+// once all keys have been returned.
+func (it *TreeIterator) Next() (k, v uint64, ok bool) {
+	for len(it.path) > 0 {
+		top := &it.path[len(it.path)-1]
+		n := it.t.node(top.pid)
+		if n.isLeaf() {
+			for top.idx < n.numKeys() {
+				i := top.idx
+				top.idx++
+				// A zero value here means that this is a bogus entry.
+				if v := n.val(i); v != 0 {
+					return n.key(i), v, true
+				}
+			}
+			it.pop()
+			continue
+		}
+		if top.idx >= n.numKeys() {
+			it.pop()
+			continue
+		}
+		child := n.val(top.idx)
+		if child == 0 {
+			top.idx++
+			continue
+		}
+		it.path = append(it.path, iterFrame{pid: child})
+	}
+	return 0, 0, false
+}
+
+// pop moves the iterator up one level, to the next entry of the parent.
+func (it *TreeIterator) pop() {
+	it.path = it.path[:len(it.path)-1]
+	if len(it.path) > 0 {
+		it.path[len(it.path)-1].idx++
+	}
+}
+
 func (t *Tree) print(n node, parentID uint64) {
 	n.print(parentID)
 	if n.isLeaf() {
 		return
 	}
 	pid := n.pageID()
-	for i := 0; i < maxKeys; i++ {
+	for i := 0; i < n.maxKeys(); i++ {
 		if n.key(i) == 0 {
 			return
 		}
@@ -468,13 +799,14 @@ func (t *Tree) split(pid uint64) node {
 	nn := t.newNode(n.bits())
 	// Re-read n as the underlying buffer for tree might have changed during newNode.
 	n = t.node(pid)
-	rightHalf := n[keyOffset(maxKeys/2):keyOffset(maxKeys)]
+	mk := n.maxKeys()
+	rightHalf := n[keyOffset(mk/2):keyOffset(mk)]
 	copy(nn, rightHalf)
-	nn.setNumKeys(maxKeys - maxKeys/2)
+	nn.setNumKeys(mk - mk/2)
 
 	// Remove entries from node n.
 	zeroOut(rightHalf)
-	n.setNumKeys(maxKeys / 2)
+	n.setNumKeys(mk / 2)
 	return nn
 }
 
@@ -489,7 +821,9 @@ func (t *Tree) shareWithSiblingXXX(n node, idx int) bool {
 	}
 	left := t.node(n.val(idx - 1))
 	ns := left.numKeys()
-	if ns >= maxKeys/2 {
+	mk := left.maxKeys()
+	oneThird := mk / 3
+	if ns >= mk/2 {
 		// Sibling is already getting full.
 		return false
 	}
@@ -504,9 +838,9 @@ func (t *Tree) shareWithSiblingXXX(n node, idx int) bool {
 	n.setAt(keyOffset(idx-1), left.maxKey())
 
 	// Now move keys to left for the right sibling.
-	until := copy(right, right[keyOffset(oneThird):keyOffset(maxKeys)])
+	until := copy(right, right[keyOffset(oneThird):keyOffset(mk)])
 	right.setNumKeys(until / 2)
-	zeroOut(right[until:keyOffset(maxKeys)])
+	zeroOut(right[until:keyOffset(mk)])
 	return true
 }
 
@@ -526,8 +860,9 @@ func (n node) uint64(start int) uint64 { return n[start] }
 
 func keyOffset(i int) int          { return 2 * i }
 func valOffset(i int) int          { return 2*i + 1 }
-func (n node) numKeys() int        { return int(n.uint64(valOffset(maxKeys)) & 0xFFFFFFFF) }
-func (n node) pageID() uint64      { return n.uint64(keyOffset(maxKeys)) }
+func (n node) maxKeys() int        { return len(n)/2 - 1 }
+func (n node) numKeys() int        { return int(n.uint64(valOffset(n.maxKeys())) & 0xFFFFFFFF) }
+func (n node) pageID() uint64      { return n.uint64(keyOffset(n.maxKeys())) }
 func (n node) key(i int) uint64    { return n.uint64(keyOffset(i)) }
 func (n node) val(i int) uint64    { return n.uint64(valOffset(i)) }
 func (n node) data(i int) []uint64 { return n[keyOffset(i):keyOffset(i+1)] }
@@ -537,7 +872,7 @@ func (n node) setAt(start int, k uint64) {
 }
 
 func (n node) setNumKeys(num int) {
-	idx := valOffset(maxKeys)
+	idx := valOffset(n.maxKeys())
 	val := n[idx]
 	val &= 0xFFFFFFFF00000000
 	val |= uint64(num)
@@ -546,7 +881,7 @@ func (n node) setNumKeys(num int) {
 
 func (n node) moveRight(lo int) {
 	hi := n.numKeys()
-	assert(hi != maxKeys)
+	assert(hi != n.maxKeys())
 	// copy works despite of overlap in src and dst.
 	// See https://golang.org/pkg/builtin/#copy
 	copy(n[keyOffset(lo+1):keyOffset(hi+1)], n[keyOffset(lo):keyOffset(hi)])
@@ -557,14 +892,14 @@ const (
 )
 
 func (n node) setBit(b uint64) {
-	vo := valOffset(maxKeys)
+	vo := valOffset(n.maxKeys())
 	val := n[vo]
 	val &= 0xFFFFFFFF
 	val |= b
 	n[vo] = val
 }
 func (n node) bits() uint64 {
-	return n.val(maxKeys) & 0xFF00000000000000
+	return n.val(n.maxKeys()) & 0xFF00000000000000
 }
 func (n node) isLeaf() bool {
 	return n.bits()&bitLeaf > 0
@@ -572,7 +907,7 @@ func (n node) isLeaf() bool {
 
 // isFull checks that the node is already full.
 func (n node) isFull() bool {
-	return n.numKeys() == maxKeys
+	return n.numKeys() == n.maxKeys()
 }
 
 // Search returns the index of a smallest key >= k in a node.
@@ -648,6 +983,35 @@ func (n node) compact(lo uint64) int {
 	return left
 }
 
+// deleteRange removes all the kvs with key in [lo, hi] from the node. The max key is needed to route
+// lookups, so instead of removing it, its value is zeroed out. It returns the remaining number of
+// keys, or zero if the node only holds a zeroed out max key and can be dropped.
+func (n node) deleteRange(lo, hi uint64) int {
+	N := n.numKeys()
+	mk := n.maxKey()
+	var left, right int
+	for right = 0; right < N; right++ {
+		if k := n.key(right); k >= lo && k <= hi && k < mk {
+			// Skip over this key. Don't copy it.
+			continue
+		}
+		if left != right {
+			copy(n.data(left), n.data(right))
+		}
+		left++
+	}
+	zeroOut(n[keyOffset(left):keyOffset(right)])
+	n.setNumKeys(left)
+
+	if mk >= lo && mk <= hi {
+		n.setAt(valOffset(left-1), 0)
+	}
+	if left == 1 && n.key(0) == mk && n.val(0) == 0 {
+		return 0
+	}
+	return left
+}
+
 func (n node) get(k uint64) uint64 {
 	idx := n.search(k)
 	// key is not found
@@ -664,7 +1028,7 @@ func (n node) get(k uint64) uint64 {
 func (n node) set(k, v uint64) (numAdded int) {
 	idx := n.search(k)
 	ki := n.key(idx)
-	if n.numKeys() == maxKeys {
+	if n.numKeys() == n.maxKeys() {
 		// This happens during split of non-root node, when we are updating the child pointer of
 		// right node. Hence, the key should already exist.
 		assert(ki == k)
@@ -689,7 +1053,7 @@ func (n node) set(k, v uint64) (numAdded int) {
 }
 
 func (n node) iterate(fn func(node, int)) {
-	for i := 0; i < maxKeys; i++ {
+	for i := 0; i < n.maxKeys(); i++ {
 		if k := n.key(i); k > 0 {
 			fn(n, i)
 		} else {
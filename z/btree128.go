@@ -0,0 +1,351 @@
+/*
+ * Copyright 2024 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package z
+
+import (
+	"math"
+)
+
+// Key128 is a 128-bit key for Tree128. Keys are ordered by Hi, then by Lo.
+type Key128 struct {
+	Hi, Lo uint64
+}
+
+// Less returns true if k sorts before o.
+func (k Key128) Less(o Key128) bool {
+	return k.Hi < o.Hi || (k.Hi == o.Hi && k.Lo < o.Lo)
+}
+
+func (k Key128) isZero() bool { return k.Hi == 0 && k.Lo == 0 }
+
+var (
+	// absoluteMax128 acts as the rightmost key of Tree128, like absoluteMax does for Tree.
+	absoluteMax128 = Key128{Hi: math.MaxUint64, Lo: math.MaxUint64 - 1}
+	maxKey128      = Key128{Hi: math.MaxUint64, Lo: math.MaxUint64}
+)
+
+// Tree128 is the same B+ tree as Tree, but with 128-bit keys. It supports keys in range
+// [{0, 1}, {MaxUint64, MaxUint64-1}] and values [1, math.Uint64].
+type Tree128 struct {
+	treePages
+	stats TreeStats
+}
+
+// NewTree128 returns an in-memory B+ tree with 128-bit keys, whose nodes are the size of an OS
+// page.
+func NewTree128(tag string) *Tree128 {
+	const defaultTag = "tree128"
+	if tag == "" {
+		tag = defaultTag
+	}
+	t := &Tree128{treePages: treePages{buffer: NewBuffer(minSize, tag), pageSize: pageSize}}
+	t.Reset()
+	return t
+}
+
+// NewTree128Persistent returns a persistent on-disk B+ tree with 128-bit keys. As for
+// NewTreePersistent, the file must be opened on a machine with the page size it was written with.
+func NewTree128Persistent(path string) (*Tree128, error) {
+	t := &Tree128{treePages: treePages{pageSize: pageSize}}
+	if err := t.openPages(path); err != nil {
+		return nil, err
+	}
+	// pageID can never be 0 if the tree has been initialized.
+	if t.node(1).pageID() == 0 {
+		t.nextPage = 1
+		t.initRootNode()
+		return t, nil
+	}
+	t.findNextPage()
+	t.iterate(t.node(1), func(n node128) {
+		if n.isLeaf() {
+			t.stats.NumLeafKeys += n.numKeys()
+		}
+	})
+	return t, nil
+}
+
+func (t *Tree128) initRootNode() {
+	// This is the root node.
+	t.newNode(0)
+	// This acts as the rightmost pointer (all the keys are <= this key).
+	t.Set(absoluteMax128, 0)
+}
+
+// Reset resets the tree and truncates it to maxSz.
+func (t *Tree128) Reset() {
+	t.resetPages()
+	t.stats = TreeStats{}
+	t.initRootNode()
+}
+
+// Close releases the memory used by the tree.
+func (t *Tree128) Close() error {
+	if t == nil {
+		return nil
+	}
+	return t.buffer.Release()
+}
+
+// Stats returns stats about the tree.
+func (t *Tree128) Stats() TreeStats {
+	numPages := int(t.nextPage - 1)
+	out := TreeStats{
+		Bytes:       numPages * t.pageSize,
+		Allocated:   len(t.data),
+		NumLeafKeys: t.stats.NumLeafKeys,
+		NumPages:    numPages,
+		PageSize:    t.pageSize,
+	}
+	out.Occupancy = 100.0 * float64(out.NumLeafKeys) / float64(t.node(1).maxKeys()*numPages)
+	return out
+}
+
+func (t *Tree128) newNode(bit uint64) node128 {
+	pageId := t.allocPage()
+	n := t.node(pageId)
+	zeroOut(n)
+	n.setBit(bit)
+	n[len(n)-2] = pageId
+	return n
+}
+
+func (t *Tree128) node(pid uint64) node128 {
+	return node128(t.page(pid))
+}
+
+// Set sets the key-value pair in the tree.
+func (t *Tree128) Set(k Key128, v uint64) {
+	if k == maxKey128 || k.isZero() {
+		panic("Error setting zero or max key")
+	}
+	root := t.set(1, k, v)
+	if root.isFull() {
+		right := t.split(1)
+		left := t.newNode(root.bits())
+		// Re-read the root as the underlying buffer for tree might have changed during split.
+		root = t.node(1)
+		N := root.maxKeys()
+		copy(left[:keyOffset128(N)], root)
+		left.setNumKeys(root.numKeys())
+
+		// reset the root node.
+		zeroOut(root[:keyOffset128(N)])
+		root.setNumKeys(0)
+
+		// set the pointers for left and right child in the root node.
+		root.set(left.maxKey(), left.pageID())
+		root.set(right.maxKey(), right.pageID())
+	}
+}
+
+// For internal nodes, they contain <key, ptr>.
+// where all entries <= key are stored in the corresponding ptr.
+func (t *Tree128) set(pid uint64, k Key128, v uint64) node128 {
+	n := t.node(pid)
+	if n.isLeaf() {
+		t.stats.NumLeafKeys += n.set(k, v)
+		return n
+	}
+
+	// This is an internal node.
+	idx := n.search(k)
+	if idx >= n.maxKeys() {
+		panic("search returned index >= maxKeys")
+	}
+	// If no key at idx.
+	if n.key(idx).isZero() {
+		n.setKey(idx, k)
+		n.setNumKeys(n.numKeys() + 1)
+	}
+	child := t.node(n.val(idx))
+	if child == nil {
+		child = t.newNode(bitLeaf)
+		n = t.node(pid)
+		n.setVal(idx, child.pageID())
+	}
+	child = t.set(child.pageID(), k, v)
+	// Re-read n as the underlying buffer for tree might have changed during set.
+	n = t.node(pid)
+	if child.isFull() {
+		nn := t.split(child.pageID())
+		// Re-read n and child as the underlying buffer for tree might have changed during split.
+		n = t.node(pid)
+		child = t.node(n.val(idx))
+		// Set child pointers in the node n.
+		// Note that key for right node (nn) already exist in node n, but the
+		// pointer is updated.
+		n.set(child.maxKey(), child.pageID())
+		n.set(nn.maxKey(), nn.pageID())
+	}
+	return n
+}
+
+func (t *Tree128) split(pid uint64) node128 {
+	n := t.node(pid)
+	if !n.isFull() {
+		panic("This should be called only when n is full")
+	}
+
+	// Create a new node nn, copy over half the keys from n.
+	nn := t.newNode(n.bits())
+	// Re-read n as the underlying buffer for tree might have changed during newNode.
+	n = t.node(pid)
+	N := n.maxKeys()
+	rightHalf := n[keyOffset128(N/2):keyOffset128(N)]
+	copy(nn, rightHalf)
+	nn.setNumKeys(N - N/2)
+
+	// Remove entries from node n.
+	zeroOut(rightHalf)
+	n.setNumKeys(N / 2)
+	return nn
+}
+
+// Get looks for key and returns the corresponding value.
+// If key is not found, 0 is returned.
+func (t *Tree128) Get(k Key128) uint64 {
+	if k == maxKey128 || k.isZero() {
+		panic("Does not support getting zero or max key")
+	}
+	n := t.node(1)
+	for !n.isLeaf() {
+		idx := n.search(k)
+		if idx == n.numKeys() || n.key(idx).isZero() {
+			return 0
+		}
+		n = t.node(n.val(idx))
+		assert(n != nil)
+	}
+	idx := n.search(k)
+	if idx == n.numKeys() || n.key(idx) != k {
+		return 0
+	}
+	return n.val(idx)
+}
+
+// IterateKV iterates through all keys and values in the tree, in key order.
+// If newVal is non-zero, it will be set in the tree.
+func (t *Tree128) IterateKV(f func(key Key128, val uint64) (newVal uint64)) {
+	t.iterate(t.node(1), func(n node128) {
+		// Only leaf nodes contain keys.
+		if !n.isLeaf() {
+			return
+		}
+		for i := 0; i < n.numKeys(); i++ {
+			val := n.val(i)
+			// A zero value here means that this is a bogus entry.
+			if val == 0 {
+				continue
+			}
+			if newVal := f(n.key(i), val); newVal != 0 {
+				n.setVal(i, newVal)
+			}
+		}
+	})
+}
+
+func (t *Tree128) iterate(n node128, fn func(node128)) {
+	fn(n)
+	if n.isLeaf() {
+		return
+	}
+	// Explore children.
+	for i := 0; i < n.numKeys(); i++ {
+		childID := n.val(i)
+		assert(childID > 0)
+		t.iterate(t.node(childID), fn)
+	}
+}
+
+// node128 is laid out like node, but holds <key hi, key lo, value> triples. The last 16 bytes hold
+// the pageID and the meta bits and number of keys, in the same format as node.
+type node128 []uint64
+
+func keyOffset128(i int) int { return 3 * i }
+
+func (n node128) maxKeys() int   { return (len(n) - 2) / 3 }
+func (n node128) numKeys() int   { return int(n[len(n)-1] & 0xFFFFFFFF) }
+func (n node128) pageID() uint64 { return n[len(n)-2] }
+func (n node128) key(i int) Key128 {
+	return Key128{Hi: n[keyOffset128(i)], Lo: n[keyOffset128(i)+1]}
+}
+func (n node128) val(i int) uint64 { return n[keyOffset128(i)+2] }
+func (n node128) setKey(i int, k Key128) {
+	n[keyOffset128(i)] = k.Hi
+	n[keyOffset128(i)+1] = k.Lo
+}
+func (n node128) setVal(i int, v uint64) { n[keyOffset128(i)+2] = v }
+
+func (n node128) setNumKeys(num int) {
+	val := n[len(n)-1]
+	val &= 0xFFFFFFFF00000000
+	val |= uint64(num)
+	n[len(n)-1] = val
+}
+
+func (n node128) setBit(b uint64) {
+	val := n[len(n)-1]
+	val &= 0xFFFFFFFF
+	val |= b
+	n[len(n)-1] = val
+}
+func (n node128) bits() uint64 { return n[len(n)-1] & 0xFF00000000000000 }
+func (n node128) isLeaf() bool { return n.bits()&bitLeaf > 0 }
+func (n node128) isFull() bool { return n.numKeys() == n.maxKeys() }
+
+func (n node128) maxKey() Key128 {
+	idx := n.numKeys()
+	// idx points to the first key which is zero.
+	if idx > 0 {
+		idx--
+	}
+	return n.key(idx)
+}
+
+// search returns the index of a smallest key >= k in a node.
+func (n node128) search(k Key128) int {
+	lo, hi := 0, n.numKeys()
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if n.key(mid).Less(k) {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo
+}
+
+// set returns 1 if it added a new key.
+func (n node128) set(k Key128, v uint64) (numAdded int) {
+	idx := n.search(k)
+	N := n.numKeys()
+	if idx < N && n.key(idx) == k {
+		n.setVal(idx, v)
+		return 0
+	}
+	// This happens during split of non-root node, when we are updating the child pointer of
+	// right node. Hence, the key should already exist.
+	assert(N < n.maxKeys())
+	// Move the rest of the data in the node to the right to make space for k.
+	copy(n[keyOffset128(idx+1):keyOffset128(N+1)], n[keyOffset128(idx):keyOffset128(N)])
+	n.setKey(idx, k)
+	n.setVal(idx, v)
+	n.setNumKeys(N + 1)
+	return 1
+}
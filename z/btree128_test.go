@@ -0,0 +1,91 @@
+/*
+ * Copyright 2024 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package z
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTree128(t *testing.T) {
+	setAndGet := func() {
+		bt := NewTree128("TestTree128")
+		defer func() { require.NoError(t, bt.Close()) }()
+
+		mp := make(map[Key128]uint64)
+		for i := 0; i < 1<<16; i++ {
+			// Share the high word between many keys, like UUIDs with a common prefix would.
+			key := Key128{Hi: uint64(rand.Intn(16)), Lo: uint64(rand.Int63n(1<<60) + 1)}
+			val := uint64(i + 1)
+			bt.Set(key, val)
+			mp[key] = val
+		}
+		for k, v := range mp {
+			require.Equal(t, v, bt.Get(k))
+		}
+		require.Zero(t, bt.Get(Key128{Hi: 100, Lo: 1}))
+		require.Equal(t, len(mp), bt.Stats().NumLeafKeys-1)
+
+		var last Key128
+		var count int
+		bt.IterateKV(func(key Key128, val uint64) uint64 {
+			require.True(t, last.Less(key))
+			require.Equal(t, mp[key], val)
+			last = key
+			count++
+			return 0
+		})
+		require.Equal(t, len(mp), count)
+	}
+	setAndGet()
+	defer setPageSize(os.Getpagesize())
+	setPageSize(16 << 5)
+	setAndGet()
+}
+
+func TestTree128Persistent(t *testing.T) {
+	dir, err := os.MkdirTemp("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tree128.buf")
+
+	bt1, err := NewTree128Persistent(path)
+	require.NoError(t, err)
+	N := uint64(32 << 10)
+	for i := uint64(1); i < N; i++ {
+		bt1.Set(Key128{Hi: i % 7, Lo: i}, i*2)
+	}
+	bt1Stats := bt1.Stats()
+	require.NoError(t, bt1.Close())
+
+	// Reopen tree and validate the data.
+	bt2, err := NewTree128Persistent(path)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, bt2.Close()) }()
+	require.Equal(t, bt1.nextPage, bt2.nextPage)
+	bt2Stats := bt2.Stats()
+	// When reopening a tree, the allocated size becomes the file size.
+	bt2Stats.Allocated = bt1Stats.Allocated
+	require.Equal(t, bt1Stats, bt2Stats)
+	for i := uint64(1); i < N; i++ {
+		require.Equal(t, i*2, bt2.Get(Key128{Hi: i % 7, Lo: i}))
+	}
+}
@@ -60,6 +60,36 @@ func TestTree(t *testing.T) {
 	}
 }
 
+func TestTreeWithPageSize(t *testing.T) {
+	require.Panics(t, func() { NewTreeWithPageSize("", 64) })
+	require.Panics(t, func() { NewTreeWithPageSize("", 100) })
+
+	for _, sz := range []int{80, 16 << 5, 64 << 10} {
+		bt := NewTreeWithPageSize("TestTreeWithPageSize", sz)
+		N := uint64(64 << 10)
+		for i := uint64(1); i < N; i++ {
+			bt.Set(i, i)
+		}
+		bt.DeleteBelow(N / 2)
+		for i := N / 2; i < N; i++ {
+			require.Equal(t, i, bt.Get(i))
+		}
+		stats := bt.Stats()
+		require.Equal(t, sz, stats.PageSize)
+		require.Equal(t, stats.NumPages*sz, stats.Bytes)
+
+		clone, err := bt.Clone(filepath.Join(t.TempDir(), "clone.buf"))
+		require.NoError(t, err)
+		require.NoError(t, bt.Compact())
+		for i := N / 2; i < N; i++ {
+			require.Equal(t, i, bt.Get(i))
+			require.Equal(t, i, clone.Get(i))
+		}
+		require.NoError(t, clone.Close())
+		require.NoError(t, bt.Close())
+	}
+}
+
 func TestTreePersistent(t *testing.T) {
 	dir, err := os.MkdirTemp("", "")
 	require.NoError(t, err)
@@ -108,6 +138,164 @@ func TestTreePersistent(t *testing.T) {
 	require.NoError(t, bt3.Close())
 }
 
+func TestTreeDeleteRange(t *testing.T) {
+	deleteRange := func() {
+		bt := NewTree("TestTreeDeleteRange")
+		defer func() { require.NoError(t, bt.Close()) }()
+
+		N := uint64(64 << 10)
+		for i := uint64(1); i < N; i++ {
+			bt.Set(i, i)
+		}
+		lo, hi := uint64(100), uint64(50000)
+		bt.DeleteRange(lo, hi)
+		for i := uint64(1); i < N; i++ {
+			if i >= lo && i <= hi {
+				require.Zero(t, bt.Get(i), "key %d", i)
+			} else {
+				require.Equal(t, i, bt.Get(i), "key %d", i)
+			}
+		}
+		stats := bt.Stats()
+		require.NotZero(t, stats.NumPagesFree)
+
+		var numKeys int
+		bt.IterateKV(func(key, val uint64) uint64 {
+			require.True(t, key < lo || key > hi)
+			numKeys++
+			return 0
+		})
+		require.Equal(t, int(N-1-(hi-lo+1)), numKeys)
+
+		// The freed pages get reused.
+		for i := lo; i <= hi; i++ {
+			bt.Set(i, i)
+		}
+		require.Less(t, bt.Stats().NumPagesFree, stats.NumPagesFree)
+		for i := uint64(1); i < N; i++ {
+			require.Equal(t, i, bt.Get(i), "key %d", i)
+		}
+
+		bt.DeleteRange(10, 5)
+		require.Equal(t, uint64(10), bt.Get(10))
+	}
+	deleteRange()
+	defer setPageSize(os.Getpagesize())
+	setPageSize(16 << 5)
+	deleteRange()
+}
+
+func TestTreeClone(t *testing.T) {
+	dir, err := os.MkdirTemp("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	bt := NewTree("TestTreeClone")
+	defer func() { require.NoError(t, bt.Close()) }()
+	N := uint64(64 << 10)
+	for i := uint64(1); i < N; i++ {
+		bt.Set(i, i*2)
+	}
+	bt.DeleteBelow(N)
+
+	clone, err := bt.Clone(filepath.Join(dir, "clone.buf"))
+	require.NoError(t, err)
+	defer func() { require.NoError(t, clone.Close()) }()
+	require.Equal(t, bt.freePage, clone.freePage)
+	require.Equal(t, bt.nextPage, clone.nextPage)
+	for i := uint64(1); i < N; i++ {
+		require.Equal(t, bt.Get(i), clone.Get(i))
+	}
+
+	// Writes to either tree are not seen by the other.
+	bt.Set(N, 1)
+	clone.Set(N+1, 1)
+	require.Zero(t, clone.Get(N))
+	require.Zero(t, bt.Get(N+1))
+}
+
+func TestTreeCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree.buf")
+	persistent, err := NewTreePersistent(path)
+	require.NoError(t, err)
+	trees := []*Tree{NewTree("TestTreeCompact"), persistent}
+
+	const N = uint64(256 << 10)
+	for _, bt := range trees {
+		for i := uint64(1); i <= N; i++ {
+			bt.Set(i, i)
+		}
+		// Only keep the keys with the largest values.
+		bt.DeleteBelow(N - 999)
+		want := make([]uint64, N+1)
+		for i := uint64(1); i <= N; i++ {
+			want[i] = bt.Get(i)
+		}
+		before := bt.Stats()
+		require.NoError(t, bt.Compact())
+		after := bt.Stats()
+		require.Zero(t, after.NumPagesFree)
+		require.Less(t, after.Allocated, before.Allocated)
+
+		for i := uint64(1); i <= N; i++ {
+			require.Equal(t, want[i], bt.Get(i), "key %d", i)
+		}
+		// The tree is still usable.
+		bt.Set(N+1, 1)
+		require.Equal(t, uint64(1), bt.Get(N+1))
+	}
+	require.NoError(t, trees[0].Close())
+
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, int64(persistent.buffer.offset), fi.Size())
+	require.NoError(t, persistent.Close())
+
+	reopened, err := NewTreePersistent(path)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, reopened.Close()) }()
+	for i := N - 999; i <= N+1; i++ {
+		require.NotZero(t, reopened.Get(i), "key %d", i)
+	}
+}
+
+func TestTreePrefault(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree.buf")
+	persistent, err := NewTreePersistent(path)
+	require.NoError(t, err)
+	for _, bt := range []*Tree{NewTree("TestTreePrefault"), persistent} {
+		for i := uint64(1); i <= 10000; i++ {
+			bt.Set(i, i)
+		}
+		require.NoError(t, bt.Prefault())
+		require.Equal(t, uint64(5000), bt.Get(5000))
+		require.NoError(t, bt.Close())
+	}
+}
+
+func TestTreeMarshal(t *testing.T) {
+	bt := NewTree("TestTreeMarshal")
+	defer func() { require.NoError(t, bt.Close()) }()
+	for i := uint64(1); i <= 10000; i++ {
+		bt.Set(i*3, i)
+	}
+	bt.DeleteBelow(3000)
+
+	b := NewBuffer(1<<10, "TestTreeMarshal")
+	defer func() { require.NoError(t, b.Release()) }()
+	bt.Marshal(b)
+	require.Equal(t, 0, b.LenNoPadding()%16)
+
+	nt := UnmarshalTree(b)
+	defer func() { require.NoError(t, nt.Close()) }()
+	for i := uint64(1); i <= 30010; i++ {
+		require.Equal(t, bt.Get(i), nt.Get(i), "key: %d", i)
+	}
+
+	b.WriteByte(1)
+	require.Panics(t, func() { UnmarshalTree(b) })
+}
+
 func TestTreeBasic(t *testing.T) {
 	setAndGet := func() {
 		bt := NewTree("TestTreeBasic")
@@ -219,6 +407,67 @@ func TestTreeIterateKV(t *testing.T) {
 	require.Equal(t, n, count)
 }
 
+func TestTreeGetBatch(t *testing.T) {
+	bt := NewTree("TestTreeGetBatch")
+	defer func() { require.NoError(t, bt.Close()) }()
+
+	N := uint64(1 << 16)
+	for i := uint64(1); i < N; i += 2 {
+		bt.Set(i, i*10)
+	}
+	keys := make([]uint64, 0, N)
+	for i := uint64(1); i < N+100; i++ {
+		keys = append(keys, i)
+	}
+	vals := bt.GetBatch(keys)
+	require.Len(t, vals, len(keys))
+	for i, k := range keys {
+		require.Equal(t, bt.Get(k), vals[i], "key %d", k)
+	}
+	require.Empty(t, bt.GetBatch(nil))
+}
+
+func TestTreeIterator(t *testing.T) {
+	bt := NewTree("TestTreeIterator")
+	defer func() { require.NoError(t, bt.Close()) }()
+
+	N := uint64(1 << 16)
+	for i := uint64(2); i <= N; i += 2 {
+		bt.Set(i, i*10)
+	}
+	bt.DeleteRange(1000, 3000)
+
+	it := bt.Iterator()
+	var want []uint64
+	bt.IterateKV(func(k, v uint64) uint64 {
+		want = append(want, k)
+		return 0
+	})
+	var got []uint64
+	for k, v, ok := it.Next(); ok; k, v, ok = it.Next() {
+		require.Equal(t, k*10, v)
+		got = append(got, k)
+	}
+	require.Equal(t, want, got)
+
+	it.Seek(999)
+	k, _, ok := it.Next()
+	require.True(t, ok)
+	require.Equal(t, uint64(3002), k)
+
+	it.Seek(4001)
+	k, _, ok = it.Next()
+	require.True(t, ok)
+	require.Equal(t, uint64(4002), k)
+	k, _, ok = it.Next()
+	require.True(t, ok)
+	require.Equal(t, uint64(4004), k)
+
+	it.Seek(N + 1)
+	_, _, ok = it.Next()
+	require.False(t, ok)
+}
+
 func TestOccupancyRatio(t *testing.T) {
 	// atmax 4 keys per node
 	setPageSize(16 * 5)
@@ -19,10 +19,12 @@ package z
 import (
 	"encoding/binary"
 	"fmt"
-	"log"
+	"io"
+	"math/bits"
 	"os"
 	"sort"
 	"sync/atomic"
+	"unsafe"
 
 	"github.com/pkg/errors"
 )
@@ -53,6 +55,8 @@ type Buffer struct {
 	autoMmapDir   string     // directory for autoMmap to create a tempfile in
 	persistent    bool       // when enabled, Release will not delete the underlying mmap file
 	tag           string     // used for jemalloc stats
+	growthFactor  float64    // capacity multiplier on Grow, 2 if zero
+	numSlices     int        // number of slices allocated since the last Reset
 }
 
 func NewBuffer(capacity int, tag string) *Buffer {
@@ -143,6 +147,17 @@ func (b *Buffer) WithMaxSize(size int) *Buffer {
 	return b
 }
 
+// WithGrowthFactor sets the factor by which Grow multiplies the capacity of the buffer, which
+// defaults to 2. A smaller factor wastes less memory, a larger one reallocates less often. The
+// factor must be at least 1; with 1, the buffer grows by exactly what is needed.
+func (b *Buffer) WithGrowthFactor(f float64) *Buffer {
+	if f < 1 {
+		panic(fmt.Sprintf("z.Buffer growth factor must be at least 1, got: %v", f))
+	}
+	b.growthFactor = f
+	return b
+}
+
 func (b *Buffer) IsEmpty() bool {
 	return int(b.offset) == b.StartOffset()
 }
@@ -184,6 +199,9 @@ func (b *Buffer) Grow(n int) {
 
 	// Calculate new capacity.
 	growBy := b.curSz + n
+	if b.growthFactor > 0 {
+		growBy = int(float64(b.curSz)*(b.growthFactor-1)) + n
+	}
 	// Don't allocate more than 1GB at a time.
 	if growBy > 1<<30 {
 		growBy = 1 << 30
@@ -264,9 +282,41 @@ func (b *Buffer) writeLen(sz int) {
 func (b *Buffer) SliceAllocate(sz int) []byte {
 	b.Grow(8 + sz)
 	b.writeLen(sz)
+	b.numSlices++
 	return b.Allocate(sz)
 }
 
+// SliceAllocateAligned works like SliceAllocate, but the returned slice starts at an address which
+// is a multiple of align, so that it can be cast to a struct. align must be a power of two, up to
+// 64KiB. The slice is preceded by up to align-1 padding bytes, whose number is recorded along with
+// its length, so that SliceIterate and Slice skip them. As with Allocator.AllocateAligned, the
+// alignment only holds until the buffer grows again.
+func (b *Buffer) SliceAllocateAligned(sz, align int) []byte {
+	assert(align > 0 && align&(align-1) == 0 && align <= 1<<(64-slicePadShift))
+	b.Grow(8 + sz + align - 1)
+	addr := uintptr(unsafe.Pointer(&b.buf[0])) + uintptr(b.offset) + 8
+	pad := int(-addr & uintptr(align-1))
+	out := b.SliceAllocate(pad + sz)
+	ZeroOut(out, 0, pad)
+	lenOffset := int(b.offset) - len(out) - 8
+	binary.BigEndian.PutUint64(b.buf[lenOffset:], uint64(pad+sz)|uint64(pad)<<slicePadShift)
+	return out[pad:]
+}
+
+// The length written before a slice holds, in its top bits, the number of padding bytes
+// SliceAllocateAligned put at the start of the slice.
+const (
+	slicePadShift = 48
+	sliceLenMask  = 1<<slicePadShift - 1
+)
+
+// sliceLen decodes the length written before a slice into the size of the slice, padding
+// included, and the size of the padding.
+func sliceLen(buf []byte) (sz, pad uint64) {
+	v := binary.BigEndian.Uint64(buf)
+	return v & sliceLenMask, v >> slicePadShift
+}
+
 func (b *Buffer) StartOffset() int {
 	return int(b.padding)
 }
@@ -276,6 +326,9 @@ func (b *Buffer) WriteSlice(slice []byte) {
 	assert(len(slice) == copy(dst, slice))
 }
 
+// SliceIterate calls f on every non-empty slice written via SliceAllocate or
+// WriteSlice, in the order they were written. Iteration stops at the first
+// error returned by f, and that error is returned.
 func (b *Buffer) SliceIterate(f func(slice []byte) error) error {
 	if b.IsEmpty() {
 		return nil
@@ -283,8 +336,11 @@ func (b *Buffer) SliceIterate(f func(slice []byte) error) error {
 
 	next := b.StartOffset()
 	var slice []byte
+	var err error
 	for next >= 0 {
-		slice, next = b.Slice(next)
+		if slice, next, err = b.SliceChecked(next); err != nil {
+			return err
+		}
 		if len(slice) == 0 {
 			continue
 		}
@@ -296,6 +352,49 @@ func (b *Buffer) SliceIterate(f func(slice []byte) error) error {
 	return nil
 }
 
+// SliceIterateReverse is like SliceIterate, but calls f on the slices in the reverse order they
+// were written, newest first. As slices can only be walked forward, it first collects the offsets
+// of all the slices.
+func (b *Buffer) SliceIterateReverse(f func(slice []byte) error) error {
+	if b.IsEmpty() {
+		return nil
+	}
+
+	offsets := b.SliceOffsets()
+	for i := len(offsets) - 1; i >= 0; i-- {
+		slice, _ := b.Slice(offsets[i])
+		if len(slice) == 0 {
+			continue
+		}
+		if err := f(slice); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NumSlices returns the number of slices written via SliceAllocate or WriteSlice since the buffer
+// was created or last Reset, including empty ones. Unlike SliceCount, it doesn't read the buffer, so
+// it doesn't know about slices the buffer was created with, e.g. by NewBufferSlice or
+// NewBufferPersistent; use SliceCount for those.
+func (b *Buffer) NumSlices() int {
+	return b.numSlices
+}
+
+// SliceCount returns the number of slices written via SliceAllocate or
+// WriteSlice, including empty ones. It only reads the length prefixes, without
+// touching the slice contents.
+func (b *Buffer) SliceCount() int {
+	if b.IsEmpty() {
+		return 0
+	}
+	var count int
+	for next := b.StartOffset(); next >= 0; count++ {
+		_, next = b.Slice(next)
+	}
+	return count
+}
+
 const (
 	UseCalloc BufferType = iota
 	UseMmap
@@ -346,14 +445,16 @@ func (s *sortHelper) sortSmall(start, end int) {
 	assert(end-start == copy(s.b.buf[start:end], s.tmp.Bytes()))
 }
 
+// assert and check panic, rather than exit the process, so that programs embedding this package can
+// recover and report the failure the way they see fit.
 func assert(b bool) {
 	if !b {
-		log.Fatalf("%+v", errors.Errorf("Assertion failure"))
+		panic(errors.Errorf("Assertion failure"))
 	}
 }
 func check(err error) {
 	if err != nil {
-		log.Fatalf("%+v", err)
+		panic(errors.WithStack(err))
 	}
 }
 func check2(_ interface{}, err error) {
@@ -393,8 +494,9 @@ func (s *sortHelper) merge(left, right []byte, start, end int) {
 		ls = rawSlice(left)
 		rs = rawSlice(right)
 
-		// We skip the first 4 bytes in the rawSlice, because that stores the length.
-		if s.less(ls[8:], rs[8:]) {
+		// We skip the first 8 bytes in the rawSlice, because that stores the length, and the
+		// padding after them.
+		if s.less(sliceData(ls), sliceData(rs)) {
 			copyLeft()
 		} else {
 			copyRight()
@@ -467,26 +569,59 @@ func (b *Buffer) SortSliceBetween(start, end int, less LessFunc) {
 }
 
 func rawSlice(buf []byte) []byte {
-	sz := binary.BigEndian.Uint64(buf)
+	sz, _ := sliceLen(buf)
 	return buf[:8+int(sz)]
 }
 
+// sliceData returns the slice held by a rawSlice, without its length and padding.
+func sliceData(raw []byte) []byte {
+	_, pad := sliceLen(raw)
+	return raw[8+int(pad):]
+}
+
 // Slice would return the slice written at offset.
 func (b *Buffer) Slice(offset int) ([]byte, int) {
 	if offset >= int(b.offset) {
 		return nil, -1
 	}
 
-	sz := binary.BigEndian.Uint64(b.buf[offset:])
+	sz, pad := sliceLen(b.buf[offset:])
 	start := offset + 8
 	next := start + int(sz)
-	res := b.buf[start:next]
+	res := b.buf[start+int(pad) : next]
 	if next >= int(b.offset) {
 		next = -1
 	}
 	return res, next
 }
 
+// SliceChecked is like Slice, but it validates offset and the length written at it, and returns an
+// error instead of panicking or returning garbage if they don't fall within the written bytes, e.g.
+// for a buffer backed by a truncated or corrupted file.
+func (b *Buffer) SliceChecked(offset int) ([]byte, int, error) {
+	end := int(b.offset)
+	if offset < b.StartOffset() || offset > end-8 {
+		return nil, -1, errors.Errorf("slice offset %d out of range [%d, %d)", offset,
+			b.StartOffset(), end)
+	}
+	sz, pad := sliceLen(b.buf[offset:])
+	start := offset + 8
+	if sz > uint64(end-start) {
+		return nil, -1, errors.Errorf("slice of %d bytes at offset %d overruns buffer of %d bytes",
+			sz, offset, end)
+	}
+	if pad > sz {
+		return nil, -1, errors.Errorf("slice of %d bytes at offset %d has %d bytes of padding",
+			sz, offset, pad)
+	}
+	next := start + int(sz)
+	res := b.buf[start+int(pad) : next]
+	if next >= end {
+		next = -1
+	}
+	return res, next, nil
+}
+
 // SliceOffsets is an expensive function. Use sparingly.
 func (b *Buffer) SliceOffsets() []int {
 	next := b.StartOffset()
@@ -514,9 +649,77 @@ func (b *Buffer) Write(p []byte) (n int, err error) {
 	return n, nil
 }
 
+// WriteAt overwrites the bytes at offset off with p, e.g. to fill in a header whose space was
+// reserved with AllocateOffset, whose offsets it takes. The whole range must have been written
+// already: WriteAt never grows the buffer, and returns an error instead, writing nothing. Unlike
+// io.WriterAt, it takes an int offset.
+func (b *Buffer) WriteAt(p []byte, off int) (int, error) {
+	end := int(b.offset)
+	if off < b.StartOffset() || off > end || len(p) > end-off {
+		return 0, errors.Errorf("write of %d bytes at offset %d out of range [%d, %d)", len(p), off,
+			b.StartOffset(), end)
+	}
+	return copy(b.buf[off:], p), nil
+}
+
+// WriteByte would write a single byte to the buffer. It implements io.ByteWriter and never returns
+// an error.
+func (b *Buffer) WriteByte(c byte) error {
+	b.Grow(1)
+	b.buf[b.offset] = c
+	b.offset++
+	return nil
+}
+
+// WriteString would write the contents of s to the buffer, without converting it to a byte slice
+// first. It implements io.StringWriter.
+func (b *Buffer) WriteString(s string) (n int, err error) {
+	n = len(s)
+	b.Grow(n)
+	assert(n == copy(b.buf[b.offset:], s))
+	b.offset += uint64(n)
+	return n, nil
+}
+
+// writeToChunkSize is the size of the chunks in which WriteTo writes mmap buffers.
+const writeToChunkSize = 4 << 20
+
+// WriteTo would write all the written bytes, as returned by Bytes, to w. It implements io.WriterTo.
+// Mmap buffers are written in chunks, so that the pages of the mapping are faulted in as they are
+// written, rather than all at once.
+func (b *Buffer) WriteTo(w io.Writer) (int64, error) {
+	data := b.Bytes()
+	chunk := len(data)
+	if b.bufType == UseMmap {
+		chunk = writeToChunkSize
+	}
+	var written int64
+	for len(data) > 0 {
+		sz := min(chunk, len(data))
+		n, err := w.Write(data[:sz])
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+		if n < sz {
+			return written, io.ErrShortWrite
+		}
+		data = data[sz:]
+	}
+	return written, nil
+}
+
 // Reset would reset the buffer to be reused.
 func (b *Buffer) Reset() {
 	b.offset = uint64(b.StartOffset())
+	b.numSlices = 0
+}
+
+// ResetZero would reset the buffer to be reused, like Reset, after zeroing out all the bytes written
+// so far. Use it for buffers which held sensitive data, so that it doesn't linger in memory.
+func (b *Buffer) ResetZero() {
+	Memclr(b.buf[:b.offset])
+	b.Reset()
 }
 
 // Release would free up the memory allocated by the buffer. Once the usage of buffer is done, it is
@@ -544,3 +747,67 @@ func (b *Buffer) Release() error {
 	}
 	return nil
 }
+
+const (
+	// numBufferClasses is the number of size classes kept by the buffer pool. Class i holds buffers
+	// with a capacity of at least defaultCapacity << i, so the largest pooled buffers are 4MB.
+	numBufferClasses = 17
+	// bufferClassSize is the number of buffers kept per size class.
+	bufferClassSize = 8
+)
+
+// bufferPool holds released buffers by size class. Using bounded channels, rather than a sync.Pool,
+// ensures Calloc-ed memory is always freed, instead of being dropped by GC.
+var bufferPool [numBufferClasses]chan *Buffer
+
+func init() {
+	for i := range bufferPool {
+		bufferPool[i] = make(chan *Buffer, bufferClassSize)
+	}
+}
+
+// GetBufferFromPool returns an empty Calloc based Buffer with a capacity of at least sz, reusing one
+// given back via ReturnBuffer if possible. Once done with it, give it back with ReturnBuffer.
+func GetBufferFromPool(sz int) *Buffer {
+	class := 0
+	if sz > defaultCapacity {
+		// Round up to the class that fits sz.
+		class = bits.Len64(uint64(sz-1) / defaultCapacity)
+	}
+	if class >= numBufferClasses {
+		return NewBuffer(sz, "pool")
+	}
+	select {
+	case b := <-bufferPool[class]:
+		return b
+	default:
+		return NewBuffer(defaultCapacity<<class, "pool")
+	}
+}
+
+// ReturnBuffer gives a buffer back to the pool used by GetBufferFromPool. Buffers which are mmap-ed,
+// too big to be pooled or which don't fit in the pool are released. b must not be used afterwards.
+func ReturnBuffer(b *Buffer) {
+	if b == nil {
+		return
+	}
+	if b.bufType != UseCalloc || b.curSz < defaultCapacity {
+		_ = b.Release()
+		return
+	}
+	// Round down to the class that b fits in.
+	class := bits.Len64(uint64(b.curSz)/defaultCapacity) - 1
+	if class >= numBufferClasses {
+		_ = b.Release()
+		return
+	}
+	b.Reset()
+	b.maxSz = 0
+	b.autoMmapAfter = 0
+	b.growthFactor = 0
+	select {
+	case bufferPool[class] <- b:
+	default:
+		_ = b.Release()
+	}
+}
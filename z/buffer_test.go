@@ -20,10 +20,14 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"math/rand"
 	"sort"
+	"strings"
 	"testing"
+	"unsafe"
 
 	"github.com/stretchr/testify/require"
 )
@@ -86,6 +90,129 @@ func TestBufferWrite(t *testing.T) {
 	}
 }
 
+func TestBufferSliceAllocateAligned(t *testing.T) {
+	buffers := newTestBuffers(t, 32)
+
+	for _, buf := range buffers {
+		name := fmt.Sprintf("Using buffer type: %s", buf.bufType)
+		t.Run(name, func(t *testing.T) {
+			buf.WriteSlice([]byte("abc"))
+			for _, align := range []int{1, 8, 16, 64} {
+				out := buf.SliceAllocateAligned(24, align)
+				require.Len(t, out, 24)
+				require.Zero(t, uintptr(unsafe.Pointer(&out[0]))%uintptr(align))
+				copy(out, "aligned")
+			}
+			require.Equal(t, 5, buf.SliceCount())
+
+			// The padding isn't part of the slices read back.
+			var slices []string
+			require.NoError(t, buf.SliceIterate(func(slice []byte) error {
+				slices = append(slices, string(slice[:min(len(slice), 7)]))
+				if len(slices) > 1 {
+					require.Len(t, slice, 24)
+				}
+				return nil
+			}))
+			require.Equal(t, []string{"abc", "aligned", "aligned", "aligned", "aligned"}, slices)
+			_, next := buf.Slice(buf.StartOffset())
+			_, _, err := buf.SliceChecked(next)
+			require.NoError(t, err)
+			require.Panics(t, func() { buf.SliceAllocateAligned(8, 3) })
+		})
+	}
+}
+
+func TestBufferWriteByteString(t *testing.T) {
+	buffers := newTestBuffers(t, 4)
+
+	for _, buf := range buffers {
+		name := fmt.Sprintf("Using buffer type: %s", buf.bufType)
+		t.Run(name, func(t *testing.T) {
+			bytesBuf := new(bytes.Buffer)
+			for i := 0; i < 100; i++ {
+				require.NoError(t, buf.WriteByte(byte(i)))
+				bytesBuf.WriteByte(byte(i))
+
+				s := strings.Repeat("x", i%7)
+				n, err := buf.WriteString(s)
+				require.NoError(t, err)
+				require.Equal(t, len(s), n)
+				bytesBuf.WriteString(s)
+			}
+			require.Equal(t, bytesBuf.Bytes(), buf.Bytes())
+		})
+	}
+}
+
+func TestBufferGrowthFactor(t *testing.T) {
+	for _, tc := range []struct {
+		factor float64
+		want   int
+	}{
+		{0, 3},
+		{1, 2},
+		{2, 3},
+		{4, 5},
+	} {
+		buf := NewBuffer(defaultCapacity, "test")
+		if tc.factor > 0 {
+			buf.WithGrowthFactor(tc.factor)
+		}
+		sz := buf.curSz
+		buf.Grow(sz)
+		require.Equal(t, tc.want*sz, buf.curSz, "factor %v", tc.factor)
+		require.NoError(t, buf.Release())
+	}
+	buf := NewBuffer(defaultCapacity, "test")
+	require.Panics(t, func() { buf.WithGrowthFactor(0.5) })
+	require.NoError(t, buf.Release())
+}
+
+func TestBufferResetZero(t *testing.T) {
+	buffers := newTestBuffers(t, 32)
+
+	for _, buf := range buffers {
+		name := fmt.Sprintf("Using buffer type: %s", buf.bufType)
+		t.Run(name, func(t *testing.T) {
+			buf.WriteSlice([]byte("secret"))
+			end := int(buf.offset)
+			buf.ResetZero()
+			require.True(t, buf.IsEmpty())
+			require.Equal(t, make([]byte, end), buf.buf[:end])
+		})
+	}
+}
+
+func TestBufferPool(t *testing.T) {
+	b := GetBufferFromPool(100)
+	require.GreaterOrEqual(t, b.curSz, 100)
+	require.True(t, b.IsEmpty())
+	b.WriteSlice([]byte("hello"))
+	ReturnBuffer(b)
+
+	// The same buffer is handed out again, empty, for any size it fits.
+	b2 := GetBufferFromPool(128)
+	require.Same(t, b, b2)
+	require.True(t, b2.IsEmpty())
+	b3 := GetBufferFromPool(128)
+	require.NotSame(t, b2, b3)
+	ReturnBuffer(b2)
+	ReturnBuffer(b3)
+
+	// Buffers too big to be pooled are simply released.
+	big := GetBufferFromPool(64 << 20)
+	require.GreaterOrEqual(t, big.curSz, 64<<20)
+	ReturnBuffer(big)
+	ReturnBuffer(nil)
+
+	for i := range bufferPool {
+		for len(bufferPool[i]) > 0 {
+			require.NoError(t, (<-bufferPool[i]).Release())
+		}
+	}
+}
+
 func TestBufferAutoMmap(t *testing.T) {
 	buf := NewBuffer(1<<20, "test").WithAutoMmap(64<<20, "")
 	defer func() { require.NoError(t, buf.Release()) }()
@@ -200,6 +327,124 @@ func TestBufferSlice(t *testing.T) {
 	}
 }
 
+func TestBufferSliceIterateError(t *testing.T) {
+	buffers := newTestBuffers(t, 32)
+
+	for _, buf := range buffers {
+		name := fmt.Sprintf("Using buffer type: %s", buf.bufType)
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, 0, buf.SliceCount())
+			for i := 0; i < 10; i++ {
+				buf.WriteSlice([]byte{byte(i)})
+			}
+			buf.SliceAllocate(0)
+			require.Equal(t, 11, buf.SliceCount())
+
+			errStop := errors.New("stop")
+			var seen int
+			err := buf.SliceIterate(func(slice []byte) error {
+				seen++
+				if slice[0] == 3 {
+					return errStop
+				}
+				return nil
+			})
+			require.ErrorIs(t, err, errStop)
+			require.Equal(t, 4, seen)
+		})
+	}
+}
+
+func TestBufferNumSlices(t *testing.T) {
+	buffers := newTestBuffers(t, 32)
+
+	for _, buf := range buffers {
+		name := fmt.Sprintf("Using buffer type: %s", buf.bufType)
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, 0, buf.NumSlices())
+			for i := 0; i < 10; i++ {
+				buf.WriteSlice([]byte{byte(i)})
+			}
+			buf.SliceAllocate(0)
+			buf.SliceAllocateAligned(3, 8)
+			require.Equal(t, 12, buf.NumSlices())
+			require.Equal(t, buf.SliceCount(), buf.NumSlices())
+
+			buf.Reset()
+			require.Equal(t, 0, buf.NumSlices())
+		})
+	}
+}
+
+func TestBufferSliceChecked(t *testing.T) {
+	buffers := newTestBuffers(t, 32)
+
+	for _, buf := range buffers {
+		name := fmt.Sprintf("Using buffer type: %s", buf.bufType)
+		t.Run(name, func(t *testing.T) {
+			buf.WriteSlice([]byte("abc"))
+			buf.WriteSlice([]byte("de"))
+
+			slice, next, err := buf.SliceChecked(buf.StartOffset())
+			require.NoError(t, err)
+			require.Equal(t, []byte("abc"), slice)
+			slice, next, err = buf.SliceChecked(next)
+			require.NoError(t, err)
+			require.Equal(t, []byte("de"), slice)
+			require.Equal(t, -1, next)
+
+			_, _, err = buf.SliceChecked(buf.StartOffset() - 1)
+			require.Error(t, err)
+			_, _, err = buf.SliceChecked(buf.LenWithPadding())
+			require.Error(t, err)
+			// An offset in the middle of a slice reads a bogus length.
+			_, _, err = buf.SliceChecked(buf.StartOffset() + 4)
+			require.Error(t, err)
+
+			// A corrupted length is reported by SliceIterate too.
+			binary.BigEndian.PutUint64(buf.Bytes(), 1<<40)
+			require.Error(t, buf.SliceIterate(func([]byte) error { return nil }))
+		})
+	}
+}
+
+func TestBufferSliceIterateReverse(t *testing.T) {
+	buffers := newTestBuffers(t, 32)
+
+	for _, buf := range buffers {
+		name := fmt.Sprintf("Using buffer type: %s", buf.bufType)
+		t.Run(name, func(t *testing.T) {
+			require.NoError(t, buf.SliceIterateReverse(func(slice []byte) error {
+				t.Fatal("empty buffer has no slices")
+				return nil
+			}))
+			for i := 0; i < 10; i++ {
+				buf.WriteSlice([]byte{byte(i)})
+			}
+			buf.SliceAllocate(0)
+
+			var got []byte
+			require.NoError(t, buf.SliceIterateReverse(func(slice []byte) error {
+				got = append(got, slice[0])
+				return nil
+			}))
+			require.Equal(t, []byte{9, 8, 7, 6, 5, 4, 3, 2, 1, 0}, got)
+
+			errStop := errors.New("stop")
+			var seen int
+			err := buf.SliceIterateReverse(func(slice []byte) error {
+				seen++
+				if slice[0] == 7 {
+					return errStop
+				}
+				return nil
+			})
+			require.ErrorIs(t, err, errStop)
+			require.Equal(t, 3, seen)
+		})
+	}
+}
+
 func TestBufferSort(t *testing.T) {
 	const capacity = 32
 	bufs := newTestBuffers(t, capacity)
@@ -266,6 +511,26 @@ func TestBufferPadding(t *testing.T) {
 	}
 }
 
+func TestBufferWriteTo(t *testing.T) {
+	var _ io.WriterTo = &Buffer{}
+	bufs := newTestBuffers(t, 1<<10)
+	for _, buf := range bufs {
+		name := fmt.Sprintf("Using buffer type: %s", buf.bufType)
+		t.Run(name, func(t *testing.T) {
+			data := make([]byte, writeToChunkSize+100)
+			rand.Read(data)
+			_, err := buf.Write(data)
+			require.NoError(t, err)
+
+			var out bytes.Buffer
+			n, err := buf.WriteTo(&out)
+			require.NoError(t, err)
+			require.Equal(t, int64(len(data)), n)
+			require.Equal(t, data, out.Bytes())
+		})
+	}
+}
+
 func newTestBuffers(t *testing.T, capacity int) []*Buffer {
 	var bufs []*Buffer
 
@@ -299,3 +564,35 @@ func TestSmallBuffer(t *testing.T) {
 		})
 	})
 }
+
+func TestBufferWriteAt(t *testing.T) {
+	buffers := newTestBuffers(t, 32)
+
+	for _, buf := range buffers {
+		name := fmt.Sprintf("Using buffer type: %s", buf.bufType)
+		t.Run(name, func(t *testing.T) {
+			// Reserve a header, and fill it in once the count is known.
+			header := buf.AllocateOffset(8)
+			for i := 0; i < 100; i++ {
+				buf.WriteString("data")
+			}
+			var count [8]byte
+			binary.BigEndian.PutUint64(count[:], 100)
+			n, err := buf.WriteAt(count[:], header)
+			require.NoError(t, err)
+			require.Equal(t, 8, n)
+			require.Equal(t, uint64(100), binary.BigEndian.Uint64(buf.Bytes()))
+			require.Equal(t, 8+400, buf.LenNoPadding())
+
+			end := buf.LenWithPadding()
+			_, err = buf.WriteAt([]byte("xy"), end-1)
+			require.Error(t, err)
+			_, err = buf.WriteAt([]byte("x"), buf.StartOffset()-1)
+			require.Error(t, err)
+			n, err = buf.WriteAt(nil, end)
+			require.NoError(t, err)
+			require.Zero(t, n)
+			require.Equal(t, end, buf.LenWithPadding())
+		})
+	}
+}
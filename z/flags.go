@@ -3,6 +3,7 @@ package z
 import (
 	"fmt"
 	"log"
+	"math"
 	"os"
 	"os/user"
 	"path/filepath"
@@ -11,6 +12,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/dustin/go-humanize"
 	"github.com/pkg/errors"
 )
 
@@ -257,6 +259,27 @@ func (sf *SuperFlag) GetUint64(opt string) uint64 {
 	return u
 }
 
+// GetBytes returns the size in bytes given by the option, which may be humanized, like "512kb",
+// "64mb" or "2GiB", or a plain number of bytes. As with go-humanize, "kb", "mb" and "gb" are powers
+// of 1000, and "kib", "mib" and "gib" powers of 1024.
+func (sf *SuperFlag) GetBytes(opt string) int64 {
+	val := sf.GetString(opt)
+	if val == "" {
+		return 0
+	}
+	u, err := humanize.ParseBytes(val)
+	if err == nil && u > math.MaxInt64 {
+		err = errors.New("value out of range")
+	}
+	if err != nil {
+		err = errors.Wrapf(err,
+			"Unable to parse %s as bytes for key: %s. Options: %s\n",
+			val, opt, sf)
+		log.Fatalf("%+v", err)
+	}
+	return int64(u)
+}
+
 func (sf *SuperFlag) GetUint32(opt string) uint32 {
 	val := sf.GetString(opt)
 	if val == "" {
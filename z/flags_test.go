@@ -35,6 +35,17 @@ func TestFlag(t *testing.T) {
 	require.Equal(t, time.Hour*24*30, sf.GetDuration("duration-days"))
 }
 
+func TestFlagGetBytes(t *testing.T) {
+	sf := NewSuperFlag(`plain=1024; kb=512kb; mb=64mb; mib=64MiB; gb=2 GB; empty=;`)
+	require.Equal(t, int64(1024), sf.GetBytes("plain"))
+	require.Equal(t, int64(512*1000), sf.GetBytes("kb"))
+	require.Equal(t, int64(64*1000*1000), sf.GetBytes("mb"))
+	require.Equal(t, int64(64<<20), sf.GetBytes("mib"))
+	require.Equal(t, int64(2*1000*1000*1000), sf.GetBytes("gb"))
+	require.Equal(t, int64(0), sf.GetBytes("empty"))
+	require.Equal(t, int64(0), sf.GetBytes("missing"))
+}
+
 func TestFlagDefault(t *testing.T) {
 	def := `one=false; two=; three=;`
 	f := NewSuperFlag(`one=true; two=4;`).MergeAndCheckDefault(def)
@@ -0,0 +1,124 @@
+/*
+ * Copyright 2024 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package z
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"unsafe"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// KeyToHashSip returns a KeyToHash function which hashes keys with SipHash-2-4 keyed by secret.
+// Without the secret, an attacker can't craft keys that collide, or that all land in the same
+// shard, which matters when keys come from untrusted input. Integer keys are hashed too, rather
+// than used as is. Keep the secret random and private, e.g. read it from crypto/rand at startup.
+//
+// SipHash is a few times slower than memhash, which KeyToHash uses, so only use it when
+// hash-flooding is a concern. The conflict hash is computed as in KeyToHash.
+func KeyToHashSip[K Key](secret [16]byte) func(key K) (uint64, uint64) {
+	k0 := binary.LittleEndian.Uint64(secret[:8])
+	k1 := binary.LittleEndian.Uint64(secret[8:])
+	if !isBasicKey[K]() {
+		kind := keyKind[K]()
+		return func(key K) (uint64, uint64) {
+			b, n, isInt := underlyingKey(kind, &key)
+			if isInt {
+				return sipIntKeyToHash(k0, k1, n)
+			}
+			return sipHash24(k0, k1, b), xxhash.Sum64(b)
+		}
+	}
+	return func(key K) (uint64, uint64) {
+		return sipKeyToHash(k0, k1, any(key))
+	}
+}
+
+func sipKeyToHash(k0, k1 uint64, key any) (uint64, uint64) {
+	switch k := key.(type) {
+	case string:
+		b := unsafe.Slice(unsafe.StringData(k), len(k))
+		return sipHash24(k0, k1, b), xxhash.Sum64String(k)
+	case []byte:
+		return sipHash24(k0, k1, k), xxhash.Sum64(k)
+	case uint64, byte, int, int32, uint32, int64:
+		// Integer keys hash to themselves in KeyToHash, which makes a fine conflict hash.
+		h, _ := keyToHash(k)
+		return sipIntKeyToHash(k0, k1, h)
+	}
+	panic("Key type not supported")
+}
+
+func sipIntKeyToHash(k0, k1, h uint64) (uint64, uint64) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], h)
+	return sipHash24(k0, k1, buf[:]), h
+}
+
+// sipHash24 returns the SipHash-2-4 of p keyed by k0 and k1.
+func sipHash24(k0, k1 uint64, p []byte) uint64 {
+	v0 := k0 ^ 0x736f6d6570736575
+	v1 := k1 ^ 0x646f72616e646f6d
+	v2 := k0 ^ 0x6c7967656e657261
+	v3 := k1 ^ 0x7465646279746573
+	t := uint64(len(p)) << 56
+
+	round := func() {
+		v0 += v1
+		v1 = bits.RotateLeft64(v1, 13)
+		v1 ^= v0
+		v0 = bits.RotateLeft64(v0, 32)
+		v2 += v3
+		v3 = bits.RotateLeft64(v3, 16)
+		v3 ^= v2
+		v0 += v3
+		v3 = bits.RotateLeft64(v3, 21)
+		v3 ^= v0
+		v2 += v1
+		v1 = bits.RotateLeft64(v1, 17)
+		v1 ^= v2
+		v2 = bits.RotateLeft64(v2, 32)
+	}
+
+	// Compression.
+	for len(p) >= 8 {
+		m := binary.LittleEndian.Uint64(p)
+		v3 ^= m
+		round()
+		round()
+		v0 ^= m
+		p = p[8:]
+	}
+
+	// Compress the last block, along with the length.
+	for i := len(p) - 1; i >= 0; i-- {
+		t |= uint64(p[i]) << (8 * uint(i))
+	}
+	v3 ^= t
+	round()
+	round()
+	v0 ^= t
+
+	// Finalization.
+	v2 ^= 0xff
+	round()
+	round()
+	round()
+	round()
+	return v0 ^ v1 ^ v2 ^ v3
+}
@@ -18,13 +18,16 @@ package z
 
 import (
 	"context"
+	"reflect"
 	"sync"
+	"unsafe"
 
 	"github.com/cespare/xxhash/v2"
+	"github.com/dgryski/go-farm"
 )
 
 type Key interface {
-	uint64 | string | []byte | byte | int | int32 | uint32 | int64
+	~uint64 | ~string | ~[]byte | ~byte | ~int | ~int32 | ~uint32 | ~int64
 }
 
 // TODO: Figure out a way to re-use memhash for the second uint64 hash,
@@ -35,8 +38,42 @@ type Key interface {
 // anything resembling a 128bit hash, even though that's exactly what
 // we need in this situation.
 func KeyToHash[K Key](key K) (uint64, uint64) {
-	keyAsAny := any(key)
-	switch k := keyAsAny.(type) {
+	if !isBasicKey[K]() {
+		b, n, isInt := underlyingKey(keyKind[K](), &key)
+		if isInt {
+			return n, 0
+		}
+		return MemHash(b), xxhash.Sum64(b)
+	}
+	return keyToHash(any(key))
+}
+
+// KeyToHashFunc returns KeyToHash for keys of type K. The underlying type of K is resolved once
+// here, so keys of a named type, such as type UserID string, hash without reflection per call.
+func KeyToHashFunc[K Key]() func(key K) (uint64, uint64) {
+	if isBasicKey[K]() {
+		return KeyToHash[K]
+	}
+	switch kind := keyKind[K](); kind {
+	case reflect.String:
+		return func(key K) (uint64, uint64) {
+			k := *(*string)(unsafe.Pointer(&key))
+			return MemHashString(k), xxhash.Sum64String(k)
+		}
+	case reflect.Slice:
+		return func(key K) (uint64, uint64) {
+			k := *(*[]byte)(unsafe.Pointer(&key))
+			return MemHash(k), xxhash.Sum64(k)
+		}
+	default:
+		return func(key K) (uint64, uint64) {
+			return intKey(kind, unsafe.Pointer(&key)), 0
+		}
+	}
+}
+
+func keyToHash(key any) (uint64, uint64) {
+	switch k := key.(type) {
 	case uint64:
 		return k, 0
 	case string:
@@ -53,9 +90,125 @@ func KeyToHash[K Key](key K) (uint64, uint64) {
 		return uint64(k), 0
 	case int64:
 		return uint64(k), 0
-	default:
-		panic("Key type not supported")
 	}
+	panic("Key type not supported")
+}
+
+// isBasicKey reports whether K is one of the types listed in Key itself rather than a named type
+// derived from one, in which case the type switches of the hash functions handle its keys.
+func isBasicKey[K Key]() bool {
+	var zero K
+	switch any(zero).(type) {
+	case uint64, string, []byte, byte, int, int32, uint32, int64:
+		return true
+	}
+	return false
+}
+
+// keyKind returns the kind of the underlying type of K.
+func keyKind[K Key]() reflect.Kind {
+	return reflect.TypeOf((*K)(nil)).Elem().Kind()
+}
+
+// underlyingKey views the key of a named type, whose underlying type has the given kind, as that
+// type without copying it. String and []byte keys are returned as b, which hashes the same for
+// both, and integer keys as n, converted the way KeyToHash converts them.
+func underlyingKey[K Key](kind reflect.Kind, key *K) (b []byte, n uint64, isInt bool) {
+	switch kind {
+	case reflect.String:
+		k := *(*string)(unsafe.Pointer(key))
+		return unsafe.Slice(unsafe.StringData(k), len(k)), 0, false
+	case reflect.Slice:
+		return *(*[]byte)(unsafe.Pointer(key)), 0, false
+	}
+	return nil, intKey(kind, unsafe.Pointer(key)), true
+}
+
+// intKey reads the integer key at p, whose underlying type has the given kind.
+func intKey(kind reflect.Kind, p unsafe.Pointer) uint64 {
+	switch kind {
+	case reflect.Uint64:
+		return *(*uint64)(p)
+	case reflect.Uint8:
+		return uint64(*(*uint8)(p))
+	case reflect.Int:
+		return uint64(*(*int)(p))
+	case reflect.Int32:
+		return uint64(*(*int32)(p))
+	case reflect.Uint32:
+		return uint64(*(*uint32)(p))
+	case reflect.Int64:
+		return uint64(*(*int64)(p))
+	}
+	panic("Key type not supported")
+}
+
+// KeyToHashSeeded hashes key with the given seed. Different seeds give independent hashes for the
+// same key, which is what rendezvous or consistent hashing need to route keys. Unlike KeyToHash,
+// integer keys are mixed with the seed rather than hashed to themselves.
+// NOTE: Like MemHash, hashes of string and []byte keys change for every process.
+func KeyToHashSeeded[K Key](key K, seed uint64) uint64 {
+	if !isBasicKey[K]() {
+		b, n, isInt := underlyingKey(keyKind[K](), &key)
+		if isInt {
+			return mix64(n ^ seed)
+		}
+		return memHashSeeded(b, seed)
+	}
+	return keyToHashSeeded(any(key), seed)
+}
+
+func keyToHashSeeded(key any, seed uint64) uint64 {
+	switch k := key.(type) {
+	case string:
+		return memHashStringSeeded(k, seed)
+	case []byte:
+		return memHashSeeded(k, seed)
+	case uint64, byte, int, int32, uint32, int64:
+		h, _ := keyToHash(k)
+		return mix64(h ^ seed)
+	}
+	panic("Key type not supported")
+}
+
+// mix64 is the finalizer of splitmix64, which spreads every input bit over the whole output.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// StableKeyToHash works like KeyToHash, but the hashes it produces for string
+// and []byte keys are stable across processes and machines. It uses farm
+// fingerprint instead of memhash, whose seed changes on every process start.
+// Use it when hashes get persisted or shared with other processes, e.g. to
+// build hash-indexed structures on disk. It is slower than KeyToHash, which
+// should remain the default for in-memory caches.
+func StableKeyToHash[K Key](key K) (uint64, uint64) {
+	if !isBasicKey[K]() {
+		b, n, isInt := underlyingKey(keyKind[K](), &key)
+		if isInt {
+			return n, 0
+		}
+		return farm.Fingerprint64(b), xxhash.Sum64(b)
+	}
+	return stableKeyToHash(any(key))
+}
+
+func stableKeyToHash(key any) (uint64, uint64) {
+	switch k := key.(type) {
+	case string:
+		return farm.Fingerprint64([]byte(k)), xxhash.Sum64String(k)
+	case []byte:
+		return farm.Fingerprint64(k), xxhash.Sum64(k)
+	case uint64, byte, int, int32, uint32, int64:
+		// Integer keys are hashed to themselves, which is already stable.
+		return keyToHash(k)
+	}
+	panic("Key type not supported")
 }
 
 var (
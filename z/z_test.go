@@ -54,6 +54,62 @@ func TestKeyToHash(t *testing.T) {
 	verifyHashProduct(t, 3, 0, key, conflict)
 }
 
+func TestStableKeyToHash(t *testing.T) {
+	key, conflict := StableKeyToHash("ristretto")
+	// These values must never change across processes or releases.
+	verifyHashProduct(t, 0x85e72e61bc619f88, 0xc71acb8846c55ce3, key, conflict)
+
+	bkey, bconflict := StableKeyToHash([]byte("ristretto"))
+	verifyHashProduct(t, key, conflict, bkey, bconflict)
+
+	key, conflict = StableKeyToHash(int64(3))
+	verifyHashProduct(t, 3, 0, key, conflict)
+}
+
+type (
+	namedStringKey string
+	namedBytesKey  []byte
+	namedIntKey    int64
+)
+
+func TestKeyToHashNamedTypes(t *testing.T) {
+	key, conflict := KeyToHash("ristretto")
+	nkey, nconflict := KeyToHash(namedStringKey("ristretto"))
+	verifyHashProduct(t, key, conflict, nkey, nconflict)
+	nkey, nconflict = KeyToHash(namedBytesKey("ristretto"))
+	verifyHashProduct(t, key, conflict, nkey, nconflict)
+	nkey, nconflict = KeyToHash(namedIntKey(-2))
+	verifyHashProduct(t, math.MaxUint64-1, 0, nkey, nconflict)
+
+	key, conflict = StableKeyToHash("ristretto")
+	nkey, nconflict = StableKeyToHash(namedStringKey("ristretto"))
+	verifyHashProduct(t, key, conflict, nkey, nconflict)
+
+	require.Equal(t, KeyToHashSeeded("ristretto", 1), KeyToHashSeeded(namedBytesKey("ristretto"), 1))
+	require.Equal(t, KeyToHashSeeded(int64(3), 1), KeyToHashSeeded(namedIntKey(3), 1))
+
+	var secret [16]byte
+	key, conflict = KeyToHashSip[string](secret)("ristretto")
+	nkey, nconflict = KeyToHashSip[namedStringKey](secret)("ristretto")
+	verifyHashProduct(t, key, conflict, nkey, nconflict)
+}
+
+func TestKeyToHashFunc(t *testing.T) {
+	key, conflict := KeyToHash("ristretto")
+	nkey, nconflict := KeyToHashFunc[namedStringKey]()("ristretto")
+	verifyHashProduct(t, key, conflict, nkey, nconflict)
+	nkey, nconflict = KeyToHashFunc[namedBytesKey]()(namedBytesKey("ristretto"))
+	verifyHashProduct(t, key, conflict, nkey, nconflict)
+	nkey, nconflict = KeyToHashFunc[namedIntKey]()(-2)
+	verifyHashProduct(t, math.MaxUint64-1, 0, nkey, nconflict)
+	nkey, nconflict = KeyToHashFunc[string]()("ristretto")
+	verifyHashProduct(t, key, conflict, nkey, nconflict)
+
+	keyToHash := KeyToHashFunc[namedStringKey]()
+	skey := namedStringKey("ristretto")
+	require.Zero(t, testing.AllocsPerRun(100, func() { keyToHash(skey) }))
+}
+
 func TestMulipleSignals(t *testing.T) {
 	closer := NewCloser(0)
 	require.NotPanics(t, func() { closer.Signal() })
@@ -105,3 +161,34 @@ func TestZeroOut(t *testing.T) {
 	ZeroOut(dst, 0, len(dst))
 	check(dst, 0x00)
 }
+
+func TestKeyToHashSeeded(t *testing.T) {
+	require.Equal(t, KeyToHashSeeded("ristretto", 1), KeyToHashSeeded([]byte("ristretto"), 1))
+	require.NotEqual(t, KeyToHashSeeded("ristretto", 1), KeyToHashSeeded("ristretto", 2))
+	require.Equal(t, KeyToHashSeeded(uint64(3), 1), KeyToHashSeeded(int64(3), 1))
+	require.NotEqual(t, KeyToHashSeeded(uint64(3), 1), KeyToHashSeeded(uint64(3), 2))
+	require.NotEqual(t, KeyToHashSeeded(uint64(3), 1), KeyToHashSeeded(uint64(4), 1))
+}
+
+func TestKeyToHashSip(t *testing.T) {
+	var secret [16]byte
+	for i := range secret {
+		secret[i] = byte(i)
+	}
+	// Test vectors from the SipHash paper.
+	msg := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14}
+	require.Equal(t, uint64(0xa129ca6149be45e5), sipHash24(0x0706050403020100, 0x0f0e0d0c0b0a0908, msg))
+	require.Equal(t, uint64(0x726fdb47dd0e0e31), sipHash24(0x0706050403020100, 0x0f0e0d0c0b0a0908, nil))
+
+	h := KeyToHashSip[string](secret)
+	k1, c1 := h("foo")
+	k2, c2 := KeyToHashSip[[]byte](secret)([]byte("foo"))
+	require.Equal(t, k1, k2)
+	require.Equal(t, c1, c2)
+	k3, _ := KeyToHashSip[string]([16]byte{1})("foo")
+	require.NotEqual(t, k1, k3)
+
+	ki, ci := KeyToHashSip[uint64](secret)(42)
+	require.NotEqual(t, uint64(42), ki)
+	require.Equal(t, uint64(42), ci)
+}